@@ -0,0 +1,70 @@
+package client
+
+import (
+	"log"
+	"mini-rpc/metadata"
+	"mini-rpc/transport"
+	"sync/atomic"
+)
+
+// Call states — a Call moves from pending to exactly one of completed or canceled.
+const (
+	callPending   int32 = iota // Request in flight
+	callCompleted              // Response (or error) is being / has been delivered
+	callCanceled               // Caller gave up; a late response must be dropped
+)
+
+// Call represents an active or completed asynchronous RPC, in the spirit of net/rpc.Call.
+//
+// Created by Client.Go; once the call finishes, the Call itself is sent on Done.
+// Error and Reply must only be read after receiving from Done.
+type Call struct {
+	ServiceMethod string      // The name of the service and method to call, e.g., "Arith.Add"
+	Args          any         // The argument to the function
+	Reply         any         // The reply from the function (pointer, filled on success)
+	Error         error       // After completion, the error status
+	Metadata      metadata.MD // After completion, the response metadata set by the server (nil if none)
+	Done          chan *Call  // Receives the Call itself when it completes
+
+	transport *transport.ClientTransport // Transport the request was sent on (nil if never sent)
+	seq       uint32                     // Sequence number on that transport, used for cancellation
+	state     atomic.Int32               // callPending → callCompleted | callCanceled
+	logger    *log.Logger                // The client's logger
+}
+
+// begin claims the right to deliver the result. It returns false if the call
+// was already cancelled, in which case the caller must not touch Reply.
+func (call *Call) begin() bool {
+	return call.state.CompareAndSwap(callPending, callCompleted)
+}
+
+// complete records the outcome and signals Done. Must be preceded by a successful begin().
+func (call *Call) complete(err error) {
+	call.Error = err
+	select {
+	case call.Done <- call:
+	default:
+		// Never block recvLoop — a full Done channel is a caller bug, not a transport problem
+		call.logger.Println("rpc: discarding Call reply due to insufficient Done chan capacity")
+	}
+}
+
+// finish completes a call that failed before (or while) being sent.
+func (call *Call) finish(err error) {
+	if call.begin() {
+		call.complete(err)
+	}
+}
+
+// cancel abandons the call: the pending entry is removed from the transport so
+// recvLoop drops the late response. It returns false if the response already
+// won the race, in which case the caller should wait on Done as usual.
+func (call *Call) cancel() bool {
+	if !call.state.CompareAndSwap(callPending, callCanceled) {
+		return false
+	}
+	if call.transport != nil {
+		call.transport.Cancel(call.seq)
+	}
+	return true
+}
@@ -3,141 +3,322 @@
 //
 // Call flow:
 //
-//	Call("Arith.Add", args, reply)
+//	CallContext(ctx, "Arith.Add", args, reply)
 //	  → Registry.Discover("Arith")    → get instance list from etcd
 //	  → Balancer.Pick(instances)      → select one address
-//	  → getTransport(addr)            → get a shared transport (round-robin)
-//	  → transport.Send()              → send request, get response channel
-//	  → <-channel                     → wait for response
-//	  → json.Unmarshal → reply        → done
+//	  → getTransport(addr)            → get a shared transport (round-robin, redialed if broken)
+//	  → transport.SendAsync()         → send request (with deadline), register completion handler
+//	  → recvLoop: decode payload      → reply filled, Call sent on call.Done
+//	  → <-call.Done or <-ctx.Done()   → done (or cancelled)
+//
+// Go() follows the same path but returns the *Call immediately instead of waiting on it.
 package client
 
 import (
-	"encoding/json"
-	"fmt"
+	"context"
+	"crypto/tls"
+	"log"
 	"mini-rpc/codec"
+	"mini-rpc/compressor"
 	"mini-rpc/loadbalance"
+	"mini-rpc/message"
+	"mini-rpc/metadata"
+	"mini-rpc/protocol"
 	"mini-rpc/registry"
+	"mini-rpc/status"
 	"mini-rpc/transport"
 	"net"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 // Client manages the full RPC call lifecycle: service discovery → load balancing → transport → call.
 type Client struct {
-	registry   registry.Registry                       // Service discovery (etcd or mock)
-	balancer   loadbalance.Balancer                    // Load balancing strategy
-	transports map[string][]*transport.ClientTransport // Per-address transport pool (shared, not borrowed)
-	codecType  codec.CodecType                         // Serialization format
-	mu         sync.Mutex                              // Protects transports map (not the transports themselves)
-	poolSize   int                                     // Number of transports per address
-	counter    uint64                                  // Atomic counter for round-robin transport selection
+	registry   registry.Registry    // Service discovery (etcd or mock)
+	balancer   loadbalance.Balancer // Load balancing strategy
+	transports map[string]*addrPool // Per-address transport pool (shared, not borrowed)
+	codecType  codec.CodecType      // Serialization format
+	compressor compressor.Type      // Default request compression (per-call override: compressor.NewContext)
+	mu         sync.Mutex           // Protects transports map and the pools in it (not the transports themselves)
+	poolSize   int                  // Number of transports per address
+	counter    uint64               // Atomic counter for round-robin transport selection
+	closed     atomic.Bool          // Set (under mu) by Close; no transport is created after that
+
+	dialer      Dialer        // Opens the pool connections (default: a plain net.Dialer)
+	dialTimeout time.Duration // Bound on each dial (default DefaultDialTimeout, 0 = none)
+	tlsConfig   *tls.Config   // Pool connections run over TLS, if set
+
+	heartbeatInterval time.Duration // Passed on to every transport
+	heartbeatMisses   int           // Passed on to every transport
+	maxRequestSize    int           // Passed on to every transport
+	maxResponseSize   int           // Passed on to every transport
+	callTimeout       time.Duration // Deadline of calls whose ctx has none (0 = none)
+	logger            *log.Logger
+}
+
+// ErrClientClosed is the error of every call cut short by Close, and of every call made after it.
+var ErrClientClosed = transport.ErrClientClosed
+
+// New creates a client that discovers servers through reg and spreads calls over them
+// with bal, configured by opts (see Option).
+func New(reg registry.Registry, bal loadbalance.Balancer, opts ...Option) *Client {
+	c := &Client{
+		registry:   reg,
+		balancer:   bal,
+		transports: make(map[string]*addrPool),
+		codecType:  codec.CodecTypeJSON,
+		poolSize:   1,
+
+		dialer:      &net.Dialer{},
+		dialTimeout: DefaultDialTimeout,
+
+		heartbeatInterval: transport.DefaultHeartbeatInterval,
+		heartbeatMisses:   transport.DefaultHeartbeatMisses,
+		maxRequestSize:    protocol.DefaultMaxBodySize,
+		maxResponseSize:   protocol.DefaultMaxBodySize,
+		logger:            log.Default(),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	c.poolSize = max(c.poolSize, 1)
+	return c
 }
 
 // NewClient creates a client with the given registry, load balancer, codec type, and pool size.
+// It is a shorthand for New(reg, bal, WithCodec(codecType), WithPoolSize(poolSize)).
 //
 // poolSize determines how many TCP connections are maintained per server address.
 // Each connection supports multiplexing, so even poolSize=1 handles concurrent calls.
-// Larger pools reduce write lock contention under very high concurrency.
+// Larger pools spread the load over several writer goroutines and sockets under very high concurrency.
 func NewClient(reg registry.Registry, bal loadbalance.Balancer, codecType byte, poolSize int) *Client {
-	return &Client{
-		registry:   reg,
-		balancer:   bal,
-		transports: make(map[string][]*transport.ClientTransport),
-		codecType:  codec.CodecType(codecType),
-		poolSize:   poolSize,
-	}
+	return New(reg, bal, WithCodec(codec.CodecType(codecType)), WithPoolSize(poolSize))
 }
 
-// getTransport returns a shared transport for the given address using round-robin selection.
+// Close shuts the client down: every pooled connection is closed (see
+// transport.ClientTransport.Close), every call still waiting for its response fails with
+// ErrClientClosed, open streams are aborted, and every later call fails with ErrClientClosed
+// without touching the network. A dial still in flight is closed as soon as it connects.
 //
-// Design: transports are SHARED, not borrowed/returned. Since each ClientTransport supports
-// multiplexing, there's no need to exclusively hold a transport during a call. The transport
-// is only "used" during Send() (a few microseconds), not during the entire call (which includes
-// waiting for the response). Shared access avoids 95% idle time from exclusive holding.
-//
-// Lock strategy:
-//   - mu.Lock protects the transports map (read + write). This is nanosecond-level.
-//   - net.Dial is inside the lock only on first access (pool creation). Subsequent calls
-//     just read the map and select via atomic counter — no lock needed for selection.
-func (c *Client) getTransport(addr string) (*transport.ClientTransport, error) {
-	// Atomic counter for round-robin — each goroutine captures its own value (no race)
-	n := atomic.AddUint64(&c.counter, 1)
-
-	// Lock only to protect map access (not transport usage)
+// The transports' goroutines exit right after, so a short-lived client leaves nothing behind.
+// Closing twice is a no-op.
+func (c *Client) Close() error {
 	c.mu.Lock()
-	pool, ok := c.transports[addr]
-
-	if !ok {
-		// First access to this address — create all transports upfront
-		pool = make([]*transport.ClientTransport, c.poolSize)
-		c.transports[addr] = pool
-		for i := 0; i < c.poolSize; i++ {
-			conn, err := net.Dial("tcp", addr)
-			if err != nil {
-				c.mu.Unlock()
-				return nil, err
+	if c.closed.Load() {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed.Store(true)
+	var ts []*transport.ClientTransport
+	for _, pool := range c.transports {
+		for _, slot := range pool.slots {
+			if slot.t != nil {
+				ts = append(ts, slot.t)
 			}
-			pool[i] = transport.NewClientTransport(conn, c.codecType)
 		}
 	}
+	clear(c.transports)
 	c.mu.Unlock()
 
-	// Round-robin selection — lock-free, uses the captured counter value
-	return pool[n%uint64(c.poolSize)], nil
+	// Outside the lock: each Close waits for its recvLoop to fail the pending calls
+	for _, t := range ts {
+		t.Close()
+	}
+	return nil
 }
 
-// Call performs a synchronous RPC call.
+// withCompressor applies the client's default compressor to ctx, unless the call chose its own.
+func (c *Client) withCompressor(ctx context.Context) context.Context {
+	if _, ok := compressor.FromContext(ctx); ok || c.compressor == compressor.None {
+		return ctx
+	}
+	return compressor.NewContext(ctx, c.compressor)
+}
+
+// Call performs a synchronous RPC call without a deadline.
+// It is equivalent to CallContext(context.Background(), ...).
+func (c *Client) Call(serviceMethod string, args any, reply any) error {
+	return c.CallContext(context.Background(), serviceMethod, args, reply)
+}
+
+// CallContext performs a synchronous RPC call bounded by ctx.
+//
+// If ctx is cancelled or its deadline expires before the response arrives, CallContext
+// stops waiting, removes the pending request from the transport, and returns ctx.Err().
+// The deadline (if any) is also sent to the server, so the handler's ctx expires too.
+//
+// Server-side failures are returned as *status.Status:
+//
+//	var st *status.Status
+//	if errors.As(err, &st) && st.Code == status.NotFound { ... }
+//
+// Per-call metadata is attached through ctx:
+//
+//	ctx = metadata.AppendToOutgoingContext(ctx, "trace-id", traceID)
+//	err := cli.CallContext(ctx, "Arith.Add", args, reply)
+//
+// and the metadata the server sent back (metadata.SetResponse) is read the same way:
+//
+//	var header metadata.MD
+//	err := cli.CallContext(metadata.ReceiveResponse(ctx, &header), "Arith.Add", args, reply)
+//
+// A ctx without a deadline gets the client's default call timeout, if any (WithCallTimeout).
+//
+// Internally a synchronous call is just an asynchronous call that we wait on:
+// send() fires the request, then we block on call.Done or ctx.Done().
+func (c *Client) CallContext(ctx context.Context, serviceMethod string, args any, reply any) error {
+	if _, ok := ctx.Deadline(); !ok && c.callTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.callTimeout)
+		defer cancel()
+	}
+	call := c.send(ctx, serviceMethod, args, reply, make(chan *Call, 1))
+
+	select {
+	case call = <-call.Done:
+	case <-ctx.Done():
+		// On cancellation the pending entry is removed, so a late response is dropped
+		// instead of leaking in the pending map. If the response won the race and is
+		// already being delivered, wait for it — reply may be half-written otherwise.
+		if call.cancel() {
+			return ctx.Err()
+		}
+		call = <-call.Done
+	}
+	// The response metadata, for callers that asked with metadata.ReceiveResponse
+	if md := metadata.ResponseReceiver(ctx); md != nil {
+		*md = call.Metadata
+	}
+	return call.Error
+}
+
+// Go invokes the RPC asynchronously and returns immediately, in the spirit of net/rpc.
+// The returned Call is sent on done once the response arrives (or the call fails).
+//
+// If done is nil, a new buffered channel is allocated. If non-nil, done must be buffered,
+// and can be shared by many calls to collect them in completion order:
+//
+//	done := make(chan *client.Call, len(jobs))
+//	for _, j := range jobs {
+//	    cli.Go("Arith.Add", j.args, j.reply, done)
+//	}
+//	for range jobs {
+//	    call := <-done // call.Error, call.Reply
+//	}
+//
+// No goroutine is spawned per call: completion is driven by the transport's recvLoop.
+func (c *Client) Go(serviceMethod string, args any, reply any, done chan *Call) *Call {
+	if done == nil {
+		done = make(chan *Call, 10) // Buffered, same default as net/rpc
+	} else if cap(done) == 0 {
+		// An unbuffered channel would block recvLoop and stall every call on the connection
+		log.Panic("rpc: done channel is unbuffered")
+	}
+	return c.send(context.Background(), serviceMethod, args, reply, done)
+}
+
+// Notify invokes a method without waiting for it: the request is sent one-way
+// (protocol.FlagOneWay), so the server runs the handler and sends nothing back.
+// The returned error only covers getting the request onto the wire; the handler's
+// result, including any error, is discarded.
+func (c *Client) Notify(ctx context.Context, serviceMethod string, args any) error {
+	t, err := c.pickTransport(ctx, serviceMethod)
+	if err != nil {
+		return err
+	}
+	return t.SendOneWay(c.withCompressor(ctx), serviceMethod, args)
+}
+
+// send resolves a transport for serviceMethod and fires the request.
+// Any failure before the request hits the wire completes the Call immediately.
 //
 // Steps:
 //  1. Parse serviceMethod ("Arith.Add" → service="Arith")
 //  2. Discover instances from registry
 //  3. Pick an instance using load balancer
 //  4. Get a shared transport for that instance
-//  5. Send the request and wait for the response
-//  6. Unmarshal the response payload into reply
-func (c *Client) Call(serviceMethod string, args any, reply any) error {
+//  5. Send the request; recvLoop decodes the response into reply and completes the Call
+func (c *Client) send(ctx context.Context, serviceMethod string, args any, reply any, done chan *Call) *Call {
+	call := &Call{
+		ServiceMethod: serviceMethod,
+		Args:          args,
+		Reply:         reply,
+		Done:          done,
+		logger:        c.logger,
+	}
+
+	// Steps 1-4: service discovery → load balancing → shared transport
+	t, err := c.pickTransport(ctx, serviceMethod)
+	if err != nil {
+		call.finish(err)
+		return call
+	}
+
+	// Step 5: Send the request — the handler runs on recvLoop once the response arrives
+	seq, err := t.SendAsync(c.withCompressor(ctx), serviceMethod, args, func(resp *message.RPCMessage) {
+		if !call.begin() {
+			return // Cancelled by the caller, drop the late response
+		}
+		call.Metadata = resp.Metadata
+		// Check for server-side errors — returned as *status.Status so callers can use errors.As
+		if st := resp.Status(); st != nil {
+			if st.Code == status.Canceled && c.closed.Load() {
+				call.complete(ErrClientClosed) // Failed by Close, not by the server
+				return
+			}
+			call.complete(st)
+			return
+		}
+		// Decode the payload into the reply struct with the client's codec
+		call.complete(codec.GetCodec(c.codecType).Decode(resp.Payload, reply))
+	})
+	if err != nil {
+		call.finish(err)
+		return call
+	}
+	call.transport = t
+	call.seq = seq
+	return call
+}
+
+// pickTransport runs service discovery and load balancing for serviceMethod
+// and returns a shared transport to the selected instance. If the transport is still being
+// dialed, it waits for the dial, or until ctx is done (then ctx.Err() is returned as is).
+func (c *Client) pickTransport(ctx context.Context, serviceMethod string) (*transport.ClientTransport, error) {
+	if c.closed.Load() {
+		return nil, ErrClientClosed
+	}
+
 	// Step 1: Parse service name from "Service.Method" format
 	split := strings.Split(serviceMethod, ".")
 	if len(split) != 2 {
-		return fmt.Errorf("invalid serviceMethod format: %v", serviceMethod)
+		return nil, status.Errorf(status.InvalidArgument, "invalid serviceMethod format: %v", serviceMethod)
 	}
 	serviceName := split[0]
 
 	// Step 2: Discover available instances from the registry
+	// Discovery, balancing and dial failures all mean "no server to talk to right now",
+	// so they are reported as Unavailable — the code callers treat as retryable.
 	instances, err := c.registry.Discover(serviceName)
 	if err != nil {
-		return err
+		return nil, status.Errorf(status.Unavailable, "discover %s: %v", serviceName, err)
 	}
 
 	// Step 3: Select one instance using the load balancer
 	instance, err := c.balancer.Pick(instances)
 	if err != nil {
-		return err
+		return nil, status.Errorf(status.Unavailable, "pick instance for %s: %v", serviceName, err)
 	}
 
 	// Step 4: Get a shared transport for the selected instance's address
-	t, err := c.getTransport(instance.Addr)
-	if err != nil {
-		return err
+	t, err := c.getTransport(ctx, instance.Addr)
+	if err != nil && (err == ctx.Err() || err == ErrClientClosed) {
+		return nil, err
 	}
-
-	// Step 5: Send the request — returns immediately with a response channel
-	_, ch, err := t.Send(serviceMethod, args)
 	if err != nil {
-		return err
+		return nil, status.Errorf(status.Unavailable, "connect to %s: %v", instance.Addr, err)
 	}
-
-	// Block until the response arrives (routed by recvLoop via sequence number)
-	resp := <-ch
-
-	// Check for server-side errors
-	if resp.Error != "" {
-		return fmt.Errorf("server error: %v", resp.Error)
-	}
-
-	// Step 6: Unmarshal the JSON payload into the reply struct
-	return json.Unmarshal(resp.Payload, &reply)
+	return t, nil
 }
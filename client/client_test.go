@@ -1,13 +1,37 @@
 package client
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"log"
+	"math/big"
 	"mini-rpc/codec"
+	"mini-rpc/compressor"
+	"mini-rpc/internal/leakcheck"
 	"mini-rpc/loadbalance"
+	"mini-rpc/message"
+	"mini-rpc/metadata"
 	"mini-rpc/middleware"
 	"mini-rpc/registry"
 	"mini-rpc/server"
+	"mini-rpc/status"
+	"mini-rpc/transport"
+	"net"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"google.golang.org/protobuf/types/known/wrapperspb"
 )
 
 // ---- 测试用的服务 ----
@@ -27,6 +51,103 @@ func (a *Arith) Add(args *Args, reply *Reply) error {
 	return nil
 }
 
+// Div 除数为 0 时返回带错误码的 status
+func (a *Arith) Div(args *Args, reply *Reply) error {
+	if args.B == 0 {
+		return status.Error(status.InvalidArgument, "division by zero")
+	}
+	reply.Result = args.A / args.B
+	return nil
+}
+
+// Sleep 睡 A 毫秒后返回，用来模拟慢 handler
+func (a *Arith) Sleep(args *Args, reply *Reply) error {
+	time.Sleep(time.Duration(args.A) * time.Millisecond)
+	reply.Result = args.A
+	return nil
+}
+
+type CountArgs struct {
+	N    int
+	Fail bool // 发完 N 个元素后返回错误
+}
+
+// Counter 是流式服务：依次推送 0..N-1
+type Counter struct {
+	stopped chan error // handler 退出时把 Send 的错误写进来，用来验证客户端取消能传到服务端
+}
+
+func (c *Counter) Count(args *CountArgs, stream server.Stream) error {
+	for i := 0; i < args.N; i++ {
+		if err := stream.Send(i); err != nil {
+			c.stopped <- err
+			return err
+		}
+	}
+	// 发送的元素个数作为 trailer 随流结束帧返回
+	metadata.SetResponse(stream.Context(), metadata.Pairs("sent", strconv.Itoa(args.N)))
+	if args.Fail {
+		return status.Error(status.DataLoss, "scan interrupted")
+	}
+	return nil
+}
+
+// Sum 是客户端流：累加客户端发来的所有数，CloseSend 后返回总和
+func (c *Counter) Sum(stream server.Stream, reply *Reply) error {
+	for {
+		var n int
+		err := stream.Recv(&n)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if n < 0 {
+			return status.Error(status.InvalidArgument, "negative number")
+		}
+		reply.Result += n
+	}
+}
+
+// Echo 是双向流：每收到一个数就回一个它的两倍
+func (c *Counter) Echo(stream server.Stream) error {
+	for {
+		var n int
+		err := stream.Recv(&n)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(n * 2); err != nil {
+			return err
+		}
+	}
+}
+
+// Greeter 的参数和返回值都是 protobuf 消息，用于测试 Protobuf codec
+type Greeter struct{}
+
+func (g *Greeter) Hello(args *wrapperspb.StringValue, reply *wrapperspb.StringValue) error {
+	reply.Value = "hello " + args.GetValue()
+	return nil
+}
+
+// Text 返回大段文本，用于测试压缩
+type Text struct{}
+
+type RepeatArgs struct {
+	S string
+	N int
+}
+
+func (t *Text) Repeat(args *RepeatArgs, reply *string) error {
+	*reply = strings.Repeat(args.S, args.N)
+	return nil
+}
+
 // ---- Mock Registry（不依赖 etcd）----
 
 type MockRegistry struct {
@@ -140,3 +261,834 @@ func TestClientMultipleInstances(t *testing.T) {
 
 	t.Log("Multi-instance load balancing test passed!")
 }
+
+func TestCallContextDeadline(t *testing.T) {
+	// 用中间件记录 server 端 handler 拿到的 ctx 是否带 deadline
+	deadlineSeen := make(chan bool, 1)
+	svr := server.NewServer()
+	svr.Use(func(next middleware.HandlerFunc) middleware.HandlerFunc {
+		return func(ctx context.Context, req *message.RPCMessage) *message.RPCMessage {
+			_, ok := ctx.Deadline()
+			deadlineSeen <- ok
+			return next(ctx, req)
+		}
+	})
+	if err := svr.Register(&Arith{}); err != nil {
+		t.Fatal(err)
+	}
+	go svr.Serve("tcp", ":18083", "", nil)
+	time.Sleep(100 * time.Millisecond)
+
+	reg := NewMockRegistry()
+	reg.Register("Arith", registry.ServiceInstance{Addr: "127.0.0.1:18083", Weight: 1}, 10)
+	client := NewClient(reg, &loadbalance.RoundRobinBalancer{}, byte(codec.CodecTypeJSON), 1)
+
+	// handler 睡 500ms，ctx 只给 50ms，应该很快返回 DeadlineExceeded
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err := client.CallContext(ctx, "Arith.Sleep", &Args{A: 500}, &Reply{})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expect context.DeadlineExceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 300*time.Millisecond {
+		t.Fatalf("CallContext should return on deadline, took %v", elapsed)
+	}
+	if !<-deadlineSeen {
+		t.Fatal("expect server-side ctx to carry the client's deadline")
+	}
+
+}
+
+func TestCallContextCanceled(t *testing.T) {
+	svr := server.NewServer()
+	if err := svr.Register(&Arith{}); err != nil {
+		t.Fatal(err)
+	}
+	go svr.Serve("tcp", ":18084", "", nil)
+	time.Sleep(100 * time.Millisecond)
+
+	reg := NewMockRegistry()
+	reg.Register("Arith", registry.ServiceInstance{Addr: "127.0.0.1:18084", Weight: 1}, 10)
+	client := NewClient(reg, &loadbalance.RoundRobinBalancer{}, byte(codec.CodecTypeJSON), 1)
+
+	// 已经取消的 ctx：不发请求，直接返回 Canceled
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := client.CallContext(ctx, "Arith.Add", &Args{A: 1, B: 2}, &Reply{}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expect context.Canceled, got %v", err)
+	}
+
+	// 调用中途取消
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	if err := client.CallContext(ctx, "Arith.Sleep", &Args{A: 500}, &Reply{}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expect context.Canceled, got %v", err)
+	}
+
+	// 之后的正常调用不受影响
+	reply := &Reply{}
+	if err := client.Call("Arith.Add", &Args{A: 1, B: 2}, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Result != 3 {
+		t.Fatalf("expect 3, got %d", reply.Result)
+	}
+}
+
+func TestGo(t *testing.T) {
+	svr := server.NewServer()
+	if err := svr.Register(&Arith{}); err != nil {
+		t.Fatal(err)
+	}
+	go svr.Serve("tcp", ":18085", "", nil)
+	time.Sleep(100 * time.Millisecond)
+
+	reg := NewMockRegistry()
+	reg.Register("Arith", registry.ServiceInstance{Addr: "127.0.0.1:18085", Weight: 1}, 10)
+	client := NewClient(reg, &loadbalance.RoundRobinBalancer{}, byte(codec.CodecTypeJSON), 2)
+
+	// 一次性发出 50 个异步调用，共用一个 done channel，再统一收集
+	const n = 50
+	done := make(chan *Call, n)
+	for i := 0; i < n; i++ {
+		client.Go("Arith.Add", &Args{A: i, B: i}, &Reply{}, done)
+	}
+
+	seen := make(map[int]bool)
+	for i := 0; i < n; i++ {
+		call := <-done
+		if call.Error != nil {
+			t.Fatalf("call failed: %v", call.Error)
+		}
+		args := call.Args.(*Args)
+		if got := call.Reply.(*Reply).Result; got != args.A*2 {
+			t.Fatalf("expect %d, got %d", args.A*2, got)
+		}
+		seen[args.A] = true
+	}
+	if len(seen) != n {
+		t.Fatalf("expect %d distinct calls, got %d", n, len(seen))
+	}
+
+	// 发现失败（没有实例）时，Call 立刻带着错误完成
+	call := <-client.Go("Unknown.Add", &Args{}, &Reply{}, nil).Done
+	if call.Error == nil {
+		t.Fatal("expect error for service without instances")
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	// server 端中间件：读请求 metadata，用 SetResponse 把 trace-id 回写到响应 metadata
+	svr := server.NewServer()
+	svr.Use(func(next middleware.HandlerFunc) middleware.HandlerFunc {
+		return func(ctx context.Context, req *message.RPCMessage) *message.RPCMessage {
+			md, _ := metadata.FromIncomingContext(ctx)
+			if err := metadata.SetResponse(ctx, metadata.Pairs("echo-trace-id", md.Get("trace-id"), "tenant", md.Get("tenant"))); err != nil {
+				t.Error(err)
+			}
+			return next(ctx, req)
+		}
+	})
+	if err := svr.Register(&Arith{}); err != nil {
+		t.Fatal(err)
+	}
+	go svr.Serve("tcp", ":18086", "", nil)
+	time.Sleep(100 * time.Millisecond)
+
+	reg := NewMockRegistry()
+	reg.Register("Arith", registry.ServiceInstance{Addr: "127.0.0.1:18086", Weight: 1}, 10)
+
+	// JSON 和 Binary 两种 codec 都要能携带 metadata
+	for _, ct := range []codec.CodecType{codec.CodecTypeJSON, codec.CodecTypeBinary} {
+		client := NewClient(reg, &loadbalance.RoundRobinBalancer{}, byte(ct), 1)
+
+		ctx := metadata.NewOutgoingContext(context.Background(), metadata.Pairs("trace-id", "abc123"))
+		ctx = metadata.AppendToOutgoingContext(ctx, "tenant", "t1")
+
+		done := make(chan *Call, 1)
+		call := <-client.send(ctx, "Arith.Add", &Args{A: 1, B: 2}, &Reply{}, done).Done
+		if call.Error != nil {
+			t.Fatal(call.Error)
+		}
+		if call.Metadata.Get("echo-trace-id") != "abc123" || call.Metadata.Get("tenant") != "t1" {
+			t.Fatalf("codec %d: unexpected response metadata: %v", ct, call.Metadata)
+		}
+
+		// 同步调用通过 ReceiveResponse 拿到响应 metadata
+		var header metadata.MD
+		if err := client.CallContext(metadata.ReceiveResponse(ctx, &header), "Arith.Add", &Args{A: 1, B: 2}, &Reply{}); err != nil {
+			t.Fatal(err)
+		}
+		if header.Get("echo-trace-id") != "abc123" || header.Get("tenant") != "t1" {
+			t.Fatalf("codec %d: unexpected response metadata from CallContext: %v", ct, header)
+		}
+	}
+}
+
+func TestStatusErrors(t *testing.T) {
+	svr := server.NewServer()
+	if err := svr.Register(&Arith{}); err != nil {
+		t.Fatal(err)
+	}
+	go svr.Serve("tcp", ":18087", "", nil)
+	time.Sleep(100 * time.Millisecond)
+
+	reg := NewMockRegistry()
+	reg.Register("Arith", registry.ServiceInstance{Addr: "127.0.0.1:18087", Weight: 1}, 10)
+	client := NewClient(reg, &loadbalance.RoundRobinBalancer{}, byte(codec.CodecTypeBinary), 1)
+
+	cases := []struct {
+		serviceMethod string
+		want          status.Code
+	}{
+		{"Arith.Div", status.InvalidArgument}, // handler 返回的 status 原样透传
+		{"Arith.Nope", status.NotFound},       // 方法不存在
+		{"Nope.Add", status.Unavailable},      // 没有实例
+		{"Arith", status.InvalidArgument},     // 格式错误
+	}
+	for _, tc := range cases {
+		err := client.Call(tc.serviceMethod, &Args{A: 1, B: 0}, &Reply{})
+		var st *status.Status
+		if !errors.As(err, &st) {
+			t.Fatalf("%s: expect *status.Status, got %T: %v", tc.serviceMethod, err, err)
+		}
+		if st.Code != tc.want {
+			t.Fatalf("%s: expect code %s, got %s (%v)", tc.serviceMethod, tc.want, st.Code, err)
+		}
+	}
+}
+
+func TestStream(t *testing.T) {
+	counter := &Counter{stopped: make(chan error, 1)}
+	svr := server.NewServer()
+	if err := svr.Register(counter); err != nil {
+		t.Fatal(err)
+	}
+	go svr.Serve("tcp", ":18088", "", nil)
+	time.Sleep(100 * time.Millisecond)
+
+	reg := NewMockRegistry()
+	reg.Register("Counter", registry.ServiceInstance{Addr: "127.0.0.1:18088", Weight: 1}, 10)
+	client := NewClient(reg, &loadbalance.RoundRobinBalancer{}, byte(codec.CodecTypeBinary), 1)
+
+	// 正常流：元素数量远超流控窗口，按顺序全部收到，最后是 io.EOF
+	stream, err := client.Stream(context.Background(), "Counter.Count", &CountArgs{N: 500})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 500; i++ {
+		var got int
+		if err := stream.Recv(&got); err != nil {
+			t.Fatalf("recv %d: %v", i, err)
+		}
+		if got != i {
+			t.Fatalf("expect %d, got %d", i, got)
+		}
+	}
+	if err := stream.Recv(new(int)); err != io.EOF {
+		t.Fatalf("expect io.EOF, got %v", err)
+	}
+	if got := stream.Trailer().Get("sent"); got != "500" {
+		t.Fatalf("expect the trailer set by the handler, got %v", stream.Trailer())
+	}
+
+	// handler 返回错误：先收完元素，再收到带错误码的 status
+	stream, err = client.Stream(context.Background(), "Counter.Count", &CountArgs{N: 3, Fail: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := stream.Recv(new(int)); err != nil {
+			t.Fatalf("recv %d: %v", i, err)
+		}
+	}
+	var st *status.Status
+	if err := stream.Recv(new(int)); !errors.As(err, &st) || st.Code != status.DataLoss {
+		t.Fatalf("expect DataLoss status, got %v", err)
+	}
+	if got := stream.Trailer().Get("sent"); got != "3" {
+		t.Fatalf("expect the trailer with an error status too, got %v", stream.Trailer())
+	}
+
+	// 一元调用不能调用流式方法
+	err = client.Call("Counter.Count", &CountArgs{N: 1}, new(int))
+	if !errors.As(err, &st) || st.Code != status.FailedPrecondition {
+		t.Fatalf("expect FailedPrecondition, got %v", err)
+	}
+
+	// 客户端提前 Close：服务端 handler 阻塞在流控上，应被取消而不是泄漏
+	stream, err = client.Stream(context.Background(), "Counter.Count", &CountArgs{N: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Recv(new(int)); err != nil {
+		t.Fatal(err)
+	}
+	stream.Close()
+	select {
+	case err := <-counter.stopped:
+		if status.CodeOf(err) != status.Canceled {
+			t.Fatalf("expect Canceled on the server, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("server handler was not cancelled after Close")
+	}
+}
+
+func TestClientAndBidiStream(t *testing.T) {
+	svr := server.NewServer()
+	if err := svr.Register(&Counter{stopped: make(chan error, 1)}); err != nil {
+		t.Fatal(err)
+	}
+	go svr.Serve("tcp", ":18089", "", nil)
+	time.Sleep(100 * time.Millisecond)
+
+	reg := NewMockRegistry()
+	reg.Register("Counter", registry.ServiceInstance{Addr: "127.0.0.1:18089", Weight: 1}, 10)
+	client := NewClient(reg, &loadbalance.RoundRobinBalancer{}, byte(codec.CodecTypeBinary), 1)
+
+	// 客户端流：发送量远超流控窗口，CloseAndRecv 拿到唯一的 reply
+	stream, err := client.NewStream(context.Background(), "Counter.Sum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := 0
+	for i := 0; i < 1000; i++ {
+		if err := stream.Send(i); err != nil {
+			t.Fatalf("send %d: %v", i, err)
+		}
+		want += i
+	}
+	var reply Reply
+	if err := stream.CloseAndRecv(&reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Result != want {
+		t.Fatalf("expect %d, got %d", want, reply.Result)
+	}
+
+	// 客户端流中途出错：handler 提前返回，Send 最终返回 io.EOF，原因由 CloseAndRecv 给出
+	stream, err = client.NewStream(context.Background(), "Counter.Sum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.Send(-1)
+	for i := 0; i < 1000; i++ {
+		if err := stream.Send(i); err != nil {
+			if err != io.EOF {
+				t.Fatalf("expect io.EOF from Send, got %v", err)
+			}
+			break
+		}
+	}
+	var st *status.Status
+	if err := stream.CloseAndRecv(&reply); !errors.As(err, &st) || st.Code != status.InvalidArgument {
+		t.Fatalf("expect InvalidArgument, got %v", err)
+	}
+
+	// 双向流：一个 goroutine 发，一个 goroutine 收，CloseSend 后服务端结束
+	stream, err = client.NewStream(context.Background(), "Counter.Echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for i := 0; i < 200; i++ {
+			if err := stream.Send(i); err != nil {
+				return
+			}
+		}
+		stream.CloseSend()
+	}()
+	for i := 0; i < 200; i++ {
+		var got int
+		if err := stream.Recv(&got); err != nil {
+			t.Fatalf("recv %d: %v", i, err)
+		}
+		if got != i*2 {
+			t.Fatalf("expect %d, got %d", i*2, got)
+		}
+	}
+	if err := stream.Recv(new(int)); err != io.EOF {
+		t.Fatalf("expect io.EOF, got %v", err)
+	}
+}
+
+func TestProtobufCodec(t *testing.T) {
+	svr := server.NewServer()
+	if err := svr.Register(&Greeter{}); err != nil {
+		t.Fatal(err)
+	}
+	go svr.Serve("tcp", ":18090", "", nil)
+	time.Sleep(100 * time.Millisecond)
+
+	reg := NewMockRegistry()
+	reg.Register("Greeter", registry.ServiceInstance{Addr: "127.0.0.1:18090", Weight: 1}, 10)
+	client := NewClient(reg, &loadbalance.RoundRobinBalancer{}, byte(codec.CodecTypeProtobuf), 1)
+
+	// 信封和参数/返回值都用 protobuf 编码
+	reply := &wrapperspb.StringValue{}
+	if err := client.Call("Greeter.Hello", wrapperspb.String("mini-rpc"), reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.GetValue() != "hello mini-rpc" {
+		t.Fatalf("expect %q, got %q", "hello mini-rpc", reply.GetValue())
+	}
+
+	// 参数不是 proto.Message 时在客户端就报错，不会发出请求
+	if err := client.Call("Greeter.Hello", &Args{A: 1}, reply); err == nil {
+		t.Fatal("expect an error for non-protobuf args")
+	}
+}
+
+func TestAllCodecs(t *testing.T) {
+	svr := server.NewServer()
+	if err := svr.Register(&Arith{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := svr.Register(&Counter{stopped: make(chan error, 1)}); err != nil {
+		t.Fatal(err)
+	}
+	go svr.Serve("tcp", ":18091", "", nil)
+	time.Sleep(100 * time.Millisecond)
+
+	reg := NewMockRegistry()
+	reg.Register("Arith", registry.ServiceInstance{Addr: "127.0.0.1:18091", Weight: 1}, 10)
+	reg.Register("Counter", registry.ServiceInstance{Addr: "127.0.0.1:18091", Weight: 1}, 10)
+
+	// 除 Protobuf（需要 proto.Message）外，所有内置 codec 都能直接用普通结构体
+	for _, ct := range []codec.CodecType{codec.CodecTypeJSON, codec.CodecTypeBinary, codec.CodecTypeMsgpack, codec.CodecTypeGob} {
+		client := NewClient(reg, &loadbalance.RoundRobinBalancer{}, byte(ct), 1)
+
+		reply := &Reply{}
+		if err := client.Call("Arith.Add", &Args{A: 3, B: 4}, reply); err != nil {
+			t.Fatalf("codec %d: %v", ct, err)
+		}
+		if reply.Result != 7 {
+			t.Fatalf("codec %d: expect 7, got %d", ct, reply.Result)
+		}
+
+		// 错误码同样经过信封编码
+		var st *status.Status
+		if err := client.Call("Arith.Div", &Args{A: 1}, reply); !errors.As(err, &st) || st.Code != status.InvalidArgument {
+			t.Fatalf("codec %d: expect InvalidArgument, got %v", ct, err)
+		}
+
+		stream, err := client.Stream(context.Background(), "Counter.Count", &CountArgs{N: 3})
+		if err != nil {
+			t.Fatalf("codec %d: %v", ct, err)
+		}
+		for i := 0; i < 3; i++ {
+			var got int
+			if err := stream.Recv(&got); err != nil || got != i {
+				t.Fatalf("codec %d: expect %d, got %d (%v)", ct, i, got, err)
+			}
+		}
+		if err := stream.Recv(new(int)); err != io.EOF {
+			t.Fatalf("codec %d: expect io.EOF, got %v", ct, err)
+		}
+	}
+
+	// 未注册的 codec 在客户端就报错
+	client := NewClient(reg, &loadbalance.RoundRobinBalancer{}, 200, 1)
+	if err := client.Call("Arith.Add", &Args{A: 3, B: 4}, &Reply{}); err == nil {
+		t.Fatal("expect an error for an unregistered codec")
+	}
+}
+
+// 测试压缩：Client 级默认算法、单次调用覆盖，服务端用同一算法回复
+func TestCompression(t *testing.T) {
+	svr := server.NewServer()
+	if err := svr.Register(&Text{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := svr.Register(&Counter{stopped: make(chan error, 1)}); err != nil {
+		t.Fatal(err)
+	}
+	go svr.Serve("tcp", ":18092", "", nil)
+	time.Sleep(100 * time.Millisecond)
+
+	reg := NewMockRegistry()
+	reg.Register("Text", registry.ServiceInstance{Addr: "127.0.0.1:18092", Weight: 1}, 10)
+	reg.Register("Counter", registry.ServiceInstance{Addr: "127.0.0.1:18092", Weight: 1}, 10)
+
+	for _, ct := range []compressor.Type{compressor.Gzip, compressor.Deflate} {
+		client := New(reg, &loadbalance.RoundRobinBalancer{}, WithCompressor(ct))
+
+		// 小请求、大响应：请求低于阈值不压缩，但响应仍按请求的算法压缩
+		var reply string
+		if err := client.Call("Text.Repeat", &RepeatArgs{S: "abc", N: 10000}, &reply); err != nil {
+			t.Fatalf("compressor %d: %v", ct, err)
+		}
+		if reply != strings.Repeat("abc", 10000) {
+			t.Fatalf("compressor %d: unexpected reply of %d bytes", ct, len(reply))
+		}
+
+		// 大请求
+		big := strings.Repeat("x", 1<<20)
+		if err := client.Call("Text.Repeat", &RepeatArgs{S: big, N: 1}, &reply); err != nil || reply != big {
+			t.Fatalf("compressor %d: big request failed (%v)", ct, err)
+		}
+
+		// 单次调用关闭压缩
+		ctx := compressor.NewContext(context.Background(), compressor.None)
+		if err := client.CallContext(ctx, "Text.Repeat", &RepeatArgs{S: "ab", N: 2}, &reply); err != nil || reply != "abab" {
+			t.Fatalf("compressor %d: uncompressed call failed (%v)", ct, err)
+		}
+
+		// 流的每一帧都用同一算法
+		stream, err := client.Stream(context.Background(), "Counter.Count", &CountArgs{N: 3})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 3; i++ {
+			var got int
+			if err := stream.Recv(&got); err != nil || got != i {
+				t.Fatalf("compressor %d: expect %d, got %d (%v)", ct, i, got, err)
+			}
+		}
+		if err := stream.Recv(new(int)); err != io.EOF {
+			t.Fatalf("compressor %d: expect io.EOF, got %v", ct, err)
+		}
+	}
+
+	// 未注册的算法在客户端就报错
+	client := New(reg, &loadbalance.RoundRobinBalancer{}, WithCompressor(9))
+	if err := client.Call("Text.Repeat", &RepeatArgs{S: "a", N: 1}, new(string)); err == nil {
+		t.Fatal("expect an error for an unregistered compressor")
+	}
+}
+
+// slotTransports 在锁内读出 addr 连接池里每个槽位的 transport（拨号 goroutine 会并发写）
+func slotTransports(c *Client, addr string) []*transport.ClientTransport {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var ts []*transport.ClientTransport
+	for _, slot := range c.transports[addr].slots {
+		ts = append(ts, slot.t)
+	}
+	return ts
+}
+
+// 测试断线重连：拨号失败时退避，服务起来后自动建池，连接断掉后被剔除并重新拨号
+func TestReconnect(t *testing.T) {
+	const addr = "127.0.0.1:18093"
+	reg := NewMockRegistry()
+	reg.Register("Arith", registry.ServiceInstance{Addr: addr, Weight: 1}, 10)
+	client := NewClient(reg, &loadbalance.RoundRobinBalancer{}, byte(codec.CodecTypeJSON), 2)
+
+	// 1. 服务还没起来：拨号失败，返回 Unavailable
+	var st *status.Status
+	reply := &Reply{}
+	if err := client.Call("Arith.Add", &Args{A: 1, B: 2}, reply); !errors.As(err, &st) || st.Code != status.Unavailable {
+		t.Fatalf("expect Unavailable, got %v", err)
+	}
+	// 退避期内不再拨号，直接失败
+	if err := client.Call("Arith.Add", &Args{A: 1, B: 2}, reply); err == nil || !strings.Contains(err.Error(), "reconnecting in") {
+		t.Fatalf("expect a backoff error, got %v", err)
+	}
+
+	// 2. 服务起来，退避结束后调用成功
+	svr := server.NewServer()
+	if err := svr.Register(&Arith{}); err != nil {
+		t.Fatal(err)
+	}
+	go svr.Serve("tcp", ":18093", "", nil)
+	time.Sleep(200 * time.Millisecond)
+	for i := 0; i < 2; i++ { // 两个槽位都开始拨号
+		if err := client.Call("Arith.Add", &Args{A: 1, B: 2}, reply); err != nil || reply.Result != 3 {
+			t.Fatalf("expect 3 after the server came up, got %v (%v)", reply.Result, err)
+		}
+	}
+
+	time.Sleep(100 * time.Millisecond) // 第二个槽位在后台拨号，这期间调用走第一个连接
+
+	// 3. 模拟服务重启：所有连接断开，之后的调用透明地换上新连接
+	old := slotTransports(client, addr)
+	for _, tr := range old {
+		tr.Conn().Close()
+		<-tr.Done()
+	}
+	for i := 0; i < 4; i++ {
+		if err := client.Call("Arith.Add", &Args{A: i, B: 1}, reply); err != nil || reply.Result != i+1 {
+			t.Fatalf("expect %d after reconnecting, got %v (%v)", i+1, reply.Result, err)
+		}
+	}
+	for i, tr := range slotTransports(client, addr) {
+		if tr == nil || tr == old[i] || tr.Err() != nil {
+			t.Fatalf("expect slot %d to hold a new live transport", i)
+		}
+	}
+}
+
+// slowDialer 记录每个地址的拨号次数；拨 slowAddr 时卡住，直到 release 被关闭或 ctx 到期
+type slowDialer struct {
+	mu      sync.Mutex
+	dials   map[string]int
+	release chan struct{}
+}
+
+const slowAddr = "10.255.255.1:18094"
+
+func (d *slowDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.mu.Lock()
+	d.dials[addr]++
+	d.mu.Unlock()
+	if addr == slowAddr {
+		select {
+		case <-d.release:
+			return nil, errors.New("connection refused")
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	var nd net.Dialer
+	return nd.DialContext(ctx, network, addr)
+}
+
+func (d *slowDialer) count(addr string) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.dials[addr]
+}
+
+// 测试拨号不持有全局锁、并发调用共享同一次拨号、拨号超时
+func TestDial(t *testing.T) {
+	svr := server.NewServer()
+	if err := svr.Register(&Arith{}); err != nil {
+		t.Fatal(err)
+	}
+	go svr.Serve("tcp", ":18094", "", nil)
+	time.Sleep(100 * time.Millisecond)
+
+	reg := NewMockRegistry()
+	reg.Register("Arith", registry.ServiceInstance{Addr: "127.0.0.1:18094", Weight: 1}, 10)
+	reg.Register("Slow", registry.ServiceInstance{Addr: slowAddr, Weight: 1}, 10)
+	dialer := &slowDialer{dials: make(map[string]int), release: make(chan struct{})}
+	client := New(reg, &loadbalance.RoundRobinBalancer{}, WithDialer(dialer))
+
+	// 1. 5 个调用同时等 Slow 的连接
+	errs := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		go func() {
+			errs <- client.Call("Slow.Add", &Args{A: 1, B: 2}, &Reply{})
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	// 2. Slow 卡住时，别的地址照常调用
+	start := time.Now()
+	reply := &Reply{}
+	if err := client.Call("Arith.Add", &Args{A: 1, B: 2}, reply); err != nil || reply.Result != 3 {
+		t.Fatalf("expect 3, got %v (%v)", reply.Result, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expect the call not to wait for the slow dial, took %v", elapsed)
+	}
+
+	// 3. 等待中的调用可以单独放弃，拨号继续
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := client.CallContext(ctx, "Slow.Add", &Args{A: 1, B: 2}, &Reply{}); err != context.DeadlineExceeded {
+		t.Fatalf("expect DeadlineExceeded while waiting for the dial, got %v", err)
+	}
+
+	// 4. 拨号失败：所有等待者都拿到 Unavailable，而且只拨了一次
+	close(dialer.release)
+	var st *status.Status
+	for i := 0; i < 5; i++ {
+		if err := <-errs; !errors.As(err, &st) || st.Code != status.Unavailable {
+			t.Fatalf("expect Unavailable, got %v", err)
+		}
+	}
+	if n := dialer.count(slowAddr); n != 1 {
+		t.Fatalf("expect one shared dial, got %d", n)
+	}
+
+	// 5. 失败不会污染连接池：退避过后重新拨号
+	time.Sleep(150 * time.Millisecond)
+	client.Call("Slow.Add", &Args{A: 1, B: 2}, &Reply{})
+	if n := dialer.count(slowAddr); n != 2 {
+		t.Fatalf("expect a new dial after the backoff, got %d dials", n)
+	}
+
+	// 6. 拨号超时
+	timeoutClient := New(reg, &loadbalance.RoundRobinBalancer{},
+		WithDialer(&slowDialer{dials: make(map[string]int), release: make(chan struct{})}),
+		WithDialTimeout(50*time.Millisecond))
+	start = time.Now()
+	if err := timeoutClient.Call("Slow.Add", &Args{A: 1, B: 2}, &Reply{}); err == nil || !strings.Contains(err.Error(), "deadline exceeded") {
+		t.Fatalf("expect a dial timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expect the dial to time out after 50ms, took %v", elapsed)
+	}
+}
+
+// selfSignedTLS 生成一个 127.0.0.1 的自签名证书，返回服务端和客户端的 TLS 配置
+func selfSignedTLS(t *testing.T) (serverCfg, clientCfg *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "mini-rpc test"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	serverCfg = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	clientCfg = &tls.Config{RootCAs: pool}
+	return serverCfg, clientCfg
+}
+
+// lockedBuilder 是并发安全的 strings.Builder，日志在 recvLoop 里写、在测试里读
+type lockedBuilder struct {
+	mu sync.Mutex
+	b  strings.Builder
+}
+
+func (l *lockedBuilder) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.b.Write(p)
+}
+
+func (l *lockedBuilder) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.b.String()
+}
+
+// 测试函数式选项：TLS、默认调用超时、日志
+func TestOptions(t *testing.T) {
+	serverCfg, clientCfg := selfSignedTLS(t)
+	svr := server.NewServer(server.WithTLS(serverCfg))
+	if err := svr.Register(&Arith{}); err != nil {
+		t.Fatal(err)
+	}
+	go svr.Serve("tcp", ":18095", "", nil)
+	time.Sleep(100 * time.Millisecond)
+
+	reg := NewMockRegistry()
+	reg.Register("Arith", registry.ServiceInstance{Addr: "127.0.0.1:18095", Weight: 1}, 10)
+
+	// 1. TLS：证书按拨号地址的主机名校验
+	logs := &lockedBuilder{}
+	client := New(reg, &loadbalance.RoundRobinBalancer{},
+		WithCodec(codec.CodecTypeBinary),
+		WithPoolSize(2),
+		WithTLS(clientCfg),
+		WithCallTimeout(100*time.Millisecond),
+		WithHeartbeatInterval(0),
+		WithLogger(log.New(logs, "", 0)),
+	)
+	reply := &Reply{}
+	if err := client.Call("Arith.Add", &Args{A: 1, B: 2}, reply); err != nil || reply.Result != 3 {
+		t.Fatalf("expect 3 over TLS, got %v (%v)", reply.Result, err)
+	}
+
+	// 2. 没有 deadline 的调用用默认超时；自带 deadline 的不受影响
+	if err := client.Call("Arith.Sleep", &Args{A: 500}, reply); err != context.DeadlineExceeded {
+		t.Fatalf("expect the default call timeout, got %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := client.CallContext(ctx, "Arith.Sleep", &Args{A: 200}, reply); err != nil || reply.Result != 200 {
+		t.Fatalf("expect the call's own deadline to win, got %v (%v)", reply.Result, err)
+	}
+
+	// 3. 不带 TLS 的客户端连不上
+	plain := New(reg, &loadbalance.RoundRobinBalancer{}, WithCallTimeout(500*time.Millisecond))
+	if err := plain.Call("Arith.Add", &Args{A: 1, B: 2}, reply); err == nil {
+		t.Fatal("expect a plaintext client to fail against a TLS server")
+	}
+
+	// 4. Done 缓冲不够时丢弃的提示写进客户端自己的日志
+	done := make(chan *Call, 1)
+	client.Go("Arith.Add", &Args{A: 1, B: 2}, &Reply{}, done)
+	client.Go("Arith.Add", &Args{A: 1, B: 2}, &Reply{}, done)
+	time.Sleep(100 * time.Millisecond) // 两个都完成了，才读 done
+	<-done
+	if !strings.Contains(logs.String(), "insufficient Done chan capacity") {
+		t.Fatalf("expect the client's logger to be used, got %q", logs.String())
+	}
+}
+
+// 测试 Client.Close：挂起的调用和流都失败，之后的调用返回 ErrClientClosed，不留 goroutine 和连接
+func TestClose(t *testing.T) {
+	svr := server.NewServer()
+	if err := svr.Register(&Arith{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := svr.Register(&Counter{stopped: make(chan error, 10)}); err != nil {
+		t.Fatal(err)
+	}
+	go svr.Serve("tcp", ":18096", "", nil)
+	time.Sleep(100 * time.Millisecond)
+	base := runtime.NumGoroutine()
+
+	reg := NewMockRegistry()
+	reg.Register("Arith", registry.ServiceInstance{Addr: "127.0.0.1:18096", Weight: 1}, 10)
+	reg.Register("Counter", registry.ServiceInstance{Addr: "127.0.0.1:18096", Weight: 1}, 10)
+	client := NewClient(reg, &loadbalance.RoundRobinBalancer{}, byte(codec.CodecTypeJSON), 3)
+
+	// 1. 连接池建好，挂一个慢调用和一个没读完的流
+	for i := 0; i < 3; i++ {
+		if err := client.Call("Arith.Add", &Args{A: 1, B: 2}, &Reply{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(50 * time.Millisecond) // 等后台拨号完成
+	slow := client.Go("Arith.Sleep", &Args{A: 300}, &Reply{}, nil)
+	stream, err := client.NewStream(context.Background(), "Counter.Echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	// 2. Close：挂起的调用收到 ErrClientClosed，流被中止
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if call := <-slow.Done; call.Error != ErrClientClosed {
+		t.Fatalf("expect ErrClientClosed, got %v", call.Error)
+	}
+	if err := stream.Recv(new(int)); err == nil || err == io.EOF {
+		t.Fatalf("expect the stream to be aborted, got %v", err)
+	}
+
+	// 3. 之后的调用直接失败
+	if err := client.Call("Arith.Add", &Args{A: 1, B: 2}, &Reply{}); err != ErrClientClosed {
+		t.Fatalf("expect ErrClientClosed, got %v", err)
+	}
+	if _, err := client.NewStream(context.Background(), "Counter.Echo"); err != ErrClientClosed {
+		t.Fatalf("expect ErrClientClosed, got %v", err)
+	}
+	if err := client.Close(); err != nil {
+		t.Fatalf("expect a second Close to be a no-op, got %v", err)
+	}
+
+	// 4. 客户端和服务端这边的 goroutine 都退出
+	leakcheck.Check(t, base)
+}
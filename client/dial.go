@@ -0,0 +1,206 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"mini-rpc/transport"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultDialTimeout bounds each connection attempt of a Client (see WithDialTimeout).
+const DefaultDialTimeout = 5 * time.Second
+
+// Redial backoff: after n consecutive failed dials to an address, the next dial waits
+// minRedialBackoff * 2^(n-1), capped at maxRedialBackoff. Calls in between fail right away.
+const (
+	minRedialBackoff = 100 * time.Millisecond
+	maxRedialBackoff = 10 * time.Second
+)
+
+// Dialer opens the connections of a Client's transport pool. *net.Dialer implements it,
+// and so does *tls.Dialer; a custom Dialer can add proxies, socket options or test hooks.
+//
+// ctx carries the dial timeout. It is not the ctx of any call: a dial is shared by every
+// call that waits for the connection, so one caller giving up doesn't abort it.
+type Dialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// addrPool is the transport pool of one server address. A slot is empty until it is first
+// dialed, and again after its transport broke and was evicted.
+type addrPool struct {
+	slots    []poolSlot
+	failures int       // Consecutive failed dials; reset by a successful one
+	retryAt  time.Time // No new dial before this (exponential backoff after failures)
+}
+
+// poolSlot is one connection of an addrPool: its transport, or the dial producing it.
+type poolSlot struct {
+	t    *transport.ClientTransport // nil while empty or dialing
+	dial *dialCall                  // The dial in flight, shared by every call that picked this slot
+}
+
+// dialCall is one connection attempt. Its fields are written before done is closed.
+type dialCall struct {
+	done chan struct{}
+	t    *transport.ClientTransport
+	err  error
+}
+
+// live returns any live transport of the pool, or nil.
+func (p *addrPool) live() *transport.ClientTransport {
+	for _, s := range p.slots {
+		if s.t != nil && s.t.Err() == nil {
+			return s.t
+		}
+	}
+	return nil
+}
+
+// getTransport returns a shared transport for the given address using round-robin selection.
+//
+// Design: transports are SHARED, not borrowed/returned. Since each ClientTransport supports
+// multiplexing, there's no need to exclusively hold a transport during a call. The transport
+// is only "used" during Send() (a few microseconds), not during the entire call (which includes
+// waiting for the response). Shared access avoids 95% idle time from exclusive holding.
+//
+// Reconnection: a slot is dialed when it is first picked, and again when its transport has
+// broken (see ClientTransport.Done) — the dead transport is evicted, so a server restart
+// only costs the calls that were in flight on the old connections. While an address keeps
+// refusing connections, dials back off exponentially and calls fall back to any live
+// transport of the pool, or fail with the last dial error.
+//
+// Lock strategy:
+//   - mu.Lock protects the transports map and the pools (read + write). This is nanosecond-level.
+//   - Dials never run under mu: a slow or unreachable address doesn't hold up calls to
+//     any other one. The dial runs in its own goroutine, and every call that picks the
+//     slot meanwhile waits for that same attempt (or uses another live transport of the
+//     pool) instead of dialing again. A call whose ctx ends first stops waiting; the dial
+//     carries on for the others.
+//   - A failed dial leaves the slot empty, so the next call after the backoff retries it.
+func (c *Client) getTransport(ctx context.Context, addr string) (*transport.ClientTransport, error) {
+	// Atomic counter for round-robin — each goroutine captures its own value (no race)
+	n := atomic.AddUint64(&c.counter, 1)
+
+	// Lock only to protect map access (not transport usage, not dials)
+	c.mu.Lock()
+	if c.closed.Load() {
+		c.mu.Unlock()
+		return nil, ErrClientClosed
+	}
+	pool, ok := c.transports[addr]
+	if !ok {
+		pool = &addrPool{slots: make([]poolSlot, c.poolSize)}
+		c.transports[addr] = pool
+	}
+
+	// Step 1: Round-robin selection — the common case is a live transport
+	i := int(n % uint64(c.poolSize))
+	slot := &pool.slots[i]
+	if t := slot.t; t != nil && t.Err() == nil {
+		c.mu.Unlock()
+		return t, nil
+	}
+	slot.t = nil // Broken: evict it (recvLoop already closed its connection)
+
+	// Step 2: Join the slot's dial, or start one unless the address is backing off
+	d := slot.dial
+	if d == nil {
+		if wait := time.Until(pool.retryAt); wait > 0 {
+			t := pool.live()
+			c.mu.Unlock()
+			if t != nil {
+				return t, nil
+			}
+			return nil, fmt.Errorf("reconnecting in %v after %d failed dials", wait.Round(time.Millisecond), pool.failures)
+		}
+		d = &dialCall{done: make(chan struct{})}
+		slot.dial = d
+		go c.dial(addr, pool, i, d)
+	}
+
+	// Step 3: Don't wait for the dial if another transport of the pool can take the call
+	t := pool.live()
+	c.mu.Unlock()
+	if t != nil {
+		return t, nil
+	}
+	select {
+	case <-d.done:
+		return d.t, d.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// dial connects slot i of pool, records the outcome in the pool, and completes d.
+func (c *Client) dial(addr string, pool *addrPool, i int, d *dialCall) {
+	ctx := context.Background()
+	if c.dialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.dialTimeout)
+		defer cancel()
+	}
+	conn, err := c.dialer.DialContext(ctx, "tcp", addr)
+	if err == nil && c.tlsConfig != nil {
+		conn, err = c.handshake(ctx, conn, addr)
+	}
+
+	c.mu.Lock()
+	if err == nil && c.closed.Load() {
+		conn.Close() // Close ran while we were dialing: the pool is gone
+		err = ErrClientClosed
+	}
+	switch {
+	case err == ErrClientClosed:
+		d.err = err
+	case err != nil:
+		d.err = err
+		pool.failures++
+		pool.retryAt = time.Now().Add(redialBackoff(pool.failures))
+	default:
+		d.t = transport.NewClientTransport(conn, c.codecType,
+			transport.WithHeartbeatInterval(c.heartbeatInterval),
+			transport.WithHeartbeatMisses(c.heartbeatMisses),
+			transport.WithMaxRequestSize(c.maxRequestSize),
+			transport.WithMaxResponseSize(c.maxResponseSize),
+			transport.WithLogger(c.logger))
+		pool.failures = 0
+		pool.slots[i].t = d.t
+	}
+	pool.slots[i].dial = nil
+	c.mu.Unlock()
+	close(d.done)
+}
+
+// handshake runs the TLS client handshake on a freshly dialed conn, within the dial's ctx.
+// Without a ServerName in the config, the certificate must be valid for addr's host.
+func (c *Client) handshake(ctx context.Context, conn net.Conn, addr string) (net.Conn, error) {
+	cfg := c.tlsConfig
+	if cfg.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		cfg = cfg.Clone()
+		cfg.ServerName = host
+	}
+	tlsConn := tls.Client(conn, cfg)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// redialBackoff returns how long to wait before the next dial after n consecutive failures.
+func redialBackoff(n int) time.Duration {
+	d := minRedialBackoff
+	for i := 1; i < n && d < maxRedialBackoff; i++ {
+		d *= 2
+	}
+	return min(d, maxRedialBackoff)
+}
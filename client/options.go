@@ -0,0 +1,106 @@
+package client
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"math"
+	"mini-rpc/codec"
+	"mini-rpc/compressor"
+	"time"
+)
+
+// Option configures a Client at construction: client.New(reg, bal, client.WithPoolSize(4), ...).
+// Every option has a default, so New(reg, bal) alone gives a working client.
+type Option func(*Client)
+
+// WithCodec sets the serialization format of requests and replies (default codec.CodecTypeJSON).
+func WithCodec(t codec.CodecType) Option {
+	return func(c *Client) { c.codecType = t }
+}
+
+// WithPoolSize sets how many connections are kept per server address (default 1).
+// Each connection multiplexes any number of concurrent calls; see NewClient.
+func WithPoolSize(n int) Option {
+	return func(c *Client) { c.poolSize = n }
+}
+
+// WithCompressor makes every call and stream of the client compress its frames with t
+// (compressor.Gzip, compressor.Deflate, or a registered custom type); the server replies
+// with the same compressor. Frames below compressor.Threshold are still sent as is, and so
+// are those sent before the connection switched to v2 frames (all of them, to an old server).
+//
+// A single call can override the default through its ctx:
+//
+//	ctx = compressor.NewContext(ctx, compressor.None) // this call only: no compression
+func WithCompressor(t compressor.Type) Option {
+	return func(c *Client) { c.compressor = t }
+}
+
+// WithDialer replaces the Dialer used to open pool connections ("tcp" network).
+func WithDialer(d Dialer) Option {
+	return func(c *Client) { c.dialer = d }
+}
+
+// WithDialTimeout bounds each connection attempt; 0 means no bound beyond the operating
+// system's own. Defaults to DefaultDialTimeout. A dial that times out counts as a failed
+// dial (see getTransport for the backoff that follows).
+func WithDialTimeout(d time.Duration) Option {
+	return func(c *Client) { c.dialTimeout = d }
+}
+
+// WithHeartbeatInterval sets how often each connection sends a heartbeat (default
+// transport.DefaultHeartbeatInterval); 0 or less turns heartbeats off.
+func WithHeartbeatInterval(d time.Duration) Option {
+	return func(c *Client) { c.heartbeatInterval = d }
+}
+
+// WithHeartbeatMisses sets how many unanswered heartbeats in a row make a connection count
+// as dead (default transport.DefaultHeartbeatMisses, 0 = never): its pending calls fail with
+// Unavailable, and the next call redials. See transport.WithHeartbeatMisses.
+func WithHeartbeatMisses(n int) Option {
+	return func(c *Client) { c.heartbeatMisses = n }
+}
+
+// WithMaxRequestSize sets the largest request body sent (default protocol.DefaultMaxBodySize);
+// see transport.ClientTransport.SetMaxRequestSize. It panics if n is negative or over math.MaxUint32.
+func WithMaxRequestSize(n int) Option {
+	checkSizeLimit("WithMaxRequestSize", n)
+	return func(c *Client) { c.maxRequestSize = n }
+}
+
+// WithMaxResponseSize sets the largest response body accepted (default
+// protocol.DefaultMaxBodySize); see transport.ClientTransport.SetMaxResponseSize.
+// It panics if n is negative or over math.MaxUint32.
+func WithMaxResponseSize(n int) Option {
+	checkSizeLimit("WithMaxResponseSize", n)
+	return func(c *Client) { c.maxResponseSize = n }
+}
+
+// checkSizeLimit panics if n can't be a body size limit, here rather than on the first dial
+// (see transport.WithMaxRequestSize).
+func checkSizeLimit(name string, n int) {
+	if n < 0 || uint64(n) > math.MaxUint32 {
+		panic(fmt.Sprintf("client: %s(%d) out of range 0-%d", name, n, uint32(math.MaxUint32)))
+	}
+}
+
+// WithCallTimeout bounds every Call and CallContext whose ctx has no deadline of its own
+// (default: unbounded). The timeout is sent to the server like any ctx deadline. Go and
+// streams are not affected: their lifetime is up to the caller.
+func WithCallTimeout(d time.Duration) Option {
+	return func(c *Client) { c.callTimeout = d }
+}
+
+// WithTLS runs every pool connection over TLS with cfg; the server must use server.WithTLS.
+// Without cfg.ServerName, the certificate is verified against the host of the address
+// being dialed.
+func WithTLS(cfg *tls.Config) Option {
+	return func(c *Client) { c.tlsConfig = cfg }
+}
+
+// WithLogger sends the client's log output, its transports' included, to l instead of the
+// standard logger.
+func WithLogger(l *log.Logger) Option {
+	return func(c *Client) { c.logger = l }
+}
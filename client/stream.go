@@ -0,0 +1,127 @@
+package client
+
+import (
+	"context"
+	"io"
+	"mini-rpc/codec"
+	"mini-rpc/metadata"
+	"mini-rpc/status"
+	"mini-rpc/transport"
+)
+
+// Stream is the client side of a streaming call.
+//
+// Server-streaming calls are opened with Client.Stream and only read results:
+//
+//	stream, err := cli.Stream(ctx, "Logs.Tail", &TailArgs{File: "app.log"})
+//	if err != nil { ... }
+//	defer stream.Close()
+//	for {
+//	    var line Line
+//	    err := stream.Recv(&line)
+//	    if err == io.EOF {
+//	        break // handler returned nil
+//	    }
+//	    if err != nil {
+//	        return err // *status.Status from the handler, or ctx.Err()
+//	    }
+//	    ...
+//	}
+//
+// Client-streaming and bidirectional calls are opened with Client.NewStream; input is sent
+// with Send, and CloseSend tells the handler there is no more (its Recv returns io.EOF):
+//
+//	stream, err := cli.NewStream(ctx, "Files.Upload")
+//	for _, chunk := range chunks {
+//	    if err := stream.Send(chunk); err != nil {
+//	        break // io.EOF: the handler returned early, CloseAndRecv reports why
+//	    }
+//	}
+//	var reply UploadReply
+//	err = stream.CloseAndRecv(&reply)
+//
+// Recv must be called from a single goroutine, and Send from a single goroutine,
+// but one goroutine may Send while another Recvs (bidirectional streams).
+type Stream struct {
+	ServiceMethod string
+	cs            *transport.ClientStream
+	codec         codec.Codec // Decodes elements — same codec as the frames
+}
+
+// Stream opens a server-streaming call with args as its input. Discovery, load balancing
+// and the transport pool are the same as for Call; the stream is multiplexed over the
+// shared connection like any request.
+//
+// ctx bounds the whole stream: its deadline is sent to the server, and cancelling it stops
+// both the iteration (Recv returns ctx.Err()) and the server-side handler.
+func (c *Client) Stream(ctx context.Context, serviceMethod string, args any) (*Stream, error) {
+	t, err := c.pickTransport(ctx, serviceMethod)
+	if err != nil {
+		return nil, err
+	}
+	cs, err := t.OpenStream(c.withCompressor(ctx), serviceMethod, args)
+	if err != nil {
+		return nil, err
+	}
+	return &Stream{ServiceMethod: serviceMethod, cs: cs, codec: codec.GetCodec(c.codecType)}, nil
+}
+
+// NewStream opens a client-streaming or bidirectional call. Nothing but the method name
+// (plus ctx's deadline and metadata) is sent up front; input goes through Send.
+func (c *Client) NewStream(ctx context.Context, serviceMethod string) (*Stream, error) {
+	return c.Stream(ctx, serviceMethod, nil)
+}
+
+// Send sends v to the handler as one stream element. It blocks while the handler is
+// behind on reading (flow control). If the stream is already over, Send returns io.EOF
+// and the reason is reported by Recv.
+func (s *Stream) Send(v any) error {
+	return s.cs.Send(v)
+}
+
+// CloseSend half-closes the stream: the handler's Recv returns io.EOF, while results
+// can still be read with Recv.
+func (s *Stream) CloseSend() error {
+	return s.cs.CloseSend()
+}
+
+// CloseAndRecv finishes a client-streaming call: it half-closes the stream and
+// unmarshals the handler's reply into reply.
+func (s *Stream) CloseAndRecv(reply any) error {
+	if err := s.cs.CloseSend(); err != nil {
+		return err
+	}
+	if err := s.Recv(reply); err != nil {
+		return err
+	}
+	// The reply is the only element: expect the end of the stream right after it
+	if _, err := s.cs.Recv(); err != io.EOF {
+		if err == nil {
+			return status.Errorf(status.Internal, "%s sent more than one reply", s.ServiceMethod)
+		}
+		return err
+	}
+	return nil
+}
+
+// Recv decodes the next stream element into reply.
+// It returns io.EOF once the handler has returned successfully.
+func (s *Stream) Recv(reply any) error {
+	msg, err := s.cs.Recv()
+	if err != nil {
+		return err
+	}
+	return s.codec.Decode(msg.Payload, reply)
+}
+
+// Trailer returns the response metadata the handler set with metadata.SetResponse.
+// It is only available once Recv has returned an error (io.EOF included).
+func (s *Stream) Trailer() metadata.MD {
+	return s.cs.Trailer()
+}
+
+// Close stops the stream early and cancels the server-side handler.
+// It is safe (and a no-op) to call Close after Recv has returned an error.
+func (s *Stream) Close() error {
+	return s.cs.Close()
+}
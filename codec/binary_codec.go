@@ -1,33 +1,63 @@
 package codec
 
 import (
+	"encoding"
 	"encoding/binary"
-	"errors"
+	"encoding/json"
+	"fmt"
+	"math"
 	"mini-rpc/message"
+	"mini-rpc/status"
+	"time"
 )
 
 // BinaryCodec implements a custom binary serialization for RPCMessage.
 //
 // Binary format:
 //
-//	┌─────────────┬──────────────┬──────────────┬─────────┬────────────┬───────┐
-//	│MethodLen(2) │ Method bytes │ PayloadLen(4)│ Payload │ ErrLen(2)  │ Error │
-//	└─────────────┴──────────────┴──────────────┴─────────┴────────────┴───────┘
+//	┌─────────────┬──────────────┬──────────────┬─────────┬────────────┬───────┬────────────┐
+//	│MethodLen(2) │ Method bytes │ PayloadLen(4)│ Payload │ ErrLen(2)  │ Error │ Timeout(8) │
+//	└─────────────┴──────────────┴──────────────┴─────────┴────────────┴───────┴────────────┘
+//	┌────────────┬──────────────────────────────────────────────────────────┐
+//	│MetaCount(2)│ MetaCount × [KeyLen(2) │ Key │ ValLen(2) │ Value]        │
+//	└────────────┴──────────────────────────────────────────────────────────┘
+//	┌─────────┬───────────────┬───────────────────────────────────────┐
+//	│ Code(4) │ DetailCount(2)│ DetailCount × [Len(2) │ Detail]       │
+//	└─────────┴───────────────┴───────────────────────────────────────┘
 //
-// Note: The payload itself (args/reply) is still JSON-encoded. The performance gain
-// comes from encoding the outer RPCMessage fields in binary instead of JSON,
-// avoiding the overhead of JSON field names and string escaping.
+// Each of the three rows may be missing from the end of a message (older peers don't send
+// them); Decode then leaves the corresponding fields zero.
+//
+// The performance gain comes from encoding the outer RPCMessage fields in binary instead
+// of JSON, avoiding the overhead of JSON field names and string escaping.
 // Benchmark: ~65 ns/op vs JSON's ~589 ns/op (9x faster).
+//
+// Payloads (args/reply) have no schema to drive a generic binary layout, so types choose:
+// a type implementing encoding.BinaryMarshaler / encoding.BinaryUnmarshaler is encoded
+// with its own binary form; any other value falls back to JSON.
 type BinaryCodec struct{}
 
 func (c *BinaryCodec) Encode(v any) ([]byte, error) {
 	msg, ok := v.(*message.RPCMessage)
 	if !ok {
-		return nil, errors.New("BinaryCodec: v must be *RPCMessage")
+		return encodeBinaryPayload(v)
+	}
+
+	// Every length goes on the wire as a fixed-width prefix: refuse what doesn't fit instead
+	// of truncating the prefix, which would make the receiver misread everything after it
+	if err := checkBinaryLengths(msg); err != nil {
+		return nil, err
 	}
 
 	// Pre-calculate total buffer size to avoid multiple allocations
-	total := 2 + len(msg.ServiceMethod) + 4 + len(msg.Payload) + 2 + len(msg.Error)
+	total := 2 + len(msg.ServiceMethod) + 4 + len(msg.Payload) + 2 + len(msg.Error) + 8 + 2
+	for k, v := range msg.Metadata {
+		total += 2 + len(k) + 2 + len(v)
+	}
+	total += 4 + 2
+	for _, d := range msg.Details {
+		total += 2 + len(d)
+	}
 	buf := make([]byte, total)
 
 	offset := 0
@@ -48,39 +78,193 @@ func (c *BinaryCodec) Encode(v any) ([]byte, error) {
 	binary.BigEndian.PutUint16(buf[offset:offset+2], uint16(len(msg.Error)))
 	offset += 2
 	copy(buf[offset:offset+len(msg.Error)], []byte(msg.Error))
+	offset += len(msg.Error)
+
+	// Timeout: 8-byte nanosecond duration (0 = no deadline)
+	binary.BigEndian.PutUint64(buf[offset:offset+8], uint64(msg.Timeout))
+	offset += 8
+
+	// Metadata: 2-byte pair count, then each key and value with a 2-byte length prefix
+	binary.BigEndian.PutUint16(buf[offset:offset+2], uint16(len(msg.Metadata)))
+	offset += 2
+	for k, v := range msg.Metadata {
+		binary.BigEndian.PutUint16(buf[offset:offset+2], uint16(len(k)))
+		offset += 2
+		offset += copy(buf[offset:], k)
+		binary.BigEndian.PutUint16(buf[offset:offset+2], uint16(len(v)))
+		offset += 2
+		offset += copy(buf[offset:], v)
+	}
+
+	// Status code: 4 bytes, then details with a 2-byte count and 2-byte length prefixes
+	binary.BigEndian.PutUint32(buf[offset:offset+4], uint32(msg.Code))
+	offset += 4
+	binary.BigEndian.PutUint16(buf[offset:offset+2], uint16(len(msg.Details)))
+	offset += 2
+	for _, d := range msg.Details {
+		binary.BigEndian.PutUint16(buf[offset:offset+2], uint16(len(d)))
+		offset += 2
+		offset += copy(buf[offset:], d)
+	}
 
 	return buf, nil
 }
 
+// Decode parses an RPCMessage encoded by Encode. The input comes off the network, so every
+// length prefix is checked against the bytes actually left: a truncated or corrupt body yields
+// a descriptive error, never a panic in the goroutine handling it.
 func (c *BinaryCodec) Decode(data []byte, v any) error {
 	msg, ok := v.(*message.RPCMessage)
 	if !ok {
-		return errors.New("BinaryCodec: v must be *RPCMessage")
+		return decodeBinaryPayload(data, v)
 	}
 
-	offset := 0
+	r := binaryReader{data: data}
 
 	// Read ServiceMethod
-	strLen := binary.BigEndian.Uint16(data[offset : offset+2])
-	offset += 2
-	msg.ServiceMethod = string(data[offset : offset+int(strLen)])
-	offset += int(strLen)
+	msg.ServiceMethod = string(r.bytes(int(r.uint16("method length")), "method"))
 
-	// Read Payload
-	payloadLen := binary.BigEndian.Uint32(data[offset : offset+4])
-	offset += 4
-	msg.Payload = make([]byte, payloadLen)
-	copy(msg.Payload, data[offset:offset+int(payloadLen)])
-	offset += int(payloadLen)
+	// Read Payload — aliased, not copied: the frame body already is a private buffer, and
+	// the payload is usually decoded once and dropped. The cap is clipped so an append by
+	// the caller can't overwrite the fields that follow.
+	msg.Payload = r.bytes(int(r.uint32("payload length")), "payload")
 
 	// Read Error
-	errLen := binary.BigEndian.Uint16(data[offset : offset+2])
-	offset += 2
-	msg.Error = string(data[offset : offset+int(errLen)])
+	msg.Error = string(r.bytes(int(r.uint16("error length")), "error"))
 
-	return nil
+	// The sections below were appended to the format over time (timeout, then metadata,
+	// then status). A message from an older peer simply ends before one of them: it reads
+	// as absent (zero), so a rolling upgrade keeps working in both directions.
+	if r.remaining() == 0 {
+		return r.err
+	}
+
+	// Read Timeout
+	msg.Timeout = time.Duration(r.uint64("timeout"))
+	if r.remaining() == 0 {
+		return r.err
+	}
+
+	// Read Metadata (left nil when empty, matching what the sender had)
+	metaCount := int(r.uint16("metadata count"))
+	if metaCount > 0 && r.err == nil {
+		msg.Metadata = make(map[string]string, min(metaCount, r.remaining()/4)) // Each pair takes ≥ 4 bytes
+	}
+	for i := 0; i < metaCount && r.err == nil; i++ {
+		key := string(r.bytes(int(r.uint16("metadata key length")), "metadata key"))
+		msg.Metadata[key] = string(r.bytes(int(r.uint16("metadata value length")), "metadata value"))
+	}
+
+	if r.remaining() == 0 {
+		return r.err
+	}
+
+	// Read status code and details
+	msg.Code = status.Code(r.uint32("status code"))
+	detailCount := int(r.uint16("detail count"))
+	for i := 0; i < detailCount && r.err == nil; i++ {
+		msg.Details = append(msg.Details, string(r.bytes(int(r.uint16("detail length")), "detail")))
+	}
+
+	return r.err
 }
 
 func (c *BinaryCodec) Type() CodecType {
 	return CodecTypeBinary
 }
+
+// encodeBinaryPayload encodes an args/reply value: its own binary form if it has one, JSON otherwise.
+func encodeBinaryPayload(v any) ([]byte, error) {
+	if m, ok := v.(encoding.BinaryMarshaler); ok {
+		return m.MarshalBinary()
+	}
+	return json.Marshal(v)
+}
+
+// decodeBinaryPayload is the inverse of encodeBinaryPayload.
+func decodeBinaryPayload(data []byte, v any) error {
+	if u, ok := v.(encoding.BinaryUnmarshaler); ok {
+		return u.UnmarshalBinary(data)
+	}
+	return json.Unmarshal(data, v)
+}
+
+// binaryReader reads the fields of an encoded RPCMessage front to back. The first read past
+// the end of the data records an error naming the field; later reads return zero values, so
+// Decode can read straight through and check the error once.
+type binaryReader struct {
+	data []byte
+	off  int
+	err  error
+}
+
+// bytes returns the next n bytes (aliasing the data, capacity clipped).
+func (r *binaryReader) bytes(n int, field string) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n > len(r.data)-r.off {
+		r.err = fmt.Errorf("BinaryCodec: truncated %s at offset %d: need %d bytes, have %d", field, r.off, n, len(r.data)-r.off)
+		return nil
+	}
+	b := r.data[r.off : r.off+n : r.off+n]
+	r.off += n
+	return b
+}
+
+func (r *binaryReader) uint16(field string) uint16 {
+	if b := r.bytes(2, field); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *binaryReader) uint32(field string) uint32 {
+	if b := r.bytes(4, field); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *binaryReader) uint64(field string) uint64 {
+	if b := r.bytes(8, field); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (r *binaryReader) remaining() int {
+	return len(r.data) - r.off
+}
+
+// checkBinaryLengths verifies that every length and count of msg fits its prefix in the
+// binary format: 2 bytes for strings and counts, 4 bytes for the payload.
+func checkBinaryLengths(msg *message.RPCMessage) error {
+	const max16 = math.MaxUint16
+	if len(msg.ServiceMethod) > max16 {
+		return fmt.Errorf("BinaryCodec: service method too long: %d bytes (max %d)", len(msg.ServiceMethod), max16)
+	}
+	if uint64(len(msg.Payload)) > math.MaxUint32 {
+		return fmt.Errorf("BinaryCodec: payload too long: %d bytes (max %d)", len(msg.Payload), uint64(math.MaxUint32))
+	}
+	if len(msg.Error) > max16 {
+		return fmt.Errorf("BinaryCodec: error message too long: %d bytes (max %d)", len(msg.Error), max16)
+	}
+	if len(msg.Metadata) > max16 {
+		return fmt.Errorf("BinaryCodec: too many metadata pairs: %d (max %d)", len(msg.Metadata), max16)
+	}
+	for k, v := range msg.Metadata {
+		if len(k) > max16 || len(v) > max16 {
+			return fmt.Errorf("BinaryCodec: metadata %q too long: key and value are limited to %d bytes", k[:min(len(k), 64)], max16)
+		}
+	}
+	if len(msg.Details) > max16 {
+		return fmt.Errorf("BinaryCodec: too many status details: %d (max %d)", len(msg.Details), max16)
+	}
+	for i, d := range msg.Details {
+		if len(d) > max16 {
+			return fmt.Errorf("BinaryCodec: status detail %d too long: %d bytes (max %d)", i, len(d), max16)
+		}
+	}
+	return nil
+}
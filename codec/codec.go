@@ -1,34 +1,98 @@
 // Package codec provides the serialization layer for mini-RPC.
 //
-// It defines a pluggable Codec interface with two implementations:
-//   - JSONCodec:   human-readable, easy to debug, slower (~589 ns/op)
-//   - BinaryCodec: compact binary format, faster (~65 ns/op, ~9x speedup)
+// It defines a pluggable Codec interface with five built-in implementations:
+//   - JSONCodec:     human-readable, easy to debug, slower (~589 ns/op)
+//   - BinaryCodec:   compact binary format, faster (~65 ns/op, ~9x speedup)
+//   - ProtobufCodec: protobuf wire format, for cross-language services
+//   - MsgpackCodec:  MessagePack, schemaless like JSON but binary and more compact
+//   - GobCodec:      encoding/gob, for Go-only deployments with types JSON can't express
 //
 // The codec type is stored in the protocol frame header so the receiver
-// knows which codec to use for deserialization.
+// knows which codec to use for deserialization. The same codec encodes both layers
+// of a frame body: the RPCMessage envelope, and the args/reply carried in its Payload.
+//
+// Further codecs are plugged in with Register; both peers must register the same codec
+// under the same type.
 package codec
 
+import (
+	"fmt"
+	"mini-rpc/internal/codectype"
+	"sync"
+)
+
 // CodecType identifies the serialization format, stored as 1 byte in the frame header.
 type CodecType byte
 
 const (
-	CodecTypeJSON   CodecType = 0 // JSON serialization (encoding/json)
-	CodecTypeBinary CodecType = 1 // Custom binary serialization
+	CodecTypeJSON     CodecType = 0 // JSON serialization (encoding/json)
+	CodecTypeBinary   CodecType = 1 // Custom binary serialization
+	CodecTypeProtobuf CodecType = 2 // Protocol Buffers (args/reply must implement proto.Message)
+	CodecTypeMsgpack  CodecType = 3 // MessagePack (github.com/vmihailenco/msgpack)
+	CodecTypeGob      CodecType = 4 // encoding/gob
 )
 
 // Codec is the interface for serialization/deserialization.
 // Implementing this interface allows adding new formats (e.g., Protobuf)
 // without changing any other layer — this is the Strategy Pattern.
+//
+// A Codec must handle two kinds of values:
+//   - *message.RPCMessage, the envelope of every frame
+//   - args/reply values (stream elements too), encoded into RPCMessage.Payload by the
+//     client transport and decoded by the server's businessHandler, and vice versa
+//
+// Decoding an RPCMessage may alias data: BinaryCodec's Payload points into the frame body
+// instead of copying it. Whoever releases the body (protocol.ReleaseBody) must be done with
+// the message first.
+//
+// One instance serves every connection, so a Codec must be safe for concurrent use.
 type Codec interface {
 	Encode(v any) ([]byte, error)    // Serialize a struct to bytes
 	Decode(data []byte, v any) error // Deserialize bytes back to a struct
 	Type() CodecType                 // Return the codec type identifier
 }
 
-// GetCodec is a factory function that returns the appropriate codec by type.
-func GetCodec(codecType CodecType) Codec {
-	if codecType == CodecTypeJSON {
-		return &JSONCodec{}
+// registry maps codec types to their implementation. Reads happen on every frame,
+// writes only at init time, hence the RWMutex.
+var registry = struct {
+	sync.RWMutex
+	codecs map[CodecType]Codec
+}{codecs: make(map[CodecType]Codec)}
+
+func init() {
+	Register(CodecTypeJSON, &JSONCodec{})
+	Register(CodecTypeBinary, &BinaryCodec{})
+	Register(CodecTypeProtobuf, &ProtobufCodec{})
+	Register(CodecTypeMsgpack, &MsgpackCodec{})
+	Register(CodecTypeGob, &GobCodec{})
+}
+
+// Register makes a codec available under the given type, both for GetCodec and for
+// frame validation in protocol.Decode. Like database/sql.Register, it is meant to be
+// called from an init function, and panics if c is nil or the type is already taken:
+//
+//	func init() {
+//	    codec.Register(100, &MyCodec{}) // custom types: stay clear of the built-ins (0-4)
+//	}
+func Register(codecType CodecType, c Codec) {
+	if c == nil {
+		panic("codec: Register codec is nil")
+	}
+	registry.Lock()
+	defer registry.Unlock()
+	if _, dup := registry.codecs[codecType]; dup {
+		panic(fmt.Sprintf("codec: Register called twice for codec type %d", codecType))
 	}
-	return &BinaryCodec{}
+	registry.codecs[codecType] = c
+	codectype.Add(byte(codecType))
+}
+
+// GetCodec returns the codec registered under the given type, or nil if there is none.
+//
+// Frames with an unregistered codec type never get past protocol.Decode, so a nil
+// result only happens for a locally misconfigured type (e.g., a typo in NewClient).
+func GetCodec(codecType CodecType) Codec {
+	registry.RLock()
+	defer registry.RUnlock()
+	return registry.codecs[codecType]
 }
@@ -1,8 +1,18 @@
 package codec
 
 import (
+	"encoding/binary"
+	"fmt"
 	"mini-rpc/message"
+	"mini-rpc/protocol"
+	"mini-rpc/status"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 )
 
 func TestJSONCodec(t *testing.T) {
@@ -73,5 +83,352 @@ func TestBinaryCodec(t *testing.T) {
 		t.Errorf("Error mismatch: got %s, want %s", decodedMsg.Error, originalMsg.Error)
 	}
 
+	// The payload aliases the frame body instead of copying it, with its capacity clipped
+	// so an append can't overwrite the fields behind it
+	if &decodedMsg.Payload[0] != &data[6+len(originalMsg.ServiceMethod)] {
+		t.Error("Expect the decoded payload to alias the input")
+	}
+	if cap(decodedMsg.Payload) != len(decodedMsg.Payload) {
+		t.Errorf("Expect the payload capacity to be clipped, got cap %d for len %d", cap(decodedMsg.Payload), len(decodedMsg.Payload))
+	}
+
 	t.Logf("Pass all the test for BinaryCodec!")
-}
\ No newline at end of file
+}
+func TestCodecExtendedFields(t *testing.T) {
+	for _, cdc := range []Codec{&JSONCodec{}, &BinaryCodec{}, &ProtobufCodec{}, &MsgpackCodec{}, &GobCodec{}} {
+		originalMsg := &message.RPCMessage{
+			ServiceMethod: "ArithService.Add",
+			Payload:       []byte(`{"a":1,"b":2}`),
+			Timeout:       1500 * time.Millisecond,
+			Metadata:      map[string]string{"trace-id": "abc123", "tenant": "t1", "empty": ""},
+			Error:         "method not found",
+			Code:          status.NotFound,
+			Details:       []string{"Add", "Multiply"},
+		}
+
+		data, err := cdc.Encode(originalMsg)
+		if err != nil {
+			t.Fatalf("%T Encode failed: %v", cdc, err)
+		}
+
+		var decodedMsg message.RPCMessage
+		if err := cdc.Decode(data, &decodedMsg); err != nil {
+			t.Fatalf("%T Decode failed: %v", cdc, err)
+		}
+
+		if decodedMsg.Timeout != originalMsg.Timeout {
+			t.Errorf("%T Timeout mismatch: got %v, want %v", cdc, decodedMsg.Timeout, originalMsg.Timeout)
+		}
+		if !reflect.DeepEqual(decodedMsg.Metadata, originalMsg.Metadata) {
+			t.Errorf("%T Metadata mismatch: got %v, want %v", cdc, decodedMsg.Metadata, originalMsg.Metadata)
+		}
+		if !reflect.DeepEqual(decodedMsg.Status(), originalMsg.Status()) {
+			t.Errorf("%T Status mismatch: got %+v, want %+v", cdc, decodedMsg.Status(), originalMsg.Status())
+		}
+	}
+}
+
+func TestProtobufCodec(t *testing.T) {
+	cdc := &ProtobufCodec{}
+
+	// Payload: any proto.Message round-trips through proto.Marshal
+	data, err := cdc.Encode(wrapperspb.String("hello"))
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	var decoded wrapperspb.StringValue
+	if err := cdc.Decode(data, &decoded); err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	if decoded.GetValue() != "hello" {
+		t.Errorf("Value mismatch: got %q, want %q", decoded.GetValue(), "hello")
+	}
+
+	// Non-protobuf values are rejected instead of being silently mis-encoded
+	if _, err := cdc.Encode(&struct{ A int }{1}); err == nil {
+		t.Errorf("Expect an error encoding a non-proto.Message value")
+	}
+
+	// Envelope: fields added by a newer peer are skipped
+	data, err = cdc.Encode(&message.RPCMessage{ServiceMethod: "Arith.Add", Payload: []byte{1, 2}})
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	data = protowire.AppendTag(data, 99, protowire.BytesType)
+	data = protowire.AppendString(data, "from the future")
+	var msg message.RPCMessage
+	if err := cdc.Decode(data, &msg); err != nil {
+		t.Fatalf("Decode with an unknown field failed: %v", err)
+	}
+	if msg.ServiceMethod != "Arith.Add" || !reflect.DeepEqual(msg.Payload, []byte{1, 2}) {
+		t.Errorf("Envelope mismatch: got %+v", msg)
+	}
+
+	// Truncated input is an error, not a panic
+	if err := cdc.Decode(data[:len(data)-3], &msg); err == nil {
+		t.Errorf("Expect an error decoding a truncated envelope")
+	}
+}
+
+// point has its own binary form, so BinaryCodec must use it instead of JSON.
+type point struct{ X, Y uint16 }
+
+func (p *point) MarshalBinary() ([]byte, error) {
+	return []byte{byte(p.X >> 8), byte(p.X), byte(p.Y >> 8), byte(p.Y)}, nil
+}
+
+func (p *point) UnmarshalBinary(data []byte) error {
+	if len(data) != 4 {
+		return fmt.Errorf("point: want 4 bytes, got %d", len(data))
+	}
+	p.X = uint16(data[0])<<8 | uint16(data[1])
+	p.Y = uint16(data[2])<<8 | uint16(data[3])
+	return nil
+}
+
+func TestBinaryCodecPayload(t *testing.T) {
+	cdc := &BinaryCodec{}
+
+	// BinaryMarshaler: the type's own compact encoding
+	data, err := cdc.Encode(&point{X: 1, Y: 2})
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	if !reflect.DeepEqual(data, []byte{0, 1, 0, 2}) {
+		t.Errorf("Expect the MarshalBinary form, got %v", data)
+	}
+	var p point
+	if err := cdc.Decode(data, &p); err != nil || p != (point{X: 1, Y: 2}) {
+		t.Errorf("Decode mismatch: got %+v (%v)", p, err)
+	}
+
+	// Plain structs fall back to JSON, so existing services keep working unchanged
+	data, err = cdc.Encode(&struct{ A int }{A: 7})
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	if string(data) != `{"A":7}` {
+		t.Errorf("Expect JSON fallback, got %s", data)
+	}
+}
+
+// upperCodec is a toy custom codec: JSON, but registered under its own type.
+type upperCodec struct{ JSONCodec }
+
+func (c *upperCodec) Type() CodecType { return 100 }
+
+func TestRegister(t *testing.T) {
+	// Built-ins are registered and report their own type
+	for _, typ := range []CodecType{CodecTypeJSON, CodecTypeBinary, CodecTypeProtobuf, CodecTypeMsgpack, CodecTypeGob} {
+		cdc := GetCodec(typ)
+		if cdc == nil || cdc.Type() != typ {
+			t.Fatalf("Expect a registered codec for type %d, got %v", typ, cdc)
+		}
+	}
+
+	// Unknown types are no longer silently mapped to BinaryCodec
+	if cdc := GetCodec(200); cdc != nil {
+		t.Errorf("Expect nil for an unregistered type, got %T", cdc)
+	}
+
+	// A custom codec becomes visible to both GetCodec and protocol validation.
+	// Registration is process-wide: with -count > 1, type 100 is already there on later runs.
+	if GetCodec(100) == nil {
+		if protocol.IsCodecTypeRegistered(100) {
+			t.Fatalf("Expect type 100 to be rejected by the protocol before Register")
+		}
+		Register(100, &upperCodec{})
+	}
+	if _, ok := GetCodec(100).(*upperCodec); !ok {
+		t.Errorf("Expect the custom codec for type 100, got %T", GetCodec(100))
+	}
+	if !protocol.IsCodecTypeRegistered(100) {
+		t.Errorf("Expect type 100 to be accepted by the protocol after Register")
+	}
+
+	// Registering a type twice is a programming error
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Expect Register to panic on a duplicate type")
+		}
+	}()
+	Register(CodecTypeJSON, &JSONCodec{})
+}
+
+func TestPayloadCodecs(t *testing.T) {
+	type args struct {
+		A, B int
+		Tags map[string]string
+	}
+	for _, cdc := range []Codec{&JSONCodec{}, &BinaryCodec{}, &MsgpackCodec{}, &GobCodec{}} {
+		original := &args{A: 1, B: -2, Tags: map[string]string{"k": "v"}}
+		data, err := cdc.Encode(original)
+		if err != nil {
+			t.Fatalf("%T Encode failed: %v", cdc, err)
+		}
+		var decoded args
+		if err := cdc.Decode(data, &decoded); err != nil {
+			t.Fatalf("%T Decode failed: %v", cdc, err)
+		}
+		if !reflect.DeepEqual(&decoded, original) {
+			t.Errorf("%T mismatch: got %+v, want %+v", cdc, decoded, *original)
+		}
+	}
+}
+
+// fullMessage sets every RPCMessage field, so truncating its encoding hits every length prefix.
+func fullMessage() *message.RPCMessage {
+	return &message.RPCMessage{
+		ServiceMethod: "Arith.Add",
+		Payload:       []byte(`{"A":1,"B":2}`),
+		Error:         "boom",
+		Timeout:       time.Second,
+		Metadata:      map[string]string{"trace-id": "abc"},
+		Code:          status.Internal,
+		Details:       []string{"detail"},
+	}
+}
+
+func TestBinaryCodecTruncated(t *testing.T) {
+	cdc := &BinaryCodec{}
+	data, err := cdc.Encode(fullMessage())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every strict prefix is an error, never a panic — except those ending right before an
+	// optional section, which are messages in an older format
+	m := fullMessage()
+	afterError := 2 + len(m.ServiceMethod) + 4 + len(m.Payload) + 2 + len(m.Error)
+	afterMetadata := afterError + 8 + 2 + 2 + len("trace-id") + 2 + len("abc")
+	older := map[int]bool{afterError: true, afterError + 8: true, afterMetadata: true}
+	for n := 0; n < len(data); n++ {
+		var msg message.RPCMessage
+		if err := cdc.Decode(data[:n], &msg); (err == nil) != older[n] {
+			t.Fatalf("Body truncated to %d of %d bytes: unexpected result %v", n, len(data), err)
+		}
+	}
+
+	// A length prefix pointing past the end names the field
+	var msg message.RPCMessage
+	err = cdc.Decode([]byte{0xff, 0xff, 'A'}, &msg)
+	if err == nil || err.Error() != "BinaryCodec: truncated method at offset 2: need 65535 bytes, have 1" {
+		t.Errorf("Expect a descriptive error, got %v", err)
+	}
+
+	// A huge metadata count must not make the decoder allocate for it
+	data = append(make([]byte, 0, 32), 0, 0, 0, 0, 0, 0, 0, 0)
+	data = append(data, make([]byte, 8)...)
+	data = append(data, 0xff, 0xff)
+	if err := cdc.Decode(data, &msg); err == nil {
+		t.Error("Expect an error for metadata pairs that aren't there")
+	}
+}
+
+func TestBinaryCodecBaselineFormat(t *testing.T) {
+	// The original format: MethodLen │ Method │ PayloadLen │ Payload │ ErrLen │ Error, nothing after
+	baseline := func(method, payload, errMsg string) []byte {
+		var b []byte
+		b = binary.BigEndian.AppendUint16(b, uint16(len(method)))
+		b = append(b, method...)
+		b = binary.BigEndian.AppendUint32(b, uint32(len(payload)))
+		b = append(b, payload...)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(errMsg)))
+		return append(b, errMsg...)
+	}
+	cdc := &BinaryCodec{}
+
+	// A request: no deadline, no metadata
+	var req message.RPCMessage
+	if err := cdc.Decode(baseline("Arith.Add", `{"A":1,"B":2}`, ""), &req); err != nil {
+		t.Fatal(err)
+	}
+	if req.ServiceMethod != "Arith.Add" || string(req.Payload) != `{"A":1,"B":2}` || req.Timeout != 0 || req.Metadata != nil {
+		t.Fatalf("Request mismatch: %+v", req)
+	}
+
+	// A failed response: the error string alone, reported as Unknown
+	var resp message.RPCMessage
+	if err := cdc.Decode(baseline("", "", "division by zero"), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if st := resp.Status(); st == nil || st.Code != status.Unknown || st.Message != "division by zero" || resp.Details != nil {
+		t.Fatalf("Response mismatch: %+v", resp)
+	}
+}
+
+func TestBinaryCodecEncodeLimits(t *testing.T) {
+	cdc := &BinaryCodec{}
+	long := strings.Repeat("x", 1<<16)
+	for name, msg := range map[string]*message.RPCMessage{
+		"method":         {ServiceMethod: long},
+		"error":          {Error: long},
+		"metadata key":   {Metadata: map[string]string{long: "v"}},
+		"metadata value": {Metadata: map[string]string{"k": long}},
+		"detail":         {Details: []string{long}},
+	} {
+		if _, err := cdc.Encode(msg); err == nil {
+			t.Errorf("%s: expect an error instead of a truncated length prefix", name)
+		}
+	}
+
+	// The largest lengths that fit still round-trip
+	fits := strings.Repeat("x", 1<<16-1)
+	data, err := cdc.Encode(&message.RPCMessage{ServiceMethod: fits, Error: fits})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg message.RPCMessage
+	if err := cdc.Decode(data, &msg); err != nil || msg.ServiceMethod != fits || msg.Error != fits {
+		t.Errorf("Expect 65535-byte fields to round-trip, got %v", err)
+	}
+}
+
+// fuzzRoundTrip checks the invariant both fuzz targets share: decoding arbitrary input never
+// panics, and a message that decodes re-encodes to something that decodes the same way.
+func fuzzRoundTrip(t *testing.T, cdc Codec, data []byte) {
+	var first message.RPCMessage
+	if err := cdc.Decode(data, &first); err != nil {
+		return
+	}
+	encoded, err := cdc.Encode(&first)
+	if err != nil {
+		t.Fatalf("Encode of a decoded message failed: %v", err)
+	}
+	var second message.RPCMessage
+	if err := cdc.Decode(encoded, &second); err != nil {
+		t.Fatalf("Decode of a re-encoded message failed: %v", err)
+	}
+	if !reflect.DeepEqual(first, second) {
+		t.Fatalf("Round trip mismatch:\n%+v\n%+v", first, second)
+	}
+}
+
+func FuzzBinaryCodec(f *testing.F) {
+	cdc := &BinaryCodec{}
+	for _, msg := range []*message.RPCMessage{{}, {ServiceMethod: "Arith.Add", Payload: []byte(`{"A":1}`)}, fullMessage()} {
+		data, err := cdc.Encode(msg)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzzRoundTrip(t, cdc, data)
+	})
+}
+
+func FuzzJSONCodec(f *testing.F) {
+	cdc := &JSONCodec{}
+	for _, msg := range []*message.RPCMessage{{}, fullMessage()} {
+		data, err := cdc.Encode(msg)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+	f.Add([]byte(`{"Payload":null,"Metadata":{}}`))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzzRoundTrip(t, cdc, data)
+	})
+}
@@ -0,0 +1,30 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/gob"
+)
+
+// GobCodec uses Go's standard library encoding/gob for both the RPCMessage envelope
+// and the args/reply.
+// Pros: handles any Go type JSON can't (maps with non-string keys, exact integer and
+// float types), no extra dependency.
+// Cons: Go-only; and since every frame is encoded independently, each one carries its
+// own type descriptors, which makes small messages larger than with JSON.
+type GobCodec struct{}
+
+func (c *GobCodec) Encode(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *GobCodec) Decode(data []byte, v any) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+func (c *GobCodec) Type() CodecType {
+	return CodecTypeGob
+}
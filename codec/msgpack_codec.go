@@ -0,0 +1,25 @@
+package codec
+
+import (
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// MsgpackCodec uses MessagePack (github.com/vmihailenco/msgpack) for both the RPCMessage
+// envelope and the args/reply.
+// Pros: schemaless like JSON (any struct works, no generated code), but binary — no field
+// name quoting or number formatting, and noticeably smaller payloads; widely supported
+// across languages.
+// Cons: field names are still repeated in every message (unlike Protobuf or Binary).
+type MsgpackCodec struct{}
+
+func (c *MsgpackCodec) Encode(v any) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+func (c *MsgpackCodec) Decode(data []byte, v any) error {
+	return msgpack.Unmarshal(data, v)
+}
+
+func (c *MsgpackCodec) Type() CodecType {
+	return CodecTypeMsgpack
+}
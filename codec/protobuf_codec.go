@@ -0,0 +1,193 @@
+package codec
+
+import (
+	"fmt"
+	"mini-rpc/message"
+	"mini-rpc/status"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// ProtobufCodec encodes both the RPCMessage envelope and the args/reply in Protocol Buffers
+// wire format, so services written in other languages can talk to mini-rpc with any
+// protobuf library.
+//
+// The *message.RPCMessage envelope is encoded by hand (no generated code needed),
+// following this schema:
+//
+//	message RPCMessage {
+//	    string              service_method = 1;
+//	    string              error          = 2;
+//	    bytes               payload        = 3; // args or reply, itself a protobuf message
+//	    int64               timeout_ns     = 4;
+//	    map<string, string> metadata       = 5;
+//	    uint32              code           = 6; // status.Code
+//	    repeated string     details        = 7;
+//	}
+//
+// Any other value must implement proto.Message (generated args/reply types) and is
+// encoded with proto.Marshal. Unknown envelope fields are skipped, so the schema can
+// grow without breaking older peers.
+type ProtobufCodec struct{}
+
+// Field numbers of the RPCMessage envelope.
+const (
+	pbFieldServiceMethod protowire.Number = 1
+	pbFieldError         protowire.Number = 2
+	pbFieldPayload       protowire.Number = 3
+	pbFieldTimeout       protowire.Number = 4
+	pbFieldMetadata      protowire.Number = 5
+	pbFieldCode          protowire.Number = 6
+	pbFieldDetails       protowire.Number = 7
+
+	// Map entries are encoded as nested messages with key = 1, value = 2
+	pbFieldMapKey   protowire.Number = 1
+	pbFieldMapValue protowire.Number = 2
+)
+
+func (c *ProtobufCodec) Encode(v any) ([]byte, error) {
+	switch v := v.(type) {
+	case *message.RPCMessage:
+		return encodeProtoEnvelope(v), nil
+	case proto.Message:
+		return proto.Marshal(v)
+	default:
+		return nil, fmt.Errorf("ProtobufCodec: %T does not implement proto.Message", v)
+	}
+}
+
+func (c *ProtobufCodec) Decode(data []byte, v any) error {
+	switch v := v.(type) {
+	case *message.RPCMessage:
+		return decodeProtoEnvelope(data, v)
+	case proto.Message:
+		return proto.Unmarshal(data, v)
+	default:
+		return fmt.Errorf("ProtobufCodec: %T does not implement proto.Message", v)
+	}
+}
+
+func (c *ProtobufCodec) Type() CodecType {
+	return CodecTypeProtobuf
+}
+
+// encodeProtoEnvelope appends each non-zero field, as proto3 does (zero values are omitted).
+func encodeProtoEnvelope(msg *message.RPCMessage) []byte {
+	var b []byte
+	if msg.ServiceMethod != "" {
+		b = protowire.AppendTag(b, pbFieldServiceMethod, protowire.BytesType)
+		b = protowire.AppendString(b, msg.ServiceMethod)
+	}
+	if msg.Error != "" {
+		b = protowire.AppendTag(b, pbFieldError, protowire.BytesType)
+		b = protowire.AppendString(b, msg.Error)
+	}
+	if len(msg.Payload) > 0 {
+		b = protowire.AppendTag(b, pbFieldPayload, protowire.BytesType)
+		b = protowire.AppendBytes(b, msg.Payload)
+	}
+	if msg.Timeout != 0 {
+		b = protowire.AppendTag(b, pbFieldTimeout, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(msg.Timeout))
+	}
+	for k, v := range msg.Metadata {
+		var entry []byte
+		entry = protowire.AppendTag(entry, pbFieldMapKey, protowire.BytesType)
+		entry = protowire.AppendString(entry, k)
+		entry = protowire.AppendTag(entry, pbFieldMapValue, protowire.BytesType)
+		entry = protowire.AppendString(entry, v)
+		b = protowire.AppendTag(b, pbFieldMetadata, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+	if msg.Code != status.OK {
+		b = protowire.AppendTag(b, pbFieldCode, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(msg.Code))
+	}
+	for _, d := range msg.Details {
+		b = protowire.AppendTag(b, pbFieldDetails, protowire.BytesType)
+		b = protowire.AppendString(b, d)
+	}
+	return b
+}
+
+// decodeProtoEnvelope parses fields in any order; later occurrences of scalar fields win.
+func decodeProtoEnvelope(data []byte, msg *message.RPCMessage) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		switch {
+		case num == pbFieldServiceMethod && typ == protowire.BytesType:
+			msg.ServiceMethod, n = protowire.ConsumeString(data)
+		case num == pbFieldError && typ == protowire.BytesType:
+			msg.Error, n = protowire.ConsumeString(data)
+		case num == pbFieldPayload && typ == protowire.BytesType:
+			var payload []byte
+			payload, n = protowire.ConsumeBytes(data)
+			msg.Payload = append([]byte(nil), payload...) // Copy — don't alias the frame body
+		case num == pbFieldTimeout && typ == protowire.VarintType:
+			var timeout uint64
+			timeout, n = protowire.ConsumeVarint(data)
+			msg.Timeout = time.Duration(timeout)
+		case num == pbFieldMetadata && typ == protowire.BytesType:
+			var entry []byte
+			entry, n = protowire.ConsumeBytes(data)
+			if n >= 0 {
+				k, v, err := decodeProtoMapEntry(entry)
+				if err != nil {
+					return err
+				}
+				if msg.Metadata == nil {
+					msg.Metadata = make(map[string]string)
+				}
+				msg.Metadata[k] = v
+			}
+		case num == pbFieldCode && typ == protowire.VarintType:
+			var code uint64
+			code, n = protowire.ConsumeVarint(data)
+			msg.Code = status.Code(code)
+		case num == pbFieldDetails && typ == protowire.BytesType:
+			var detail string
+			detail, n = protowire.ConsumeString(data)
+			msg.Details = append(msg.Details, detail)
+		default:
+			// Unknown field (or known field with an unexpected wire type): skip it
+			n = protowire.ConsumeFieldValue(num, typ, data)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// decodeProtoMapEntry parses one map<string, string> entry.
+func decodeProtoMapEntry(data []byte) (key, value string, err error) {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return "", "", protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		switch {
+		case num == pbFieldMapKey && typ == protowire.BytesType:
+			key, n = protowire.ConsumeString(data)
+		case num == pbFieldMapValue && typ == protowire.BytesType:
+			value, n = protowire.ConsumeString(data)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, data)
+		}
+		if n < 0 {
+			return "", "", protowire.ParseError(n)
+		}
+		data = data[n:]
+	}
+	return key, value, nil
+}
@@ -0,0 +1,140 @@
+// Package compressor provides pluggable frame body compression for mini-RPC.
+//
+// The compressor type travels in the frame header (protocol.Header.Compressor), together
+// with protocol.FlagCompressed, so every frame says how its own body was compressed:
+//
+//	client: ctx/Client picks gzip → header.Compressor = Gzip, FlagCompressed → gzip(body)
+//	server: header says Gzip + FlagCompressed → decompress → ... → response compressed with Gzip too
+//
+// Bodies smaller than Threshold are sent as is (no FlagCompressed) even when compression is
+// requested: for tiny bodies the compressed form is often larger, and the CPU cost buys nothing.
+package compressor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mini-rpc/protocol"
+	"sync"
+)
+
+// Type identifies a compression algorithm. It is stored in 4 bits of the frame header,
+// so valid types are 0-15, and 0 always means "not compressed".
+type Type byte
+
+const (
+	None    Type = 0 // Body is not compressed
+	Gzip    Type = 1 // compress/gzip
+	Deflate Type = 2 // compress/flate (raw deflate, no gzip header — a few bytes smaller)
+)
+
+// MaxType is the highest compressor type the frame header can carry.
+const MaxType Type = 15
+
+// Threshold is the minimum body size, in bytes, for a frame to be compressed.
+const Threshold = 1024
+
+// ErrTooLarge is returned by Decompress when the decompressed body would exceed the limit.
+var ErrTooLarge = errors.New("compressor: decompressed body too large")
+
+// Compressor compresses and decompresses frame bodies.
+// One instance serves every connection, so a Compressor must be safe for concurrent use.
+//
+// Decompress must stop with ErrTooLarge once the output exceeds limit bytes: a few KiB of
+// compressed zeros can expand to gigabytes, so the frame size limit alone protects nothing.
+type Compressor interface {
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte, limit int) ([]byte, error)
+	Type() Type
+}
+
+// registry maps compressor types to their implementation (same design as codec's registry).
+var registry = struct {
+	sync.RWMutex
+	compressors map[Type]Compressor
+}{compressors: make(map[Type]Compressor)}
+
+func init() {
+	Register(Gzip, &GzipCompressor{})
+	Register(Deflate, &DeflateCompressor{})
+}
+
+// Register makes a compressor available under the given type, both for Get and for frame
+// validation in protocol.Decode. It is meant to be called from an init function, and
+// panics if c is nil, the type is None or out of range, or the type is already taken.
+func Register(t Type, c Compressor) {
+	if c == nil {
+		panic("compressor: Register compressor is nil")
+	}
+	if t == None || t > MaxType {
+		panic(fmt.Sprintf("compressor: Register type %d out of range 1-%d", t, MaxType))
+	}
+	registry.Lock()
+	defer registry.Unlock()
+	if _, dup := registry.compressors[t]; dup {
+		panic(fmt.Sprintf("compressor: Register called twice for compressor type %d", t))
+	}
+	registry.compressors[t] = c
+	protocol.RegisterCompressorType(byte(t))
+}
+
+// Get returns the compressor registered under the given type, or nil if there is none
+// (including for None).
+func Get(t Type) Compressor {
+	registry.RLock()
+	defer registry.RUnlock()
+	return registry.compressors[t]
+}
+
+// Compress compresses a frame body with the compressor of type t, unless t is None or
+// the body is smaller than Threshold. It reports whether the body was compressed, which
+// the sender records as protocol.FlagCompressed.
+//
+// The frame header carries t even when the body is left as is: that is what lets the
+// server answer with the client's algorithm when a small request produces a large reply.
+func Compress(t Type, body []byte) ([]byte, bool, error) {
+	if t == None {
+		return body, false, nil
+	}
+	c := Get(t)
+	if c == nil {
+		return nil, false, fmt.Errorf("unsupported compressor type: %d", t)
+	}
+	if len(body) < Threshold {
+		return body, false, nil
+	}
+	compressed, err := c.Compress(body)
+	if err != nil {
+		return nil, false, err
+	}
+	return compressed, true, nil
+}
+
+// Decompress decompresses a received frame body with the compressor of type t, failing
+// with ErrTooLarge if the result would exceed limit bytes. Callers only use it for frames
+// flagged protocol.FlagCompressed, and pass the same limit as for the frame itself.
+func Decompress(t Type, body []byte, limit int) ([]byte, error) {
+	c := Get(t)
+	if c == nil {
+		return nil, fmt.Errorf("unsupported compressor type: %d", t)
+	}
+	return c.Decompress(body, limit)
+}
+
+// contextKey is the context key for a per-call compressor choice.
+type contextKey struct{}
+
+// NewContext returns a ctx that asks the client to compress the call's request with t,
+// overriding the Client's default. Use None to disable compression for one call.
+//
+//	ctx = compressor.NewContext(ctx, compressor.Gzip)
+//	err := cli.CallContext(ctx, "Blob.Put", bigArgs, &reply)
+func NewContext(ctx context.Context, t Type) context.Context {
+	return context.WithValue(ctx, contextKey{}, t)
+}
+
+// FromContext returns the compressor chosen with NewContext, if any.
+func FromContext(ctx context.Context) (Type, bool) {
+	t, ok := ctx.Value(contextKey{}).(Type)
+	return t, ok
+}
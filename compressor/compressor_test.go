@@ -0,0 +1,140 @@
+package compressor
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestCompressRoundTrip(t *testing.T) {
+	big := []byte(strings.Repeat("mini-rpc compresses large frames. ", 200))
+	small := []byte("tiny")
+
+	for _, ct := range []Type{Gzip, Deflate} {
+		// Large bodies are compressed, and come out smaller
+		body, compressed, err := Compress(ct, big)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !compressed || len(body) >= len(big) {
+			t.Fatalf("type %d: expected a compressed body, got %d bytes", ct, len(body))
+		}
+		got, err := Decompress(ct, body, len(big))
+		if err != nil || !bytes.Equal(got, big) {
+			t.Fatalf("type %d: round trip failed (%v)", ct, err)
+		}
+
+		// Bodies below Threshold are left as is
+		body, compressed, err = Compress(ct, small)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if compressed || !bytes.Equal(body, small) {
+			t.Fatalf("type %d: expected the body as is, got %v", ct, body)
+		}
+	}
+
+	// None leaves the body untouched
+	if body, compressed, _ := Compress(None, big); compressed || !bytes.Equal(body, big) {
+		t.Fatal("None must not change the body")
+	}
+}
+
+func TestDecompressLimit(t *testing.T) {
+	// 16 MiB of zeros compresses to a few KiB: the limit must stop it, not the frame size
+	bomb := make([]byte, 16<<20)
+	for _, ct := range []Type{Gzip, Deflate} {
+		body, _, err := Compress(ct, bomb)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Decompress(ct, body, 1<<20); err != ErrTooLarge {
+			t.Fatalf("type %d: expected ErrTooLarge, got %v", ct, err)
+		}
+		if got, err := Decompress(ct, body, len(bomb)); err != nil || len(got) != len(bomb) {
+			t.Fatalf("type %d: expected %d bytes at the exact limit, got %d (%v)", ct, len(bomb), len(got), err)
+		}
+	}
+}
+
+func TestDecompressErrors(t *testing.T) {
+	if _, err := Decompress(Gzip, []byte{1, 2, 3}, 100); err == nil {
+		t.Fatal("expected an error for corrupt gzip data")
+	}
+	if _, err := Decompress(9, []byte{1, 2, 3}, 100); err == nil {
+		t.Fatal("expected an error for an unregistered type")
+	}
+	if _, _, err := Compress(9, []byte("x")); err == nil {
+		t.Fatal("expected an error for an unregistered type")
+	}
+}
+
+// reverseCompressor is a toy compressor used to test Register.
+type reverseCompressor struct{}
+
+func (reverseCompressor) Compress(data []byte) ([]byte, error) {
+	out := make([]byte, len(data))
+	for i, b := range data {
+		out[len(data)-1-i] = b
+	}
+	return out, nil
+}
+
+func (c reverseCompressor) Decompress(data []byte, limit int) ([]byte, error) {
+	if len(data) > limit {
+		return nil, ErrTooLarge
+	}
+	return c.Compress(data)
+}
+
+func (reverseCompressor) Type() Type { return 12 }
+
+func TestRegister(t *testing.T) {
+	// Registration is process-wide: with -count > 1, type 12 is already there on later runs
+	if Get(12) == nil {
+		Register(12, reverseCompressor{})
+	}
+	if Get(12) == nil {
+		t.Fatal("expected the registered compressor")
+	}
+
+	big := bytes.Repeat([]byte("ab"), Threshold)
+	body, _, err := Compress(12, big)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := Decompress(12, body, len(big)); err != nil || !bytes.Equal(got, big) {
+		t.Fatalf("round trip failed (%v)", err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		t    Type
+		c    Compressor
+	}{
+		{"duplicate", Gzip, reverseCompressor{}},
+		{"none", None, reverseCompressor{}},
+		{"out of range", MaxType + 1, reverseCompressor{}},
+		{"nil", 13, nil},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("%s: expected Register to panic", tc.name)
+				}
+			}()
+			Register(tc.t, tc.c)
+		}()
+	}
+}
+
+func TestContext(t *testing.T) {
+	ctx := context.Background()
+	if _, ok := FromContext(ctx); ok {
+		t.Fatal("expected no compressor in a bare ctx")
+	}
+	if ct, ok := FromContext(NewContext(ctx, Deflate)); !ok || ct != Deflate {
+		t.Fatalf("expected Deflate, got %d", ct)
+	}
+}
@@ -0,0 +1,98 @@
+package compressor
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"sync"
+)
+
+// GzipCompressor uses compress/gzip. Writers are pooled: allocating a gzip.Writer costs
+// far more than compressing a typical RPC body.
+type GzipCompressor struct {
+	writers sync.Pool // *gzip.Writer
+}
+
+func (c *GzipCompressor) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, ok := c.writers.Get().(*gzip.Writer)
+	if ok {
+		w.Reset(&buf)
+	} else {
+		w = gzip.NewWriter(&buf)
+	}
+	defer c.writers.Put(w)
+
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *GzipCompressor) Decompress(data []byte, limit int) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return readAllLimit(r, limit)
+}
+
+func (c *GzipCompressor) Type() Type {
+	return Gzip
+}
+
+// DeflateCompressor uses compress/flate: the same algorithm as gzip without the
+// gzip header and checksum (TCP already checksums the stream).
+type DeflateCompressor struct {
+	writers sync.Pool // *flate.Writer
+}
+
+func (c *DeflateCompressor) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, ok := c.writers.Get().(*flate.Writer)
+	if ok {
+		w.Reset(&buf)
+	} else {
+		var err error
+		if w, err = flate.NewWriter(&buf, flate.DefaultCompression); err != nil {
+			return nil, err
+		}
+	}
+	defer c.writers.Put(w)
+
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *DeflateCompressor) Decompress(data []byte, limit int) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+	return readAllLimit(r, limit)
+}
+
+func (c *DeflateCompressor) Type() Type {
+	return Deflate
+}
+
+// readAllLimit reads r to the end, failing with ErrTooLarge as soon as more than limit
+// bytes come out — without ever buffering more than limit+1 bytes.
+func readAllLimit(r io.Reader, limit int) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > limit {
+		return nil, ErrTooLarge
+	}
+	return data, nil
+}
@@ -0,0 +1,20 @@
+// Package codectype is the set of codec types protocol.Decode accepts. It sits between the
+// two packages so that only codec.Register can extend it: protocol can't import codec (codec
+// imports protocol), and a setter exported by protocol would let a frame through whose codec
+// type has no codec behind it.
+package codectype
+
+import "sync/atomic"
+
+// registered is indexed by codec type.
+var registered [256]atomic.Bool
+
+// Add makes Decode accept frames with the given codec type. Adding a type twice is harmless.
+func Add(codecType byte) {
+	registered[codecType].Store(true)
+}
+
+// Registered reports whether Decode accepts frames with the given codec type.
+func Registered(codecType byte) bool {
+	return registered[codecType].Load()
+}
@@ -0,0 +1,25 @@
+// Package leakcheck is a test helper shared by the packages whose shutdown paths must not
+// leave goroutines behind (client, transport).
+package leakcheck
+
+import (
+	"runtime"
+	"testing"
+	"time"
+)
+
+// Check waits until the number of goroutines is back to base or less. If it isn't after
+// two seconds, something leaked: the test fails with the stacks of all goroutines.
+//
+// base is runtime.NumGoroutine() taken before the code under test started its goroutines.
+func Check(t testing.TB, base int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > base {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<20)
+			t.Fatalf("goroutine leak: %d goroutines, want at most %d\n%s", runtime.NumGoroutine(), base, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -4,12 +4,77 @@
 // and wrapped in a protocol frame for transmission over TCP.
 package message
 
+import (
+	"mini-rpc/status"
+	"time"
+)
+
 // RPCMessage carries the data for a single RPC request or response.
 //
 //   - On request:  ServiceMethod is set, Payload contains the serialized args, Error is empty.
-//   - On response: Payload contains the serialized reply, Error is non-empty if the call failed.
+//   - On response: Payload contains the serialized reply; if the call failed, Code/Error/Details
+//     carry the structured status (see package status). Use Status() and SetError() rather than
+//     filling the three fields by hand.
+//
+// Metadata carries cross-cutting key/value pairs (trace IDs, auth tokens...) on both
+// requests and responses; see package metadata for the context helpers.
+//
+// Timeout carries the caller's remaining deadline (relative, to be immune to clock skew
+// between hosts). The server turns it back into a context deadline for the handler.
 type RPCMessage struct {
-	ServiceMethod string // Format: "ServiceName.MethodName", e.g., "Arith.Add"
-	Error         string // Non-empty if the server-side handler returned an error
-	Payload       []byte // Serialized args (request) or reply (response) as JSON bytes
+	ServiceMethod string            // Format: "ServiceName.MethodName", e.g., "Arith.Add"
+	Error         string            // Status message, non-empty if the server-side handler returned an error
+	Payload       []byte            // Serialized args (request) or reply (response) as JSON bytes
+	Timeout       time.Duration     // Request only: time left before the client gives up, 0 = no deadline
+	Metadata      map[string]string // Optional per-call key/value pairs, nil if none
+	Code          status.Code       // Status code, status.OK on success
+	Details       []string          // Optional status details, nil if none
+}
+
+// Status returns the structured error carried by the message, or nil on success.
+//
+// A message with only Error set (e.g., built by third-party middleware that predates
+// status codes) is reported as status.Unknown, so no failure is ever mistaken for success.
+func (m *RPCMessage) Status() *status.Status {
+	if m.Code == status.OK && m.Error == "" {
+		return nil
+	}
+	code := m.Code
+	if code == status.OK {
+		code = status.Unknown
+	}
+	return &status.Status{Code: code, Message: m.Error, Details: m.Details}
+}
+
+// SetError records err as the message's status (converted with status.FromError).
+// A nil err clears any previous status.
+func (m *RPCMessage) SetError(err error) {
+	st := status.FromError(err)
+	if st == nil {
+		m.Code, m.Error, m.Details = status.OK, "", nil
+		return
+	}
+	m.Code, m.Error, m.Details = st.Code, st.Message, st.Details
+}
+
+// AddMetadata sets the pairs of kv in m.Metadata, replacing the values of keys already
+// there. It merges metadata that travelled outside the body (in a v2 frame's extension
+// area) back into the decoded message.
+func (m *RPCMessage) AddMetadata(kv map[string]string) {
+	if len(kv) == 0 {
+		return
+	}
+	if m.Metadata == nil {
+		m.Metadata = make(map[string]string, len(kv))
+	}
+	for k, v := range kv {
+		m.Metadata[k] = v
+	}
+}
+
+// NewErrorMessage builds a response message that carries only the status of err.
+func NewErrorMessage(err error) *RPCMessage {
+	msg := &RPCMessage{}
+	msg.SetError(err)
+	return msg
 }
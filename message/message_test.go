@@ -34,3 +34,16 @@ func TestRequestResponse(t *testing.T) {
 
 	fmt.Printf("Decoded Request: %+v\n", req2.Payload)
 }
+
+func TestAddMetadata(t *testing.T) {
+	var m RPCMessage
+	m.AddMetadata(nil)
+	if m.Metadata != nil {
+		t.Fatalf("Expect no metadata, got %v", m.Metadata)
+	}
+	m.AddMetadata(map[string]string{"a": "1", "b": "2"})
+	m.AddMetadata(map[string]string{"b": "3"})
+	if len(m.Metadata) != 2 || m.Metadata["a"] != "1" || m.Metadata["b"] != "3" {
+		t.Fatalf("Expect a=1 b=3, got %v", m.Metadata)
+	}
+}
@@ -0,0 +1,179 @@
+// Package metadata carries per-call key/value pairs (trace IDs, auth tokens, tenant IDs,
+// caller names...) alongside an RPC, without touching the args/reply types.
+//
+// Metadata travels with both requests and responses — in the frame's extension area on v2
+// connections, in RPCMessage.Metadata on v1 ones:
+//
+//	Client:  ctx = metadata.NewOutgoingContext(ctx, md)  → CallContext(ctx, ...)
+//	           → transport sends md with the request
+//	Server:  handleRequest puts the request md into ctx   → middleware / handler
+//	           → md, ok := metadata.FromIncomingContext(ctx)
+//
+// Responses carry metadata back the same way:
+//
+//	Server:  metadata.SetResponse(ctx, md) in middleware / handler
+//	           → handleRequest sends it with the response
+//	Client:  ctx = metadata.ReceiveResponse(ctx, &md)     → CallContext(ctx, ...)
+//	           → md holds the response metadata once the call returns
+//
+// For a streaming call, the metadata set by the handler is sent with the end of the stream
+// and read on the client with Stream.Trailer once Recv has returned.
+//
+// Outgoing and incoming metadata use different context keys on purpose: a server that
+// forwards its ctx to a downstream call must not leak its caller's metadata by accident.
+package metadata
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// MD is a set of metadata key/value pairs.
+type MD map[string]string
+
+// New creates an MD from a map. The map is copied, so later changes to m don't affect the MD.
+func New(m map[string]string) MD {
+	md := make(MD, len(m))
+	for k, v := range m {
+		md[k] = v
+	}
+	return md
+}
+
+// Pairs creates an MD from alternating key, value strings.
+// It panics if len(kv) is odd — that is always a programming error.
+func Pairs(kv ...string) MD {
+	if len(kv)%2 == 1 {
+		panic("metadata: Pairs got an odd number of input strings")
+	}
+	md := make(MD, len(kv)/2)
+	for i := 0; i < len(kv); i += 2 {
+		md[kv[i]] = kv[i+1]
+	}
+	return md
+}
+
+// Get returns the value for key, or "" if not present.
+func (md MD) Get(key string) string {
+	return md[key]
+}
+
+// Set sets the value for key, replacing any existing value.
+func (md MD) Set(key, value string) {
+	md[key] = value
+}
+
+// Copy returns a copy of md, safe to modify independently.
+func (md MD) Copy() MD {
+	return New(md)
+}
+
+// Context keys — unexported struct types so no other package can collide with them.
+type outgoingKey struct{}
+type incomingKey struct{}
+type responseKey struct{}
+type receiverKey struct{}
+
+// ErrNoResponse is returned by SetResponse when ctx is not the context of a request being
+// handled by the server.
+var ErrNoResponse = errors.New("metadata: no response to set metadata on")
+
+// NewOutgoingContext returns a context carrying md, to be sent with the next call made with it.
+func NewOutgoingContext(ctx context.Context, md MD) context.Context {
+	return context.WithValue(ctx, outgoingKey{}, md)
+}
+
+// AppendToOutgoingContext returns a context with kv added to any existing outgoing metadata.
+// The existing MD is copied, not modified, so contexts derived earlier are unaffected.
+func AppendToOutgoingContext(ctx context.Context, kv ...string) context.Context {
+	md, _ := FromOutgoingContext(ctx)
+	md = md.Copy()
+	for k, v := range Pairs(kv...) {
+		md[k] = v
+	}
+	return NewOutgoingContext(ctx, md)
+}
+
+// FromOutgoingContext returns the metadata to be sent with a call made with ctx.
+func FromOutgoingContext(ctx context.Context) (MD, bool) {
+	md, ok := ctx.Value(outgoingKey{}).(MD)
+	return md, ok
+}
+
+// NewIncomingContext returns a context carrying the metadata received with a request.
+// Used by the server before running the middleware chain.
+func NewIncomingContext(ctx context.Context, md MD) context.Context {
+	return context.WithValue(ctx, incomingKey{}, md)
+}
+
+// FromIncomingContext returns the metadata received with the current request.
+func FromIncomingContext(ctx context.Context) (MD, bool) {
+	md, ok := ctx.Value(incomingKey{}).(MD)
+	return md, ok
+}
+
+// responseMD collects the response metadata set while a request is handled. The handler
+// may run on another goroutine than the one that sends the response (e.g., under
+// TimeOutMiddleware), hence the lock.
+type responseMD struct {
+	mu sync.Mutex
+	md MD
+}
+
+// NewResponseContext returns a context in which SetResponse records response metadata.
+// Used by the server before running the middleware chain; FromResponseContext collects it.
+func NewResponseContext(ctx context.Context) context.Context {
+	return context.WithValue(ctx, responseKey{}, &responseMD{})
+}
+
+// SetResponse adds md to the metadata sent back with the response of the request handled
+// under ctx, replacing the values of keys set earlier. Metadata set once the response has
+// been sent (e.g., by a handler still running after its timeout) is dropped.
+//
+// It returns ErrNoResponse if ctx doesn't belong to a request being handled.
+func SetResponse(ctx context.Context, md MD) error {
+	r, ok := ctx.Value(responseKey{}).(*responseMD)
+	if !ok {
+		return ErrNoResponse
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.md == nil {
+		r.md = make(MD, len(md))
+	}
+	for k, v := range md {
+		r.md[k] = v
+	}
+	return nil
+}
+
+// FromResponseContext returns a copy of the response metadata set under ctx so far,
+// or nil if there is none.
+func FromResponseContext(ctx context.Context) MD {
+	r, ok := ctx.Value(responseKey{}).(*responseMD)
+	if !ok {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.md == nil {
+		return nil
+	}
+	return r.md.Copy()
+}
+
+// ReceiveResponse returns a context that makes a call made with it store the metadata of
+// its response in *md (nil if the server sent none) — the synchronous counterpart of
+// Call.Metadata. *md is set when the call returns, unless it gave up before a response
+// arrived (cancellation, deadline, connection failure).
+func ReceiveResponse(ctx context.Context, md *MD) context.Context {
+	return context.WithValue(ctx, receiverKey{}, md)
+}
+
+// ResponseReceiver returns the MD that a call made with ctx should fill with the response
+// metadata, or nil if the caller didn't ask for it with ReceiveResponse.
+func ResponseReceiver(ctx context.Context) *MD {
+	md, _ := ctx.Value(receiverKey{}).(*MD)
+	return md
+}
@@ -0,0 +1,102 @@
+package metadata
+
+import (
+	"context"
+	"testing"
+)
+
+func TestPairs(t *testing.T) {
+	md := Pairs("trace-id", "abc", "tenant", "t1")
+	if md.Get("trace-id") != "abc" || md.Get("tenant") != "t1" {
+		t.Fatalf("unexpected metadata: %v", md)
+	}
+	if md.Get("missing") != "" {
+		t.Fatalf("expect empty value for missing key")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expect panic on odd number of strings")
+		}
+	}()
+	Pairs("only-key")
+}
+
+func TestOutgoingIncomingAreSeparate(t *testing.T) {
+	ctx := NewOutgoingContext(context.Background(), Pairs("auth", "token"))
+
+	if _, ok := FromIncomingContext(ctx); ok {
+		t.Fatal("outgoing metadata must not be visible as incoming")
+	}
+	md, ok := FromOutgoingContext(ctx)
+	if !ok || md.Get("auth") != "token" {
+		t.Fatalf("expect outgoing auth=token, got %v", md)
+	}
+
+	in := NewIncomingContext(context.Background(), Pairs("caller", "svc-a"))
+	if _, ok := FromOutgoingContext(in); ok {
+		t.Fatal("incoming metadata must not be forwarded as outgoing")
+	}
+}
+
+func TestAppendToOutgoingContext(t *testing.T) {
+	parent := NewOutgoingContext(context.Background(), Pairs("a", "1"))
+	child := AppendToOutgoingContext(parent, "b", "2")
+
+	md, _ := FromOutgoingContext(child)
+	if md.Get("a") != "1" || md.Get("b") != "2" {
+		t.Fatalf("expect a=1 b=2, got %v", md)
+	}
+
+	// The parent context must be unaffected
+	parentMD, _ := FromOutgoingContext(parent)
+	if _, ok := parentMD["b"]; ok {
+		t.Fatal("AppendToOutgoingContext must not modify the parent metadata")
+	}
+}
+
+func TestSetResponse(t *testing.T) {
+	if err := SetResponse(context.Background(), Pairs("a", "1")); err != ErrNoResponse {
+		t.Fatalf("expect ErrNoResponse outside a request, got %v", err)
+	}
+
+	ctx := NewResponseContext(context.Background())
+	if md := FromResponseContext(ctx); md != nil {
+		t.Fatalf("expect no response metadata yet, got %v", md)
+	}
+	if err := SetResponse(ctx, Pairs("a", "1", "b", "2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetResponse(ctx, Pairs("b", "3")); err != nil {
+		t.Fatal(err)
+	}
+	md := FromResponseContext(ctx)
+	if md.Get("a") != "1" || md.Get("b") != "3" {
+		t.Fatalf("expect a=1 b=3, got %v", md)
+	}
+
+	// The result is a copy
+	md.Set("a", "x")
+	if FromResponseContext(ctx).Get("a") != "1" {
+		t.Fatal("FromResponseContext must return a copy")
+	}
+}
+
+func TestReceiveResponse(t *testing.T) {
+	if ResponseReceiver(context.Background()) != nil {
+		t.Fatal("expect no receiver by default")
+	}
+	var md MD
+	ctx := ReceiveResponse(context.Background(), &md)
+	if ResponseReceiver(ctx) != &md {
+		t.Fatal("expect the receiver passed to ReceiveResponse")
+	}
+
+	// A server ctx holding response metadata is not a receiver, and vice versa
+	if ResponseReceiver(NewResponseContext(context.Background())) != nil {
+		t.Fatal("response metadata must not be visible as a receiver")
+	}
+	if SetResponse(ctx, Pairs("a", "1")) != ErrNoResponse {
+		t.Fatal("a receiver must not accept response metadata")
+	}
+}
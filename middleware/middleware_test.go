@@ -3,6 +3,8 @@ package middleware
 import (
 	"context"
 	"mini-rpc/message"
+	"mini-rpc/status"
+	"strings"
 	"testing"
 	"time"
 )
@@ -60,6 +62,9 @@ func TestTimeoutExceeded(t *testing.T) {
 	if resp.Error != "request timed out" {
 		t.Fatalf("expect timeout error, got '%s'", resp.Error)
 	}
+	if resp.Code != status.DeadlineExceeded {
+		t.Fatalf("expect code DeadlineExceeded, got %s", resp.Code)
+	}
 }
 
 func TestRateLimit(t *testing.T) {
@@ -80,6 +85,9 @@ func TestRateLimit(t *testing.T) {
 	if resp.Error != "rate limit exceeded" {
 		t.Fatalf("request 3 should be rate limited, got: '%s'", resp.Error)
 	}
+	if resp.Code != status.ResourceExhausted {
+		t.Fatalf("expect code ResourceExhausted, got %s", resp.Code)
+	}
 }
 
 func TestChain(t *testing.T) {
@@ -97,3 +105,88 @@ func TestChain(t *testing.T) {
 		t.Fatalf("expect no error, got '%s'", resp.Error)
 	}
 }
+
+func TestRetryByStatusCode(t *testing.T) {
+	// 前 2 次返回 Unavailable（可重试），第 3 次成功
+	attempts := 0
+	flaky := func(ctx context.Context, req *message.RPCMessage) *message.RPCMessage {
+		attempts++
+		if attempts < 3 {
+			return message.NewErrorMessage(status.Error(status.Unavailable, "backend down"))
+		}
+		return echoHandler(ctx, req)
+	}
+	resp := RetryMiddleware(3, time.Millisecond)(flaky)(context.Background(), &message.RPCMessage{ServiceMethod: "Arith.Add"})
+	if resp.Status() != nil || attempts != 3 {
+		t.Fatalf("expect success after 3 attempts, got %v after %d", resp.Status(), attempts)
+	}
+
+	// NotFound 不可重试，只调用一次
+	attempts = 0
+	notFound := func(ctx context.Context, req *message.RPCMessage) *message.RPCMessage {
+		attempts++
+		return message.NewErrorMessage(status.Error(status.NotFound, "no such user"))
+	}
+	resp = RetryMiddleware(3, time.Millisecond)(notFound)(context.Background(), &message.RPCMessage{ServiceMethod: "Arith.Add"})
+	if resp.Code != status.NotFound || attempts != 1 {
+		t.Fatalf("expect NotFound without retry, got %s after %d attempts", resp.Code, attempts)
+	}
+}
+
+// 模拟一个会 panic 的 handler
+func panicHandler(ctx context.Context, req *message.RPCMessage) *message.RPCMessage {
+	var m map[string]int
+	m["boom"] = 1 // nil map 写入 → panic
+	return nil
+}
+
+func TestRecovery(t *testing.T) {
+	// 默认处理：记录堆栈，返回 Internal
+	handler := RecoveryMiddleware(nil)(panicHandler)
+	resp := handler(context.Background(), &message.RPCMessage{ServiceMethod: "Arith.Boom"})
+	if resp.Code != status.Internal {
+		t.Fatalf("expect code Internal, got %s (%s)", resp.Code, resp.Error)
+	}
+
+	// 自定义处理：拿到 panic 的值和堆栈
+	var stack []byte
+	handler = RecoveryMiddleware(func(ctx context.Context, req *message.RPCMessage, recovered any, s []byte) *message.RPCMessage {
+		stack = s
+		return message.NewErrorMessage(status.Errorf(status.Unavailable, "recovered: %v", recovered))
+	})(panicHandler)
+	resp = handler(context.Background(), &message.RPCMessage{ServiceMethod: "Arith.Boom"})
+	if resp.Code != status.Unavailable || !strings.Contains(resp.Error, "nil map") {
+		t.Fatalf("expect the custom response, got %s (%s)", resp.Code, resp.Error)
+	}
+	if !strings.Contains(string(stack), "panicHandler") {
+		t.Fatalf("expect the stack of the panic, got:\n%s", stack)
+	}
+}
+
+func TestRecoveryThroughTimeout(t *testing.T) {
+	// TimeOut 在另一个 goroutine 里跑 handler：panic 要被带回来，堆栈仍是 handler 的
+	var stack []byte
+	handler := Chain(
+		RecoveryMiddleware(func(ctx context.Context, req *message.RPCMessage, recovered any, s []byte) *message.RPCMessage {
+			stack = s
+			return message.NewErrorMessage(status.Errorf(status.Internal, "%v", recovered))
+		}),
+		TimeOutMiddleware(time.Second),
+	)(panicHandler)
+
+	resp := handler(context.Background(), &message.RPCMessage{ServiceMethod: "Arith.Boom"})
+	if resp.Code != status.Internal {
+		t.Fatalf("expect code Internal, got %s (%s)", resp.Code, resp.Error)
+	}
+	if !strings.Contains(string(stack), "panicHandler") {
+		t.Fatalf("expect the handler goroutine's stack, got:\n%s", stack)
+	}
+
+	// 正常返回的 handler 不受影响
+	handler = TimeOutMiddleware(time.Second)(echoHandler)
+	for i := 0; i < 100; i++ {
+		if resp := handler(context.Background(), &message.RPCMessage{}); string(resp.Payload) != "ok" {
+			t.Fatalf("expect payload 'ok', got '%s'", resp.Payload)
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"golang.org/x/time/rate"
 	"mini-rpc/message"
+	"mini-rpc/status"
 )
 
 // RateLimitMiddleware creates a rate limiter using the token bucket algorithm.
@@ -26,9 +27,7 @@ func RateLimitMiddleware(r float64, burst int) Middleware {
 		return func(ctx context.Context, req *message.RPCMessage) *message.RPCMessage {
 			if !limiter.Allow() {
 				// No tokens available — reject immediately (short-circuit, don't call next)
-				return &message.RPCMessage{
-					Error: "rate limit exceeded",
-				}
+				return message.NewErrorMessage(status.Error(status.ResourceExhausted, "rate limit exceeded"))
 			}
 			return next(ctx, req)
 		}
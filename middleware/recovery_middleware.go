@@ -0,0 +1,73 @@
+package middleware
+
+import (
+	"context"
+	"log"
+	"mini-rpc/message"
+	"mini-rpc/status"
+	"runtime/debug"
+)
+
+// PanicHandler turns a panic recovered by RecoveryMiddleware into the call's response.
+// recovered is the value passed to panic, stack the stack trace of the panicking goroutine.
+type PanicHandler func(ctx context.Context, req *message.RPCMessage, recovered any, stack []byte) *message.RPCMessage
+
+// RecoveryMiddleware recovers a panic anywhere below it in the chain (inner middleware or the
+// service method itself) and returns onPanic's response instead, so one buggy method fails
+// its own call rather than crashing the process with every other call on it.
+//
+// With a nil onPanic, the panic and its stack are logged and the caller gets an Internal status.
+//
+// The server always runs this as the outermost layer of its chain, logging to its own
+// logger (server.WithLogger), so registering it with Server.Use is only needed for custom
+// handling (metrics, alerts, a different status): a RecoveryMiddleware added with Use sees
+// the panic first.
+func RecoveryMiddleware(onPanic PanicHandler) Middleware {
+	if onPanic == nil {
+		onPanic = logPanic
+	}
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, req *message.RPCMessage) (resp *message.RPCMessage) {
+			defer func() {
+				r := recover()
+				if r == nil {
+					return
+				}
+				// A panic re-raised by TimeOutMiddleware carries the stack of the goroutine
+				// it happened in — far more useful than ours
+				stack := debug.Stack()
+				if fp, ok := r.(*forwardedPanic); ok {
+					r, stack = fp.value, fp.stack
+				}
+				resp = onPanic(ctx, req, r, stack)
+			}()
+			return next(ctx, req)
+		}
+	}
+}
+
+// logPanic is the default PanicHandler: log the panic with its stack, answer Internal.
+func logPanic(ctx context.Context, req *message.RPCMessage, recovered any, stack []byte) *message.RPCMessage {
+	log.Printf("panic in %s: %v\n%s", req.ServiceMethod, recovered, stack)
+	return message.NewErrorMessage(status.Errorf(status.Internal, "panic in %s: %v", req.ServiceMethod, recovered))
+}
+
+// forwardedPanic carries a panic from a middleware's helper goroutine to the goroutine that
+// runs the chain, where it is raised again for RecoveryMiddleware to catch. A panic can't
+// be recovered from another goroutine: left alone, it would crash the process.
+type forwardedPanic struct {
+	value any
+	stack []byte
+}
+
+// capturePanic recovers a panic in a helper goroutine and sends it on ch (buffered, cap 1).
+// It must be deferred directly by the goroutine's function.
+func capturePanic(ch chan<- *forwardedPanic) {
+	if r := recover(); r != nil {
+		if fp, ok := r.(*forwardedPanic); ok {
+			ch <- fp // Already forwarded by a nested TimeOutMiddleware
+			return
+		}
+		ch <- &forwardedPanic{value: r, stack: debug.Stack()}
+	}
+}
@@ -4,28 +4,39 @@ import (
 	"context"
 	"log"
 	"mini-rpc/message"
-	"strings"
+	"mini-rpc/status"
 	"time"
 )
 
+// RetryMiddleware retries a failed call with exponential backoff (baseDelay, 2×, 4×, ...).
+//
+// Only transient failures are retried, decided by status code rather than by matching
+// error strings: Unavailable (the dependency is down) and DeadlineExceeded (it was too slow).
+// Everything else — NotFound, InvalidArgument, handler business errors — fails immediately,
+// since retrying would only produce the same answer.
 func RetryMiddleware(maxRetries int, baseDelay time.Duration) Middleware {
 	return func(next HandlerFunc) HandlerFunc {
 		return func(ctx context.Context, req *message.RPCMessage) *message.RPCMessage {
 			rpcMessage := next(ctx, req)
 			for i := 0; i < maxRetries; i++ {
-				if rpcMessage.Error == "" {
+				st := rpcMessage.Status()
+				if st == nil {
 					return rpcMessage // Success, return response
 				}
-				if strings.Contains(rpcMessage.Error, "timeout") || strings.Contains(rpcMessage.Error, "connection refused") {
-					// Log the retry attempt
-					log.Printf("Retry attempt %d for %s due to error: %s", i+1, req.ServiceMethod, rpcMessage.Error)
-					time.Sleep(baseDelay * time.Duration(1<<i)) // Exponential backoff
-					rpcMessage = next(ctx, req)                 // Retry the request
-				} else {
+				if !isRetryable(st.Code) {
 					return rpcMessage // Non-retryable error, return immediately
 				}
+				// Log the retry attempt
+				log.Printf("Retry attempt %d for %s due to error: %s", i+1, req.ServiceMethod, st.Message)
+				time.Sleep(baseDelay * time.Duration(1<<i)) // Exponential backoff
+				rpcMessage = next(ctx, req)                 // Retry the request
 			}
 			return rpcMessage // Return last response after retries
 		}
 	}
 }
+
+// isRetryable reports whether a failure with the given code may succeed on retry.
+func isRetryable(code status.Code) bool {
+	return code == status.Unavailable || code == status.DeadlineExceeded
+}
@@ -1,8 +1,11 @@
 package middleware
 
 import (
+	"bytes"
 	"context"
+	"log"
 	"mini-rpc/message"
+	"mini-rpc/status"
 	"time"
 )
 
@@ -14,6 +17,9 @@ import (
 //  2. Run the next handler in a goroutine, sending its result to a channel
 //  3. Select between the result channel and ctx.Done()
 //
+// A panic in the handler goroutine is handed back and raised again in the caller's goroutine,
+// so RecoveryMiddleware and the server's own recovery still apply.
+//
 // Note: the handler goroutine is NOT cancelled — it continues running in the background.
 // The timeout only controls when the caller gives up waiting. For true cancellation,
 // the handler must check ctx.Done() internally.
@@ -23,19 +29,35 @@ func TimeOutMiddleware(timeout time.Duration) Middleware {
 			ctx, cancel := context.WithTimeout(ctx, timeout)
 			defer cancel()
 
-			// Run handler in a goroutine so we can race it against the timeout
+			// Run handler in a goroutine so we can race it against the timeout.
+			// It may outlive this call, and the server recycles the frame body (which req's
+			// payload can point into) as soon as we return — so it gets its own copy.
+			own := *req
+			own.Payload = bytes.Clone(req.Payload)
 			done := make(chan *message.RPCMessage, 1) // Buffered: prevent goroutine leak if timeout fires
+			panicked := make(chan *forwardedPanic, 1) // Closed when the handler goroutine exits
 			go func() {
-				done <- next(ctx, req)
+				defer close(panicked)
+				defer capturePanic(panicked) // A panic can only be recovered in its own goroutine
+				done <- next(ctx, &own)
 			}()
 
 			select {
 			case rpcMessage := <-done:
 				return rpcMessage // Handler completed before timeout
-			case <-ctx.Done():
-				return &message.RPCMessage{
-					Error: "request timed out",
+			case fp := <-panicked:
+				if fp == nil {
+					return <-done // Closed without a panic: the result is already in done
 				}
+				panic(fp) // Raise it again here, where RecoveryMiddleware (or the server) catches it
+			case <-ctx.Done():
+				// Nobody will re-raise a panic that happens from now on: log it instead
+				go func() {
+					if fp := <-panicked; fp != nil {
+						log.Printf("panic in %s after it timed out: %v\n%s", req.ServiceMethod, fp.value, fp.stack)
+					}
+				}()
+				return message.NewErrorMessage(status.Error(status.DeadlineExceeded, "request timed out"))
 			}
 		}
 	}
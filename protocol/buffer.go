@@ -0,0 +1,70 @@
+package protocol
+
+import (
+	"math/bits"
+	"sync"
+	"unsafe"
+)
+
+// Body buffer pool.
+//
+// Every decoded frame needs a body buffer, and at high QPS allocating one per frame makes
+// the garbage collector the bottleneck. Bodies are therefore taken from size-classed pools
+// (powers of two, 512 B up to DefaultMaxBodySize; smaller bodies share the 512 B class),
+// and can be handed back with ReleaseBody:
+//
+//	header, body, err := protocol.Decode(conn) // body comes from the pool
+//	...                                          // decode it, run the handler
+//	protocol.ReleaseBody(body)                   // recycled for a later frame
+//
+// Releasing is optional — a body that is never released is simply garbage collected — but
+// once released, a body (and anything aliasing it, such as a BinaryCodec payload) must not
+// be used again.
+
+const (
+	minPooledShift = 9  // 512 B: the smallest class, most RPC bodies fit in it
+	maxPooledShift = 22 // 4 MiB = DefaultMaxBodySize: larger bodies are rare, not worth keeping
+)
+
+// bodyPools[i] holds buffers with a capacity of exactly 1<<(minPooledShift+i) bytes, stored
+// as a pointer to their first byte. Storing a pointer (rather than a *[]byte) is what keeps
+// ReleaseBody allocation-free: a pointer fits in an interface without a heap-allocated box.
+var bodyPools [maxPooledShift - minPooledShift + 1]sync.Pool
+
+// getBody returns a buffer of length n, from the pool when n is in the pooled range.
+func getBody(n int) []byte {
+	i, ok := poolIndex(n)
+	if !ok {
+		return make([]byte, n)
+	}
+	size := 1 << (minPooledShift + i)
+	if p, _ := bodyPools[i].Get().(unsafe.Pointer); p != nil {
+		return unsafe.Slice((*byte)(p), size)[:n]
+	}
+	return make([]byte, n, size)
+}
+
+// ReleaseBody returns a body obtained from Decode to the pool. Bodies that did not come from
+// the pool (e.g., too large to be pooled) are ignored, so releasing any decoded body is
+// safe — but the caller must not touch it, or anything aliasing it, afterwards.
+func ReleaseBody(body []byte) {
+	c := cap(body)
+	i, ok := poolIndex(c)
+	if !ok || c != 1<<(minPooledShift+i) {
+		return // Not one of ours (sliced, or allocated outside the size classes)
+	}
+	bodyPools[i].Put(unsafe.Pointer(unsafe.SliceData(body)))
+}
+
+// poolIndex returns the size class for an n-byte body: the smallest power of two ≥ n,
+// and at least 1<<minPooledShift.
+func poolIndex(n int) (int, bool) {
+	if n <= 0 {
+		return 0, false
+	}
+	shift := max(bits.Len(uint(n-1)), minPooledShift)
+	if shift > maxPooledShift {
+		return 0, false
+	}
+	return shift - minPooledShift, true
+}
@@ -0,0 +1,106 @@
+package protocol
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// DefaultStreamWindow is the number of stream data frames a sender may have in flight
+// before it must wait for the receiver's credits (MsgTypeStreamAck).
+//
+// Both sides start from this value implicitly, so opening a stream needs no extra round trip.
+// The receiver acks after consuming half the window, which keeps the pipe full without
+// sending one ack per message.
+const DefaultStreamWindow = 32
+
+// ErrWindowClosed is returned by Window.Acquire once the stream has ended.
+var ErrWindowClosed = errors.New("stream window closed")
+
+// Window is a credit-based flow-control window for one direction of a stream.
+//
+// Why credits? A single TCP connection is shared by many streams. Without flow control,
+// a fast server could flood one slow stream's receive buffer on the client, and the
+// client would have to either block recvLoop (stalling every other call on the connection)
+// or buffer unboundedly. With credits, the sender blocks on its own stream instead.
+//
+//	sender:   Acquire() before each data frame — blocks when credits reach 0
+//	receiver: after consuming N frames, sends MsgTypeStreamAck(N) → sender calls Grant(N)
+type Window struct {
+	mu      sync.Mutex
+	credits int
+	closed  bool
+	notify  chan struct{} // Capacity 1: "credits may have changed", coalesces multiple Grants
+}
+
+// NewWindow creates a window with the given initial credits.
+func NewWindow(credits int) *Window {
+	return &Window{credits: credits, notify: make(chan struct{}, 1)}
+}
+
+// Acquire takes one credit, blocking until one is available, ctx is done, or the window is closed.
+func (w *Window) Acquire(ctx context.Context) error {
+	for {
+		w.mu.Lock()
+		if w.closed {
+			w.mu.Unlock()
+			return ErrWindowClosed
+		}
+		if w.credits > 0 {
+			w.credits--
+			remaining := w.credits
+			w.mu.Unlock()
+			if remaining > 0 {
+				w.signal() // Pass the wake-up on to any other waiter
+			}
+			return nil
+		}
+		w.mu.Unlock()
+
+		select {
+		case <-w.notify:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Grant adds n credits, waking up a blocked Acquire.
+func (w *Window) Grant(n int) {
+	w.mu.Lock()
+	w.credits += n
+	w.mu.Unlock()
+	w.signal()
+}
+
+// Close fails all current and future Acquire calls with ErrWindowClosed.
+func (w *Window) Close() {
+	w.mu.Lock()
+	w.closed = true
+	w.mu.Unlock()
+	w.signal()
+}
+
+func (w *Window) signal() {
+	select {
+	case w.notify <- struct{}{}:
+	default: // A wake-up is already pending
+	}
+}
+
+// EncodeCredits builds the body of a MsgTypeStreamAck frame.
+func EncodeCredits(n uint32) []byte {
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, n)
+	return buf
+}
+
+// DecodeCredits parses the body of a MsgTypeStreamAck frame.
+func DecodeCredits(body []byte) (uint32, error) {
+	if len(body) != 4 {
+		return 0, fmt.Errorf("invalid stream ack body length: %d", len(body))
+	}
+	return binary.BigEndian.Uint32(body), nil
+}
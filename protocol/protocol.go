@@ -1,22 +1,40 @@
 // Package protocol implements the custom binary frame protocol for mini-RPC.
 //
-// It solves TCP's sticky packet problem by using a fixed-size 14-byte header
-// followed by a variable-length body. The receiver reads the header first to
-// determine the body length, then reads exactly that many bytes.
+// It solves TCP's sticky packet problem by using a fixed-size header followed by a
+// variable-length body. The receiver reads the header first to determine the body length,
+// then reads exactly that many bytes.
 //
-// Frame format:
+// Frame format, v1:
 //
 //	0      3  4  5  6         10        14
 //	┌──────┬──┬──┬──┬─────────┬─────────┬───────────────┐
 //	│magic │v │ct│mt│   seq   │ bodyLen │    body ...   │
 //	│ mrp  │01│  │  │ uint32  │ uint32  │ bodyLen bytes │
 //	└──────┴──┴──┴──┴─────────┴─────────┴───────────────┘
+//
+// This is the baseline format, unchanged: v1 frames are what peers that predate v2 read,
+// so they carry no compression (see Encode).
+//
+// Frame format, v2 — the same first 14 bytes, then flags, compressor and an extension area:
+//
+//	0      3  4  5  6         10        14 15 16    18
+//	┌──────┬──┬──┬──┬─────────┬─────────┬──┬──┬─────┬───────────┬───────────────┐
+//	│magic │v │ct│mt│   seq   │ bodyLen │fl│cp│extLn│  ext ...  │    body ...   │
+//	│ mrp  │02│  │  │ uint32  │ uint32  │  │  │ u16 │extLn bytes│ bodyLen bytes │
+//	└──────┴──┴──┴──┴─────────┴─────────┴──┴──┴─────┴───────────┴───────────────┘
+//
+// Decode accepts both; which one a connection uses is negotiated by its first frame
+// (see version.go), so v1 and v2 peers interoperate during a rolling upgrade.
 package protocol
 
 import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"mini-rpc/internal/codectype"
+	"net"
+	"sync"
+	"sync/atomic"
 )
 
 // Magic number bytes: "mrp" (mini-rpc protocol).
@@ -26,109 +44,320 @@ const (
 	MagicNumber byte = 0x6d // 'm'
 	MagicByte2  byte = 0x72 // 'r'
 	MagicByte3  byte = 0x70 // 'p'
-	Version     byte = 0x01
-	HeaderSize  int  = 14 // 3 (magic) + 1 (version) + 1 (codec) + 1 (msgType) + 4 (seq) + 4 (bodyLen)
+	Version     byte = 0x01 // v1: the original 14-byte header
+	Version2    byte = 0x02 // v2: v1 + flags, compressor and extension area
+
+	HeaderSize   int = 14 // 3 (magic) + 1 (version) + 1 (codec) + 1 (msgType) + 4 (seq) + 4 (bodyLen)
+	HeaderSizeV2 int = 18 // HeaderSize + 1 (flags) + 1 (compressor) + 2 (extLen); extension bytes follow
 )
 
-// MsgType distinguishes request, response, and heartbeat frames.
+// MsgType distinguishes request, response, heartbeat, and stream frames.
 type MsgType byte
 
 const (
 	MsgTypeRequest   MsgType = 0 // Client → Server RPC request
 	MsgTypeResponse  MsgType = 1 // Server → Client RPC response
 	MsgTypeHeartbeat MsgType = 2 // KeepAlive probe (no body)
+
+	// Stream frames share the Seq of the StreamOpen frame — the sequence ID doubles as stream ID.
+	// Data, end and ack frames flow in both directions; each side's end frame closes only
+	// its own direction (half-close), the server's also carries the final status.
+	MsgTypeStreamOpen   MsgType = 3 // Client → Server: open a stream, body = request RPCMessage (with args)
+	MsgTypeStreamData   MsgType = 4 // Either way: one stream element, body = RPCMessage with Payload
+	MsgTypeStreamEnd    MsgType = 5 // Either way: no more data; from the server, body = RPCMessage with the final status
+	MsgTypeStreamAck    MsgType = 6 // Either way: flow-control credit grant, body = 4-byte count
+	MsgTypeStreamCancel MsgType = 7 // Client → Server: abandon the stream, cancels the handler (no body)
 )
 
+// maxMsgType is the highest valid MsgType, used by Decode for validation.
+const maxMsgType = MsgTypeStreamCancel
+
 // Codec type constants, mirrored from codec package to avoid circular import.
 const (
-	CodecTypeJSON   byte = 0
-	CodecTypeBinary byte = 1
+	CodecTypeJSON     byte = 0
+	CodecTypeBinary   byte = 1
+	CodecTypeProtobuf byte = 2
+	CodecTypeMsgpack  byte = 3
+	CodecTypeGob      byte = 4
 )
 
-// Header represents the fixed 14-byte frame header.
-// It carries metadata needed to decode the following body correctly.
+// The codec types Decode accepts. The built-in types are known up front; custom ones are
+// added by codec.Register only (see package internal/codectype), so every accepted frame
+// has a codec to decode it.
+func init() {
+	for _, t := range []byte{CodecTypeJSON, CodecTypeBinary, CodecTypeProtobuf, CodecTypeMsgpack, CodecTypeGob} {
+		codectype.Add(t)
+	}
+}
+
+// IsCodecTypeRegistered reports whether Decode accepts frames with the given codec type.
+func IsCodecTypeRegistered(codecType byte) bool {
+	return codectype.Registered(codecType)
+}
+
+// Compressor type constants, mirrored from compressor package to avoid circular import.
+const (
+	CompressorNone    byte = 0
+	CompressorGzip    byte = 1
+	CompressorDeflate byte = 2
+)
+
+// maxCompressor is the highest compressor type the 4-bit header field can carry.
+const maxCompressor = 0x0f
+
+// compressorTypes records which compressor types Decode accepts, indexed by compressor type;
+// compressor.Register adds custom ones through RegisterCompressorType.
+var compressorTypes [maxCompressor + 1]atomic.Bool
+
+func init() {
+	for _, t := range []byte{CompressorNone, CompressorGzip, CompressorDeflate} {
+		compressorTypes[t].Store(true)
+	}
+}
+
+// RegisterCompressorType makes Decode accept frames compressed with the given type.
+// It is called by compressor.Register; registering a type twice is harmless.
+func RegisterCompressorType(compressorType byte) {
+	compressorTypes[compressorType&maxCompressor].Store(true)
+}
+
+// IsCompressorTypeRegistered reports whether Decode accepts frames compressed with the given type.
+func IsCompressorTypeRegistered(compressorType byte) bool {
+	return compressorType <= maxCompressor && compressorTypes[compressorType].Load()
+}
+
+// Header represents a frame header: the fixed 14-byte v1 header, or the v2 header with
+// flags and an extension area. It carries metadata needed to decode the following body correctly.
 type Header struct {
-	CodecType byte    // Serialization format: 0=JSON, 1=Binary
-	MsgType   MsgType // Request, Response, or Heartbeat
-	Seq       uint32  // Sequence ID — the key to multiplexing (matches request ↔ response)
-	BodyLen   uint32  // Body length in bytes — solves TCP sticky packet problem
+	Version    byte    // Frame format: Version or Version2 (0 encodes as Version)
+	CodecType  byte    // Serialization format: 0=JSON, 1=Binary, 2=Protobuf, 3=Msgpack, 4=Gob, or a custom codec
+	MsgType    MsgType // Request, Response, Heartbeat, or one of the stream frame types
+	Flags      Flags   // FlagCompressed, FlagOneWay, FlagStreamEnd, FlagError (see version.go)
+	Compressor byte    // Compressor negotiated for the call: 0=none, 1=Gzip, 2=Deflate
+	Seq        uint32  // Sequence ID — the key to multiplexing (matches request ↔ response)
+	BodyLen    uint32  // Body length in bytes — solves TCP sticky packet problem
+	Ext        []byte  // v2 extension area (see EncodeExt); not sent in v1 frames
 }
 
-// Encode writes a complete frame (header + body) to w.
+// check reports a header that can't be encoded in its frame format: an extension area
+// over MaxExtLen, or a compressed body in a v1 frame (a v1 peer would read it as is).
+func (h *Header) check() error {
+	if h.Version != Version2 {
+		if h.Flags&FlagCompressed != 0 {
+			return fmt.Errorf("frame %d: compressed bodies need a v2 frame", h.Seq)
+		}
+		return nil
+	}
+	if len(h.Ext) > MaxExtLen {
+		return fmt.Errorf("extension area too large: %d bytes", len(h.Ext))
+	}
+	return nil
+}
+
+// frameBuf is the scratch space of one Encode or Decode call, pooled so the frame path
+// allocates nothing: room for the largest fixed header (v2), and the vector handed to
+// net.Buffers.
+type frameBuf struct {
+	header [HeaderSizeV2]byte
+	vec    [3][]byte
+	bufs   net.Buffers
+}
+
+var frameBufs = sync.Pool{New: func() any { return new(frameBuf) }}
+
+// Encode writes a complete frame (header + body) to w, in the format given by h.Version.
 // The caller must hold a write lock if multiple goroutines share the same writer,
-// otherwise frames from different requests will interleave and corrupt the stream.
+// otherwise frames from different requests will interleave and corrupt the stream
+// (or use a FrameWriter, which serializes and batches the writes of a connection).
+//
+// The header, extension area and body go out in a single vectored write (net.Buffers →
+// writev on a TCP connection): one syscall per frame instead of two, and no copy of the body.
+//
+// A v1 frame is exactly what a baseline peer expects: it has no flags byte and no
+// compressor, so flags and Compressor are dropped — which is why flags may only ever be
+// hints a v1 peer can live without. A compressed body can't be sent in one (see check).
 func Encode(w io.Writer, h *Header, body []byte) error {
-	buf := make([]byte, HeaderSize)
+	if err := h.check(); err != nil {
+		return err
+	}
+	fb := frameBufs.Get().(*frameBuf)
+	defer frameBufs.Put(fb)
+
+	// Step 1: Fill in the header
+	header := fb.putHeader(h)
+
+	// Step 2: One vectored write — header, extension area (v2), body (may be nil for heartbeats)
+	fb.bufs = append(fb.vec[:0], header)
+	if h.Version == Version2 && len(h.Ext) > 0 {
+		fb.bufs = append(fb.bufs, h.Ext)
+	}
+	if len(body) > 0 {
+		fb.bufs = append(fb.bufs, body)
+	}
+	_, err := fb.bufs.WriteTo(w)
+	fb.vec = [3][]byte{} // Don't let the pool keep the caller's body alive
+	return err
+}
+
+// putHeader writes h into fb.header and returns the bytes to send.
+func (fb *frameBuf) putHeader(h *Header) []byte {
+	buf := fb.header[:]
 
 	// Magic number: 3 bytes — protocol identification
-	copy(buf[0:3], []byte{MagicNumber, MagicByte2, MagicByte3})
-	// Version: 1 byte — for future protocol upgrades
-	buf[3] = Version
+	buf[0], buf[1], buf[2] = MagicNumber, MagicByte2, MagicByte3
 	// Codec type: 1 byte
 	buf[4] = h.CodecType
-	// Message type: 1 byte
-	buf[5] = byte(h.MsgType)
 	// Sequence number: 4 bytes, big-endian (network byte order)
 	binary.BigEndian.PutUint32(buf[6:10], h.Seq)
+
+	if h.Version == Version2 {
+		buf[3] = Version2
+		buf[5] = byte(h.MsgType)
+		binary.BigEndian.PutUint32(buf[10:14], h.BodyLen)
+		// v2 fields: flags (1), compressor (1), extension length (2); extension bytes follow
+		buf[14] = byte(h.Flags)
+		buf[15] = h.Compressor
+		binary.BigEndian.PutUint16(buf[16:18], uint16(len(h.Ext)))
+		return buf[:HeaderSizeV2]
+	}
+
+	// Version: 1 byte — for future protocol upgrades
+	buf[3] = Version
+	// Message type: 1 byte
+	buf[5] = byte(h.MsgType)
 	// Body length: 4 bytes, big-endian
 	binary.BigEndian.PutUint32(buf[10:14], h.BodyLen)
+	return buf[:HeaderSize]
+}
 
-	// Write header
-	if _, err := w.Write(buf); err != nil {
-		return err
-	}
-	// Write body (may be nil for heartbeat frames)
-	if _, err := w.Write(body); err != nil {
-		return err
+// DefaultMaxBodySize is the largest frame body Decode accepts (4 MiB). Server and
+// ClientTransport use it for both directions unless configured otherwise.
+const DefaultMaxBodySize = 4 << 20
+
+// FrameTooLargeError is returned by DecodeWithLimit for a frame whose body exceeds the limit.
+// Neither the extension area nor the body has been read, so the connection can't be used for
+// further frames; Header (parsed but for Ext) tells the receiver which request or stream to
+// fail before closing it.
+type FrameTooLargeError struct {
+	Header *Header
+	Limit  uint32
+}
+
+func (e *FrameTooLargeError) Error() string {
+	return fmt.Sprintf("frame %d too large: %d bytes exceeds the %d-byte limit", e.Header.Seq, e.Header.BodyLen, e.Limit)
+}
+
+// Decode reads a complete frame (header + body) from r, rejecting bodies larger than
+// DefaultMaxBodySize. See DecodeInto.
+func Decode(r io.Reader) (*Header, []byte, error) {
+	return DecodeWithLimit(r, DefaultMaxBodySize)
+}
+
+// DecodeWithLimit reads a complete frame (header + body) from r, rejecting bodies larger
+// than maxBodySize. See DecodeInto.
+func DecodeWithLimit(r io.Reader, maxBodySize uint32) (*Header, []byte, error) {
+	h := new(Header)
+	body, err := DecodeInto(r, h, maxBodySize)
+	if err != nil {
+		return nil, nil, err
 	}
-	return nil
+	return h, body, nil
 }
 
-// Decode reads a complete frame (header + body) from r.
-// It validates the magic number, version, codec type, and message type.
+// DecodeInto reads a complete frame from r into a caller-provided header (so a read loop
+// can reuse one) and returns the body. It accepts either format: the first 14 bytes are
+// laid out the same way, and the version byte says whether v2 fields follow.
+// It validates the magic number, version, codec type, message type, and compressor type.
 // Uses io.ReadFull to guarantee exactly N bytes are read, preventing partial reads.
-func Decode(r io.Reader) (*Header, []byte, error) {
+//
+// The body length comes off the wire, so it is checked against maxBodySize before anything
+// is allocated: otherwise any peer (or a port scanner) could make us allocate 4 GiB with a
+// 14-byte header. An oversized frame yields a *FrameTooLargeError.
+//
+// The body comes from the buffer pool; once done with it, callers may hand it back with
+// ReleaseBody (see buffer.go). So does a v2 frame's extension area, h.Ext — TakeExt decodes
+// it and hands it back in one go. On error, h.Ext is always nil: there is nothing to release.
+//
+// The header looks the same for both versions: a v1 frame just has no flags (except
+// FlagStreamEnd, implied by its message type), no compressor and no extension area.
+func DecodeInto(r io.Reader, h *Header, maxBodySize uint32) ([]byte, error) {
+	fb := frameBufs.Get().(*frameBuf)
+	defer frameBufs.Put(fb)
+	headerBuf := fb.header[:]
+
 	// Step 1: Read the fixed 14-byte header
-	headerBuf := make([]byte, HeaderSize)
-	if _, err := io.ReadFull(r, headerBuf); err != nil {
-		return nil, nil, err
+	if _, err := io.ReadFull(r, headerBuf[:HeaderSize]); err != nil {
+		return nil, err
 	}
 
 	// Step 2: Validate magic number — reject non-protocol connections
 	if headerBuf[0] != MagicNumber || headerBuf[1] != MagicByte2 || headerBuf[2] != MagicByte3 {
-		return nil, nil, fmt.Errorf("invalid magic number: %x", headerBuf[0:3])
+		return nil, fmt.Errorf("invalid magic number: %x", headerBuf[0:3])
 	}
 
 	// Step 3: Validate version
-	if headerBuf[3] != Version {
-		return nil, nil, fmt.Errorf("unsupported version: %d", headerBuf[3])
+	version := headerBuf[3]
+	if version != Version && version != Version2 {
+		return nil, fmt.Errorf("unsupported version: %d", version)
 	}
 
-	// Step 4: Validate codec type
-	if headerBuf[4] != CodecTypeJSON && headerBuf[4] != CodecTypeBinary {
-		return nil, nil, fmt.Errorf("unsupported codec type: %d", headerBuf[4])
+	// Step 4: Validate codec type against the registry (built-ins + codec.Register)
+	if !IsCodecTypeRegistered(headerBuf[4]) {
+		return nil, fmt.Errorf("unsupported codec type: %d", headerBuf[4])
 	}
 
-	// Step 5: Validate message type
+	// Step 5: Read the rest of the v2 header; the extension area is read last (Step 10)
+	*h = Header{Version: version, CodecType: headerBuf[4]}
 	msgType := headerBuf[5]
-	if msgType != byte(MsgTypeRequest) && msgType != byte(MsgTypeResponse) && msgType != byte(MsgTypeHeartbeat) {
-		return nil, nil, fmt.Errorf("unsupported message type: %d", msgType)
+	var extLen uint16
+	if version == Version2 {
+		if _, err := io.ReadFull(r, headerBuf[HeaderSize:HeaderSizeV2]); err != nil {
+			return nil, err
+		}
+		h.Flags = Flags(headerBuf[14])
+		h.Compressor = headerBuf[15]
+		extLen = binary.BigEndian.Uint16(headerBuf[16:18])
 	}
 
-	// Step 6: Parse sequence number and body length
-	seq := binary.BigEndian.Uint32(headerBuf[6:10])
-	bodyLen := binary.BigEndian.Uint32(headerBuf[10:14])
+	// Step 6: Validate message type and compressor
+	if msgType > byte(maxMsgType) {
+		return nil, fmt.Errorf("unsupported message type: %d", msgType)
+	}
+	h.MsgType = MsgType(msgType)
+	if !IsCompressorTypeRegistered(h.Compressor) {
+		return nil, fmt.Errorf("unsupported compressor type: %d", h.Compressor)
+	}
 
-	// Step 7: Read exactly bodyLen bytes — this is how we solve TCP sticky packet
-	body := make([]byte, bodyLen)
-	if _, err := io.ReadFull(r, body); err != nil {
-		return nil, nil, err
+	// Step 7: Parse sequence number and body length
+	h.Seq = binary.BigEndian.Uint32(headerBuf[6:10])
+	h.BodyLen = binary.BigEndian.Uint32(headerBuf[10:14])
+
+	// Step 8: The only v1 flag that can be recovered from the frame itself
+	if version == Version && h.MsgType == MsgTypeStreamEnd {
+		h.Flags |= FlagStreamEnd
 	}
 
-	return &Header{
-		CodecType: headerBuf[4],
-		MsgType:   MsgType(msgType),
-		Seq:       seq,
-		BodyLen:   bodyLen,
-	}, body, nil
+	// Step 9: Enforce the size limit before reading anything more
+	if h.BodyLen > maxBodySize {
+		return nil, &FrameTooLargeError{Header: h, Limit: maxBodySize}
+	}
+
+	// Step 10: Read the extension area, then exactly bodyLen bytes — this is how we solve TCP sticky packet.
+	// Nothing can fail past this point but the reads, so h.Ext only escapes with a complete frame.
+	if extLen > 0 {
+		h.Ext = getBody(int(extLen))
+		if _, err := io.ReadFull(r, h.Ext); err != nil {
+			ReleaseBody(h.Ext)
+			h.Ext = nil
+			return nil, err
+		}
+	}
+	body := getBody(int(h.BodyLen))
+	if _, err := io.ReadFull(r, body); err != nil {
+		ReleaseBody(body)
+		ReleaseBody(h.Ext)
+		h.Ext = nil
+		return nil, err
+	}
+	return body, nil
 }
@@ -1,18 +1,23 @@
 package protocol
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync"
 	"testing"
-	"bytes"	
+	"time"
 )
 
-
 func TestEncodeDecode(t *testing.T) {
 	// Prepare header and body
 	header := Header{
 		CodecType: CodecTypeJSON,
 		MsgType:   MsgTypeRequest,
 		Seq:       12345,
-		BodyLen: 11,
+		BodyLen:   11,
 	}
 	body := []byte("hello world")
 
@@ -76,7 +81,7 @@ func TestDecodeEmptyBody(t *testing.T) {
 		CodecType: CodecTypeJSON,
 		MsgType:   MsgTypeHeartbeat,
 		Seq:       12345,
-		BodyLen: 0,
+		BodyLen:   0,
 	}
 	var buf bytes.Buffer
 	if err := Encode(&buf, &header, []byte{}); err != nil {
@@ -102,62 +107,454 @@ func TestDecodeEmptyBody(t *testing.T) {
 }
 
 func TestDecodeInvalidVersion(t *testing.T) {
-    var buf bytes.Buffer
-    
-    // 手动构造错误 Version 的帧
-    invalidFrame := []byte{
-        MagicNumber, MagicByte2, MagicByte3, // 正确的 Magic
-        0xFF,        // 错误的 Version
-        CodecTypeJSON,
-        byte(MsgTypeRequest),
-        0, 0, 0, 1,  // Seq
-        0, 0, 0, 0,  // BodyLen
-    }
-    buf.Write(invalidFrame)
-    
-    _, _, err := Decode(&buf)
-    if err == nil {
-        t.Fatal("期待返回错误，但 Decode 成功了")
-    }
-    
-    if !bytes.Contains([]byte(err.Error()), []byte("unsupported version")) {
-        t.Errorf("错误信息应该包含 'unsupported version', 实际: %v", err)
-    }
-    
-    t.Logf("✅ 正确识别了错误的 Version: %v", err)
+	var buf bytes.Buffer
+
+	// 手动构造错误 Version 的帧
+	invalidFrame := []byte{
+		MagicNumber, MagicByte2, MagicByte3, // 正确的 Magic
+		0xFF, // 错误的 Version
+		CodecTypeJSON,
+		byte(MsgTypeRequest),
+		0, 0, 0, 1, // Seq
+		0, 0, 0, 0, // BodyLen
+	}
+	buf.Write(invalidFrame)
+
+	_, _, err := Decode(&buf)
+	if err == nil {
+		t.Fatal("期待返回错误，但 Decode 成功了")
+	}
+
+	if !bytes.Contains([]byte(err.Error()), []byte("unsupported version")) {
+		t.Errorf("错误信息应该包含 'unsupported version', 实际: %v", err)
+	}
+
+	t.Logf("✅ 正确识别了错误的 Version: %v", err)
 }
 
 func TestDecodeLargeBody(t *testing.T) {
-    var buf bytes.Buffer
-    
-    // 1MB 的消息体
-    largeBody := make([]byte, 1024*1024)
-    for i := range largeBody {
-        largeBody[i] = byte(i % 256)
-    }
-    
-    header := &Header{
-        CodecType: CodecTypeBinary,
-        MsgType:   MsgTypeRequest,
-        Seq:       999,
-        BodyLen:   uint32(len(largeBody)),
-    }
-    
-    // 编码
-    if err := Encode(&buf, header, largeBody); err != nil {
-        t.Fatalf("Encode 失败: %v", err)
-    }
-    
-    // 解码
-    _, decodedBody, err := Decode(&buf)
-    if err != nil {
-        t.Fatalf("Decode 失败: %v", err)
-    }
-    
-    // 验证
-    if !bytes.Equal(decodedBody, largeBody) {
-        t.Errorf("大消息体内容不匹配")
-    }
-    
-    t.Logf("✅ 成功编解码 %d 字节的大消息体", len(largeBody))
-}
\ No newline at end of file
+	var buf bytes.Buffer
+
+	// 1MB 的消息体
+	largeBody := make([]byte, 1024*1024)
+	for i := range largeBody {
+		largeBody[i] = byte(i % 256)
+	}
+
+	header := &Header{
+		CodecType: CodecTypeBinary,
+		MsgType:   MsgTypeRequest,
+		Seq:       999,
+		BodyLen:   uint32(len(largeBody)),
+	}
+
+	// 编码
+	if err := Encode(&buf, header, largeBody); err != nil {
+		t.Fatalf("Encode 失败: %v", err)
+	}
+
+	// 解码
+	_, decodedBody, err := Decode(&buf)
+	if err != nil {
+		t.Fatalf("Decode 失败: %v", err)
+	}
+
+	// 验证
+	if !bytes.Equal(decodedBody, largeBody) {
+		t.Errorf("大消息体内容不匹配")
+	}
+
+	t.Logf("✅ 成功编解码 %d 字节的大消息体", len(largeBody))
+}
+func TestWindow(t *testing.T) {
+	w := NewWindow(2)
+	ctx := context.Background()
+
+	// Initial credits are consumed without blocking
+	if err := w.Acquire(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Acquire(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Out of credits: Acquire blocks until ctx expires
+	timeoutCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if err := w.Acquire(timeoutCtx); err != context.DeadlineExceeded {
+		t.Fatalf("Expect DeadlineExceeded, got %v", err)
+	}
+
+	// Grant wakes up a blocked Acquire
+	done := make(chan error, 1)
+	go func() { done <- w.Acquire(ctx) }()
+	time.Sleep(20 * time.Millisecond)
+	w.Grant(1)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// Close fails a blocked Acquire
+	go func() { done <- w.Acquire(ctx) }()
+	time.Sleep(20 * time.Millisecond)
+	w.Close()
+	if err := <-done; err != ErrWindowClosed {
+		t.Fatalf("Expect ErrWindowClosed, got %v", err)
+	}
+}
+
+func TestCredits(t *testing.T) {
+	n, err := DecodeCredits(EncodeCredits(16))
+	if err != nil || n != 16 {
+		t.Fatalf("Expect 16, got %d (%v)", n, err)
+	}
+	if _, err := DecodeCredits([]byte{1, 2}); err == nil {
+		t.Fatalf("Expect error for a short ack body")
+	}
+}
+
+func TestCompressorHeader(t *testing.T) {
+	var buf bytes.Buffer
+	h := &Header{Version: Version2, CodecType: CodecTypeJSON, MsgType: MsgTypeStreamData, Compressor: CompressorDeflate, Seq: 9, BodyLen: 2}
+	if err := Encode(&buf, h, []byte{1, 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The compressor has a byte of its own, the mt byte is left alone
+	if got := buf.Bytes(); got[5] != byte(MsgTypeStreamData) || got[15] != CompressorDeflate {
+		t.Fatalf("Expect mt 0x04 and compressor 0x02, got %#x and %#x", got[5], got[15])
+	}
+	got, _, err := Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.MsgType != MsgTypeStreamData || got.Compressor != CompressorDeflate {
+		t.Fatalf("Expect StreamData/Deflate, got %d/%d", got.MsgType, got.Compressor)
+	}
+
+	// Unregistered compressor types are rejected
+	h.Compressor = 11
+	if err := Encode(&buf, h, []byte{1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := Decode(&buf); err == nil {
+		t.Fatal("Expect error for an unregistered compressor type")
+	}
+
+	// v1 frames predate compression: a baseline peer reads the high nibble as a bad message type
+	buf.Reset()
+	buf.Write([]byte{MagicNumber, MagicByte2, MagicByte3, Version, CodecTypeJSON, CompressorGzip<<4 | byte(MsgTypeRequest), 0, 0, 0, 1, 0, 0, 0, 0})
+	if _, _, err := Decode(&buf); err == nil {
+		t.Fatal("Expect error for a v1 mt byte with a compressor nibble")
+	}
+}
+
+func TestVersion2(t *testing.T) {
+	ext, err := EncodeExt(map[string]string{"trace-id": "abc", "zone": "eu"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &Header{
+		Version:    Version2,
+		CodecType:  CodecTypeBinary,
+		MsgType:    MsgTypeStreamEnd,
+		Flags:      FlagCompressed | FlagStreamEnd | FlagError,
+		Compressor: CompressorGzip,
+		Seq:        42,
+		BodyLen:    3,
+		Ext:        ext,
+	}
+	var buf bytes.Buffer
+	if err := Encode(&buf, h, []byte{7, 8, 9}); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != HeaderSizeV2+len(ext)+3 {
+		t.Fatalf("Expect %d bytes, got %d", HeaderSizeV2+len(ext)+3, buf.Len())
+	}
+
+	got, body, err := Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Version != Version2 || got.MsgType != MsgTypeStreamEnd || got.Flags != h.Flags ||
+		got.Compressor != CompressorGzip || got.Seq != 42 || !bytes.Equal(body, []byte{7, 8, 9}) {
+		t.Fatalf("Header mismatch: %+v", got)
+	}
+	kv, err := DecodeExt(got.Ext)
+	if err != nil || kv["trace-id"] != "abc" || kv["zone"] != "eu" || len(kv) != 2 {
+		t.Fatalf("Extension mismatch: %v (%v)", kv, err)
+	}
+	if _, err := DecodeExt(ext[:len(ext)-1]); err == nil {
+		t.Fatal("Expect error for a truncated extension area")
+	}
+
+	// The extension area comes from the buffer pool, and TakeExt hands it back
+	if cap(got.Ext) != 1<<minPooledShift {
+		t.Fatalf("Expect a pooled extension area, got cap %d", cap(got.Ext))
+	}
+	kv, err = TakeExt(got)
+	if err != nil || kv["trace-id"] != "abc" || got.Ext != nil {
+		t.Fatalf("Expect TakeExt to decode and clear the extension area, got %v (%v)", kv, err)
+	}
+	if kv, err := TakeExt(got); kv != nil || err != nil {
+		t.Fatalf("Expect nothing from a frame without extension area, got %v (%v)", kv, err)
+	}
+}
+
+func TestExtFor(t *testing.T) {
+	md := map[string]string{"trace-id": "abc"}
+	if ext, ok := ExtFor(Version2, md); !ok || !bytes.Equal(ext, []byte{8, 't', 'r', 'a', 'c', 'e', '-', 'i', 'd', 0, 3, 'a', 'b', 'c'}) {
+		t.Fatalf("Expect the encoded metadata, got %v %v", ext, ok)
+	}
+	// Metadata stays in the body: v1 frames, nothing to send, too large for the area
+	if _, ok := ExtFor(Version, md); ok {
+		t.Fatal("Expect no extension area in a v1 frame")
+	}
+	if _, ok := ExtFor(Version2, nil); ok {
+		t.Fatal("Expect no extension area without metadata")
+	}
+	if _, ok := ExtFor(Version2, map[string]string{"big": strings.Repeat("x", MaxExtLen)}); ok {
+		t.Fatal("Expect no extension area for metadata that doesn't fit")
+	}
+}
+
+func TestVersion1Flags(t *testing.T) {
+	// v1 is the baseline format: no flags byte, no compressor — both are dropped
+	var buf bytes.Buffer
+	h := &Header{MsgType: MsgTypeRequest, Flags: FlagOneWay | FlagError, Compressor: CompressorGzip, Seq: 1, BodyLen: 2}
+	if err := Encode(&buf, h, []byte{1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != HeaderSize+2 || buf.Bytes()[5] != byte(MsgTypeRequest) {
+		t.Fatalf("Expect a plain %d-byte frame, got % x", HeaderSize+2, buf.Bytes())
+	}
+	got, body, err := Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Version != Version || got.Flags != 0 || got.Compressor != CompressorNone || got.BodyLen != 2 || !bytes.Equal(body, []byte{1, 2}) {
+		t.Fatalf("Header mismatch: %+v, body %v", got, body)
+	}
+
+	// A compressed body can't be sent as v1: the peer would take it for the plain one
+	h.Flags = FlagCompressed
+	if err := Encode(&buf, h, []byte{1, 2}); err == nil {
+		t.Fatal("Expect error for a compressed v1 frame")
+	}
+	if err := NewFrameWriter(io.Discard).WriteFrame(h, []byte{1, 2}); err == nil {
+		t.Fatal("Expect error for a compressed v1 frame")
+	}
+}
+
+func TestHello(t *testing.T) {
+	var buf bytes.Buffer
+	h, body := HelloFrame()
+	if err := Encode(&buf, h, body); err != nil {
+		t.Fatal(err)
+	}
+	got, gotBody, err := Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Version != Version || HelloVersion(got, gotBody) != Version2 {
+		t.Fatalf("Expect a v1 hello offering v2, got %+v %v", got, gotBody)
+	}
+
+	// Plain heartbeats are not hellos, and future versions are capped at MaxVersion
+	if HelloVersion(&Header{MsgType: MsgTypeHeartbeat}, nil) != 0 {
+		t.Fatal("Expect a plain heartbeat not to be a hello")
+	}
+	if HelloVersion(&Header{MsgType: MsgTypeHeartbeat}, []byte{9}) != MaxVersion {
+		t.Fatal("Expect the offered version to be capped at MaxVersion")
+	}
+}
+
+func TestDecodeWithLimit(t *testing.T) {
+	// A header announcing 4 GiB must be refused before anything is allocated
+	var buf bytes.Buffer
+	h := &Header{MsgType: MsgTypeRequest, Seq: 5, BodyLen: 0xffffffff}
+	if err := Encode(&buf, h, nil); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err := Decode(&buf)
+	var tooLarge *FrameTooLargeError
+	if !errors.As(err, &tooLarge) {
+		t.Fatalf("Expect FrameTooLargeError, got %v", err)
+	}
+	if tooLarge.Header.Seq != 5 || tooLarge.Header.MsgType != MsgTypeRequest || tooLarge.Limit != DefaultMaxBodySize {
+		t.Fatalf("Expect the parsed header and the default limit, got %+v", tooLarge)
+	}
+
+	// Bodies up to the limit pass
+	buf.Reset()
+	h.BodyLen = 4
+	if err := Encode(&buf, h, []byte{1, 2, 3, 4}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := DecodeWithLimit(bytes.NewReader(buf.Bytes()), 4); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := DecodeWithLimit(bytes.NewReader(buf.Bytes()), 3); !errors.As(err, &tooLarge) {
+		t.Fatalf("Expect FrameTooLargeError, got %v", err)
+	}
+
+	// A failed v2 decode leaves no pooled extension area behind, whatever the error
+	buf.Reset()
+	ext, _ := EncodeExt(map[string]string{"trace-id": "abc"})
+	v2 := &Header{Version: Version2, MsgType: MsgTypeRequest, Seq: 6, BodyLen: 4, Ext: ext}
+	if err := Encode(&buf, v2, []byte{1, 2, 3, 4}); err != nil {
+		t.Fatal(err)
+	}
+	var got Header
+	if _, err := DecodeInto(bytes.NewReader(buf.Bytes()), &got, 3); !errors.As(err, &tooLarge) || got.Ext != nil {
+		t.Fatalf("Expect FrameTooLargeError without Ext, got %v, Ext %v", err, got.Ext)
+	}
+	if _, err := DecodeInto(bytes.NewReader(buf.Bytes()[:buf.Len()-1]), &got, DefaultMaxBodySize); err == nil || got.Ext != nil {
+		t.Fatalf("Expect a truncated-body error without Ext, got %v, Ext %v", err, got.Ext)
+	}
+}
+
+func TestReleaseBody(t *testing.T) {
+	// Bodies come from power-of-two size classes, with 512 B as the smallest
+	for _, tc := range []struct{ n, cap int }{{1, 512}, {512, 512}, {513, 1024}, {DefaultMaxBodySize, DefaultMaxBodySize}} {
+		if body := getBody(tc.n); len(body) != tc.n || cap(body) != tc.cap {
+			t.Errorf("getBody(%d): expect len %d cap %d, got len %d cap %d", tc.n, tc.n, tc.cap, len(body), cap(body))
+		}
+	}
+	if body := getBody(DefaultMaxBodySize + 1); cap(body) != DefaultMaxBodySize+1 {
+		t.Errorf("Expect bodies over the largest class to be allocated exactly, got cap %d", cap(body))
+	}
+
+	// Releasing foreign or empty slices is a no-op rather than polluting the pool
+	ReleaseBody(nil)
+	ReleaseBody(make([]byte, 10))
+	ReleaseBody(getBody(2000)[:100:600])
+
+	// A released body is handed out again (sync.Pool may drop it, so retry a few times)
+	reused := false
+	for i := 0; i < 10 && !reused; i++ {
+		body := getBody(700)
+		ReleaseBody(body)
+		reused = &getBody(900)[0] == &body[0]
+	}
+	if !reused {
+		t.Error("Expect a released body to be reused")
+	}
+}
+
+func TestEncodeDecodeAllocs(t *testing.T) {
+	h := &Header{Version: Version2, MsgType: MsgTypeRequest, Seq: 1, BodyLen: 300}
+	body := bytes.Repeat([]byte{'x'}, 300)
+	var buf bytes.Buffer
+	r := bytes.NewReader(nil)
+	var decoded Header
+
+	// With a pooled body released after use, a round trip allocates nothing
+	allocs := testing.AllocsPerRun(100, func() {
+		buf.Reset()
+		if err := Encode(&buf, h, body); err != nil {
+			t.Fatal(err)
+		}
+		r.Reset(buf.Bytes())
+		out, err := DecodeInto(r, &decoded, DefaultMaxBodySize)
+		if err != nil || len(out) != len(body) {
+			t.Fatalf("Round trip failed: %v", err)
+		}
+		ReleaseBody(out)
+	})
+	if allocs > 0 {
+		t.Errorf("Expect an allocation-free encode/decode round trip, got %.1f allocs", allocs)
+	}
+}
+
+func TestFrameWriter(t *testing.T) {
+	pr, pw := io.Pipe()
+	fw := NewFrameWriter(pw)
+
+	// Concurrent writers: every frame arrives whole, and each writer's frames in order
+	const writers, frames = 8, 50
+	go func() {
+		var wg sync.WaitGroup
+		for w := 0; w < writers; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := 0; i < frames; i++ {
+					body := []byte{byte(w), byte(i)}
+					h := &Header{Version: Version2, MsgType: MsgTypeRequest, Seq: uint32(w), BodyLen: 2}
+					if err := fw.WriteFrame(h, body); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}(w)
+		}
+		wg.Wait()
+	}()
+	next := make([]int, writers)
+	for n := 0; n < writers*frames; n++ {
+		h, body, err := Decode(pr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int(body[0]) != int(h.Seq) || int(body[1]) != next[h.Seq] {
+			t.Fatalf("Expect frame %d of writer %d, got body %v", next[h.Seq], h.Seq, body)
+		}
+		next[h.Seq]++
+	}
+
+	// A write error is returned to the caller, then sticks
+	pr.CloseWithError(errors.New("broken pipe"))
+	h := &Header{MsgType: MsgTypeHeartbeat}
+	if err := fw.WriteFrame(h, nil); err == nil || err.Error() != "broken pipe" {
+		t.Fatalf("Expect the write error, got %v", err)
+	}
+	if err := fw.WriteFrame(h, nil); err == nil || err.Error() != "broken pipe" {
+		t.Fatalf("Expect the write error to stick, got %v", err)
+	}
+
+	// A closed writer fails right away
+	fw = NewFrameWriter(io.Discard)
+	fw.Close()
+	if err := fw.WriteFrame(h, nil); !errors.Is(err, ErrWriterClosed) {
+		t.Fatalf("Expect ErrWriterClosed, got %v", err)
+	}
+}
+
+func FuzzDecode(f *testing.F) {
+	// Seeds: valid v1 and v2 frames, compressed and with extensions
+	for _, h := range []*Header{
+		{Version: Version, MsgType: MsgTypeRequest, Seq: 1, BodyLen: 3},
+		{Version: Version2, MsgType: MsgTypeResponse, Compressor: CompressorGzip, Flags: FlagCompressed, Seq: 2, BodyLen: 3},
+		{Version: Version2, MsgType: MsgTypeStreamData, Flags: FlagStreamEnd, Seq: 3, BodyLen: 3, Ext: []byte{1, 'k', 0, 1, 'v'}},
+	} {
+		var buf bytes.Buffer
+		if err := Encode(&buf, h, []byte("abc")); err != nil {
+			f.Fatal(err)
+		}
+		f.Add(buf.Bytes())
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// Arbitrary input must yield a frame or an error — never a panic or a huge allocation
+		h, body, err := DecodeWithLimit(bytes.NewReader(data), 1<<16)
+		if err != nil {
+			return
+		}
+		if int(h.BodyLen) != len(body) {
+			t.Fatalf("Header says %d body bytes, got %d", h.BodyLen, len(body))
+		}
+
+		// A decoded frame re-encodes to a frame that decodes the same way
+		var buf bytes.Buffer
+		if err := Encode(&buf, h, body); err != nil {
+			t.Fatalf("Encode of a decoded frame failed: %v", err)
+		}
+		h2, body2, err := Decode(&buf)
+		if err != nil {
+			t.Fatalf("Decode of a re-encoded frame failed: %v", err)
+		}
+		if !bytes.Equal(body, body2) || h.Seq != h2.Seq || h.MsgType != h2.MsgType || h.Compressor != h2.Compressor {
+			t.Fatalf("Round trip mismatch: %+v → %+v", h, h2)
+		}
+	})
+}
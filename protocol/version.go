@@ -0,0 +1,135 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Flags is the v2 flags byte: per-frame properties that don't warrant a message type of their own.
+type Flags byte
+
+const (
+	// FlagCompressed: the body is compressed with Header.Compressor. Without it, a frame of a
+	// compressed call is sent as is (bodies under the compression threshold).
+	FlagCompressed Flags = 1 << iota
+	// FlagOneWay: a request that expects no response — the server runs the handler and
+	// writes nothing back.
+	FlagOneWay
+	// FlagStreamEnd: the last frame of its direction of a stream (set on MsgTypeStreamEnd).
+	FlagStreamEnd
+	// FlagError: the body carries an error status (responses and stream end frames), so a
+	// peer can tell failures apart without decoding the body.
+	FlagError
+)
+
+// MaxExtLen is the largest extension area a v2 header can carry (its length is a uint16).
+const MaxExtLen = 1<<16 - 1
+
+// EncodeExt serializes key/value pairs into a v2 extension area. Keys are sorted, so the
+// same map always produces the same bytes. Layout, repeated per pair:
+//
+//	keyLen (1) │ key │ valLen (2) │ value
+func EncodeExt(kv map[string]string) ([]byte, error) {
+	keys := make([]string, 0, len(kv))
+	for k := range kv {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var buf []byte
+	for _, k := range keys {
+		v := kv[k]
+		if len(k) > 0xff || len(v) > 0xffff {
+			return nil, fmt.Errorf("extension %q too large", k)
+		}
+		buf = append(buf, byte(len(k)))
+		buf = append(buf, k...)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(v)))
+		buf = append(buf, v...)
+	}
+	if len(buf) > MaxExtLen {
+		return nil, fmt.Errorf("extension area too large: %d bytes", len(buf))
+	}
+	return buf, nil
+}
+
+// DecodeExt parses an extension area written by EncodeExt. An empty area yields a nil map.
+func DecodeExt(ext []byte) (map[string]string, error) {
+	if len(ext) == 0 {
+		return nil, nil
+	}
+	kv := make(map[string]string)
+	for len(ext) > 0 {
+		keyLen := int(ext[0])
+		if len(ext) < 1+keyLen+2 {
+			return nil, errors.New("truncated extension key")
+		}
+		key := string(ext[1 : 1+keyLen])
+		ext = ext[1+keyLen:]
+		valLen := int(binary.BigEndian.Uint16(ext))
+		if len(ext) < 2+valLen {
+			return nil, errors.New("truncated extension value")
+		}
+		kv[key] = string(ext[2 : 2+valLen])
+		ext = ext[2+valLen:]
+	}
+	return kv, nil
+}
+
+// ExtFor returns the extension area carrying kv in a frame of the given version, and false
+// if kv has to travel in the body instead: there is nothing to send, v1 frames have no
+// extension area, or kv doesn't fit in one.
+func ExtFor(version byte, kv map[string]string) ([]byte, bool) {
+	if version != Version2 || len(kv) == 0 {
+		return nil, false
+	}
+	ext, err := EncodeExt(kv)
+	return ext, err == nil
+}
+
+// TakeExt decodes the extension area of a frame read by DecodeInto, then returns the area to
+// the buffer pool and clears h.Ext. A frame without one yields a nil map.
+func TakeExt(h *Header) (map[string]string, error) {
+	if h.Ext == nil {
+		return nil, nil
+	}
+	kv, err := DecodeExt(h.Ext)
+	ReleaseBody(h.Ext)
+	h.Ext = nil
+	return kv, err
+}
+
+// Version negotiation.
+//
+// A client can't just start sending v2 frames: a v1 server rejects them and drops the
+// connection. Instead, the first frame of every connection is a hello — a v1 heartbeat whose
+// 1-byte body is the highest version the sender speaks:
+//
+//	client ──hello(v1 heartbeat, body=02)──→ server    v1 server: heartbeat, skipped
+//	client ←─hello(v1 heartbeat, body=02)─── server    v2 server: switches to v2, answers
+//
+// Each side switches to v2 for the frames it writes once it knows the peer speaks it: the
+// server right after answering the hello, the client when the answer arrives (frames sent
+// before are v1 — Decode accepts both). Against a v1 server no answer ever comes, and the
+// connection simply stays on v1. Plain heartbeats have no body, so they are never mistaken
+// for a hello.
+
+// MaxVersion is the highest frame format this build speaks, offered in hello frames.
+const MaxVersion = Version2
+
+// HelloFrame returns the hello frame announcing MaxVersion. It is always encoded as v1,
+// so any peer can read it.
+func HelloFrame() (*Header, []byte) {
+	return &Header{Version: Version, MsgType: MsgTypeHeartbeat, BodyLen: 1}, []byte{MaxVersion}
+}
+
+// HelloVersion returns the version a hello frame offers, capped at MaxVersion, or 0 if the
+// frame is not a hello (e.g., a plain heartbeat).
+func HelloVersion(h *Header, body []byte) byte {
+	if h.MsgType != MsgTypeHeartbeat || len(body) != 1 || body[0] < Version {
+		return 0
+	}
+	return min(body[0], MaxVersion)
+}
@@ -0,0 +1,170 @@
+package protocol
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+// ErrWriterClosed is returned by FrameWriter.WriteFrame once the writer has been closed.
+var ErrWriterClosed = errors.New("frame writer closed")
+
+// maxBatchFrames caps how many queued frames go out in one vectored write, so a single
+// flush never holds more than a few hundred callers waiting on its result.
+const maxBatchFrames = 128
+
+// FrameWriter owns the write side of one connection: a dedicated goroutine drains a queue of
+// frames and flushes everything queued so far in one vectored write (writev on a TCP
+// connection). Under load, frames from many goroutines share a syscall instead of each
+// taking a lock and issuing its own:
+//
+//	goroutine A ─┐
+//	goroutine B ─┼─→ queue ─→ writer goroutine ─→ writev(A, B, C)
+//	goroutine C ─┘
+//
+// Frames are written in the order they are queued, and never interleave. Safe for concurrent use.
+type FrameWriter struct {
+	w    io.Writer
+	wake chan struct{} // Signalled (cap 1) when the queue goes from empty to non-empty
+
+	mu    sync.Mutex
+	queue []*queuedFrame
+	err   error // Sticky: the first write error, or ErrWriterClosed; set, the queue stays empty
+}
+
+// queuedFrame is one frame waiting for the writer goroutine, pooled with its header space.
+type queuedFrame struct {
+	fb     frameBuf   // Header bytes, filled by WriteFrame
+	header []byte     // The part of fb.header to send
+	ext    []byte     // v2 extension area, if any
+	body   []byte     // Not copied: WriteFrame waits for the flush before returning
+	done   chan error // Result of the flush (cap 1)
+}
+
+var queuedFrames = sync.Pool{New: func() any { return &queuedFrame{done: make(chan error, 1)} }}
+
+// NewFrameWriter starts the writer goroutine for w. It runs until Close is called or a write
+// fails.
+func NewFrameWriter(w io.Writer) *FrameWriter {
+	fw := &FrameWriter{w: w, wake: make(chan struct{}, 1)}
+	go fw.loop()
+	return fw
+}
+
+// WriteFrame queues a complete frame (header + body), in the format given by h.Version, and
+// waits until it has been written. It returns the write error of the flush that carried the
+// frame — after a failed write, every later call fails with the same error.
+//
+// Waiting keeps the caller's contract the same as Encode: body can be reused as soon as
+// WriteFrame returns, and an error means the frame may not have reached the peer.
+func (fw *FrameWriter) WriteFrame(h *Header, body []byte) error {
+	if err := h.check(); err != nil {
+		return err
+	}
+	qf := queuedFrames.Get().(*queuedFrame)
+	qf.header = qf.fb.putHeader(h)
+	if h.Version == Version2 {
+		qf.ext = h.Ext
+	}
+	qf.body = body
+
+	fw.mu.Lock()
+	if err := fw.err; err != nil {
+		fw.mu.Unlock()
+		qf.release()
+		return err
+	}
+	fw.queue = append(fw.queue, qf)
+	first := len(fw.queue) == 1
+	fw.mu.Unlock()
+	if first {
+		fw.signal()
+	}
+
+	err := <-qf.done
+	qf.release()
+	return err
+}
+
+// Close stops the writer goroutine. Frames still queued fail with ErrWriterClosed, as does
+// every later WriteFrame. Close does not close the underlying writer.
+func (fw *FrameWriter) Close() {
+	fw.mu.Lock()
+	if fw.err == nil {
+		fw.err = ErrWriterClosed
+	}
+	fw.mu.Unlock()
+	fw.signal()
+}
+
+func (fw *FrameWriter) signal() {
+	select {
+	case fw.wake <- struct{}{}:
+	default: // Already signalled, the writer goroutine will see the whole queue
+	}
+}
+
+// loop is the writer goroutine: wait for frames, take everything queued, flush it in one write.
+func (fw *FrameWriter) loop() {
+	var batch []*queuedFrame
+	var vec [][]byte // Backing array of the net.Buffers, kept across flushes
+	for range fw.wake {
+		for {
+			// Step 1: Take the queued frames (up to maxBatchFrames), or stop if closed
+			fw.mu.Lock()
+			if fw.err != nil {
+				rest := fw.queue
+				fw.queue = nil
+				err := fw.err
+				fw.mu.Unlock()
+				for _, qf := range rest {
+					qf.done <- err
+				}
+				return
+			}
+			n := min(len(fw.queue), maxBatchFrames)
+			if n == 0 {
+				fw.mu.Unlock()
+				break // Drained: wait for the next signal
+			}
+			batch = append(batch[:0], fw.queue[:n]...)
+			fw.queue = append(fw.queue[:0], fw.queue[n:]...)
+			fw.mu.Unlock()
+
+			// Step 2: One vectored write for the whole batch
+			vec = vec[:0]
+			for _, qf := range batch {
+				vec = append(vec, qf.header)
+				if len(qf.ext) > 0 {
+					vec = append(vec, qf.ext)
+				}
+				if len(qf.body) > 0 {
+					vec = append(vec, qf.body)
+				}
+			}
+			bufs := net.Buffers(vec) // WriteTo consumes its receiver, vec keeps the array
+			_, err := bufs.WriteTo(fw.w)
+			clear(vec) // Don't keep the callers' bodies alive until the next flush
+
+			// Step 3: Report the result; after a failure the connection is unusable
+			if err != nil {
+				fw.mu.Lock()
+				if fw.err == nil {
+					fw.err = err
+				}
+				fw.mu.Unlock()
+			}
+			for _, qf := range batch {
+				qf.done <- err
+			}
+			clear(batch)
+		}
+	}
+}
+
+// release returns a queuedFrame to the pool, dropping its references to the caller's data.
+func (qf *queuedFrame) release() {
+	qf.header, qf.ext, qf.body = nil, nil, nil
+	queuedFrames.Put(qf)
+}
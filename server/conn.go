@@ -0,0 +1,220 @@
+package server
+
+import (
+	"io"
+	"log"
+	"mini-rpc/codec"
+	"mini-rpc/compressor"
+	"mini-rpc/message"
+	"mini-rpc/protocol"
+	"mini-rpc/status"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// serverConn holds the per-connection state shared by all request goroutines on one TCP connection.
+type serverConn struct {
+	conn    net.Conn
+	writer  *protocol.FrameWriter // Per-connection writer goroutine — whole frames, batched across requests
+	streams sync.Map              // map[uint32]*serverStream — open streams on this connection, keyed by Seq
+	version atomic.Uint32         // Frame format for writes: v1 unless the client's hello offered v2
+
+	maxRecvSize int // Largest request frame body accepted, compressed or not (WithMaxRequestSize)
+	maxSendSize int // Largest response frame body sent (WithMaxResponseSize)
+
+	logger *log.Logger // The server's logger
+
+	idleTimeout time.Duration // Close the connection after this long without a frame (0 = never)
+	idleTimer   *time.Timer   // Fires checkIdle; nil without an idle timeout
+	lastRead    atomic.Int64  // When the last frame was read (UnixNano)
+	active      atomic.Int32  // Requests and streams in progress — a busy connection is never idle
+}
+
+func newServerConn(conn net.Conn, maxRecvSize, maxSendSize int, logger *log.Logger, idleTimeout time.Duration) *serverConn {
+	sc := &serverConn{
+		conn:        conn,
+		writer:      protocol.NewFrameWriter(conn),
+		maxRecvSize: maxRecvSize,
+		maxSendSize: maxSendSize,
+		logger:      logger,
+		idleTimeout: idleTimeout,
+	}
+	sc.version.Store(uint32(protocol.Version))
+	sc.touch()
+	if idleTimeout > 0 {
+		sc.idleTimer = time.AfterFunc(idleTimeout, sc.checkIdle)
+	}
+	return sc
+}
+
+// touch records that a frame was just read.
+func (sc *serverConn) touch() {
+	sc.lastRead.Store(time.Now().UnixNano())
+}
+
+// checkIdle runs when the idle timer fires. A connection that has gone idleTimeout without
+// sending a frame, while no request or stream of it is in progress, belongs to a client that
+// vanished without closing it (crash, network partition, lost NAT mapping): it is closed, and
+// the read loop cleans up. Otherwise the timer is re-armed for the rest of the timeout.
+//
+// A watchdog rather than a read deadline: a deadline can expire in the middle of a frame,
+// leaving the byte stream impossible to resume.
+func (sc *serverConn) checkIdle() {
+	idle := time.Since(time.Unix(0, sc.lastRead.Load()))
+	if idle >= sc.idleTimeout && sc.active.Load() == 0 {
+		sc.logger.Printf("Closing connection from %s: idle for %v", sc.conn.RemoteAddr(), idle.Round(time.Millisecond))
+		sc.conn.Close()
+		return
+	}
+	sc.idleTimer.Reset(max(sc.idleTimeout-idle, sc.idleTimeout/10))
+}
+
+// pong answers a client's ping with a heartbeat carrying the same Seq.
+func (sc *serverConn) pong(seq uint32) {
+	sc.writeFrame(&protocol.Header{MsgType: protocol.MsgTypeHeartbeat, Seq: seq}, nil) // A failure surfaces on the read loop
+}
+
+// writeFrame writes one complete frame in the connection's frame format and returns once it
+// has been written. Safe for concurrent use: responses of parallel requests are queued on the
+// connection's FrameWriter, which flushes whatever is queued in a single write.
+func (sc *serverConn) writeFrame(h *protocol.Header, body []byte) error {
+	h.Version = byte(sc.version.Load())
+	return sc.writer.WriteFrame(h, body)
+}
+
+// negotiate answers a client's hello and switches the connection's writes to the agreed
+// version. It runs on the read loop, before any request of the connection is dispatched,
+// so the answer is the first frame the client receives.
+func (sc *serverConn) negotiate(version byte) {
+	if err := sc.writer.WriteFrame(protocol.HelloFrame()); err != nil {
+		return // The read loop will notice the broken connection
+	}
+	sc.version.Store(uint32(version))
+}
+
+// writeCompressed writes a reply or stream frame, compressed with ct — the compressor of the
+// client frame it answers — once the connection is on v2. A reply over the response size
+// limit is not written: the ResourceExhausted status returned is for the caller to send instead.
+func (sc *serverConn) writeCompressed(h *protocol.Header, body []byte, ct compressor.Type) error {
+	if sc.version.Load() < uint32(protocol.Version2) {
+		ct = compressor.None // v1 frames carry no compressor (and v1 requests never do)
+	}
+	body, compressed, err := compressor.Compress(ct, body)
+	if err != nil {
+		return err
+	}
+	if len(body) > sc.maxSendSize {
+		return status.Errorf(status.ResourceExhausted, "message too large: %d bytes exceeds the %d-byte limit", len(body), sc.maxSendSize)
+	}
+	h.Compressor = byte(ct)
+	if compressed {
+		h.Flags |= protocol.FlagCompressed
+	}
+	h.BodyLen = uint32(len(body))
+	return sc.writeFrame(h, body)
+}
+
+// rejectFrame answers a client frame the server can't read (e.g., a corrupt compressed body)
+// with err, so the caller fails fast instead of waiting for its deadline.
+func (sc *serverConn) rejectFrame(header *protocol.Header, err error) {
+	sc.logger.Printf("Rejecting frame seq %d from %s: %v", header.Seq, sc.conn.RemoteAddr(), err)
+
+	reply := &protocol.Header{CodecType: header.CodecType, Seq: header.Seq, Flags: protocol.FlagError}
+	switch header.MsgType {
+	case protocol.MsgTypeRequest:
+		if header.Flags&protocol.FlagOneWay != 0 {
+			return
+		}
+		reply.MsgType = protocol.MsgTypeResponse
+	case protocol.MsgTypeStreamOpen:
+		reply.MsgType = protocol.MsgTypeStreamEnd // The stream was never opened
+		reply.Flags |= protocol.FlagStreamEnd
+	case protocol.MsgTypeStreamData, protocol.MsgTypeStreamEnd:
+		sc.cancelStream(header.Seq) // The handler's Recv can't be given this element
+		return
+	default:
+		return
+	}
+	body, encErr := codec.GetCodec(codec.CodecType(header.CodecType)).Encode(message.NewErrorMessage(err))
+	if encErr != nil {
+		return
+	}
+	reply.BodyLen = uint32(len(body))
+	sc.writeFrame(reply, body)
+}
+
+// closeAfterReject closes the connection after a frame was refused without reading its body.
+//
+// Closing a socket with unread input makes the kernel answer with a RST, which can destroy the
+// error reply we just wrote before the client reads it. So the write side is shut down first
+// (the client reads our reply, then EOF), and the rest of the input is discarded for a short,
+// bounded time before the connection is closed for good.
+func (sc *serverConn) closeAfterReject() {
+	if tcpConn, ok := sc.conn.(*net.TCPConn); ok {
+		tcpConn.CloseWrite()
+	}
+	sc.conn.SetReadDeadline(time.Now().Add(rejectLinger))
+	io.Copy(io.Discard, sc.conn)
+	sc.close()
+}
+
+// rejectLinger bounds how long closeAfterReject keeps draining a refused frame.
+const rejectLinger = time.Second
+
+// grantCredits applies a MsgTypeStreamAck frame to the matching stream's send window.
+// Acks for streams that already ended are ignored — they can legitimately cross the end frame.
+func (sc *serverConn) grantCredits(seq uint32, body []byte) {
+	n, err := protocol.DecodeCredits(body)
+	if err != nil {
+		sc.logger.Printf("Invalid stream ack for seq %d: %v", seq, err)
+		return
+	}
+	if st, ok := sc.streams.Load(seq); ok {
+		st.(*serverStream).window.Grant(int(n))
+	}
+}
+
+// deliver queues a client data/end frame for the matching stream's Recv, which releases the
+// body. Frames for streams that already ended are dropped.
+func (sc *serverConn) deliver(header *protocol.Header, body []byte) {
+	st, ok := sc.streams.Load(header.Seq)
+	if !ok {
+		protocol.ReleaseBody(body)
+		return
+	}
+	if header.MsgType == protocol.MsgTypeStreamEnd {
+		protocol.ReleaseBody(body)
+		st.(*serverStream).deliver(streamElem{}) // Half-close: Recv returns io.EOF after the queued elements
+		return
+	}
+	msg := &message.RPCMessage{}
+	if err := codec.GetCodec(codec.CodecType(header.CodecType)).Decode(body, msg); err != nil {
+		sc.logger.Printf("Invalid stream data for seq %d: %v", header.Seq, err)
+		protocol.ReleaseBody(body)
+		return
+	}
+	st.(*serverStream).deliver(streamElem{msg: msg, body: body})
+}
+
+// cancelStream cancels the handler of a stream the client abandoned.
+func (sc *serverConn) cancelStream(seq uint32) {
+	if st, ok := sc.streams.Load(seq); ok {
+		st.(*serverStream).cancel()
+	}
+}
+
+// close closes the connection and cancels every stream still open on it,
+// so handlers blocked in Stream.Send return instead of leaking.
+func (sc *serverConn) close() {
+	if sc.idleTimer != nil {
+		sc.idleTimer.Stop()
+	}
+	sc.conn.Close()
+	sc.writer.Close()
+	sc.streams.Range(func(key, value any) bool {
+		value.(*serverStream).cancel()
+		return true
+	})
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"math"
+	"time"
+)
+
+// Option configures a Server at construction: server.NewServer(server.WithTLS(cfg), ...).
+// Every option has a default, so NewServer() alone gives a working server.
+type Option func(*Server)
+
+// WithMaxRequestSize sets the largest request body, in bytes, the server accepts — both on
+// the wire and after decompression. Defaults to protocol.DefaultMaxBodySize.
+//
+// A frame announcing a larger body is answered with a ResourceExhausted status, then the
+// connection is closed: its body is never read, so the byte stream can't be resynchronized.
+// A compressed body that inflates past the limit only fails its own call.
+//
+// It panics if n is negative or over math.MaxUint32.
+func WithMaxRequestSize(n int) Option {
+	checkSizeLimit("WithMaxRequestSize", n)
+	return func(svr *Server) { svr.maxRequestSize = n }
+}
+
+// WithMaxResponseSize sets the largest response body, in bytes, the server sends (after
+// compression). Defaults to protocol.DefaultMaxBodySize. A larger reply is replaced with a
+// ResourceExhausted status; a larger stream element fails the handler's Stream.Send.
+//
+// It panics if n is negative or over math.MaxUint32.
+func WithMaxResponseSize(n int) Option {
+	checkSizeLimit("WithMaxResponseSize", n)
+	return func(svr *Server) { svr.maxResponseSize = n }
+}
+
+// checkSizeLimit panics if n can't be a body size limit: a frame header announces at most
+// math.MaxUint32 bytes, and a negative limit is a programming error, not "no limit".
+func checkSizeLimit(name string, n int) {
+	if n < 0 || uint64(n) > math.MaxUint32 {
+		panic(fmt.Sprintf("server: %s(%d) out of range 0-%d", name, n, uint32(math.MaxUint32)))
+	}
+}
+
+// WithStrictRegistration makes Register and RegisterName fail when the receiver has an
+// exported method that doesn't match an RPC signature, instead of logging and skipping it.
+// The error lists each such method with the reason. Off by default: a service type may
+// legitimately export helpers that aren't meant to be called remotely.
+func WithStrictRegistration() Option {
+	return func(svr *Server) { svr.strict = true }
+}
+
+// WithIdleTimeout makes the server close a connection that has sent no frame for d while
+// none of its requests or streams is in progress — the connection of a client that vanished
+// without closing it. Disabled (0) by default.
+//
+// Clients ping every transport.DefaultHeartbeatInterval, which keeps their idle connections
+// open: d should be a few times their heartbeat interval. A client with heartbeats turned
+// off simply redials after its idle connection was closed.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(svr *Server) { svr.idleTimeout = d }
+}
+
+// WithTLS makes Serve accept TLS connections only, with cfg (which needs at least one
+// certificate). Clients connect with client.WithTLS.
+func WithTLS(cfg *tls.Config) Option {
+	return func(svr *Server) { svr.tlsConfig = cfg }
+}
+
+// WithLogger sends the server's log output (rejected frames, encoding failures, skipped
+// methods, panics caught by the built-in recovery) to l instead of the standard logger.
+func WithLogger(l *log.Logger) Option {
+	return func(svr *Server) { svr.logger = l }
+}
@@ -10,16 +10,21 @@ package server
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
 	"mini-rpc/codec"
+	"mini-rpc/compressor"
 	"mini-rpc/message"
+	"mini-rpc/metadata"
 	"mini-rpc/middleware"
 	"mini-rpc/protocol"
 	"mini-rpc/registry"
+	"mini-rpc/status"
 	"net"
 	"reflect"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -28,6 +33,7 @@ import (
 
 // Server is the RPC server that registers services and handles incoming requests.
 type Server struct {
+	mu            sync.RWMutex            // Guards serviceMap (and the services' method maps) and registry
 	serviceMap    map[string]*service     // Registered services: "Arith" → *service
 	listener      net.Listener            // TCP listener
 	wg            sync.WaitGroup          // Tracks in-flight requests for graceful shutdown
@@ -37,23 +43,152 @@ type Server struct {
 	registry      registry.Registry       // Service registry (etcd), nil if not using discovery
 	advertiseAddr string                  // Address registered in etcd (e.g., "127.0.0.1:8080")
 	// Different from listen address (":8080") because etcd needs a routable IP
+	maxRequestSize  int           // Largest request body accepted (default protocol.DefaultMaxBodySize)
+	maxResponseSize int           // Largest response body sent (default protocol.DefaultMaxBodySize)
+	strict          bool          // Register fails if a receiver has exported methods that aren't RPC methods
+	tlsConfig       *tls.Config   // Serve accepts TLS connections only, if set
+	logger          *log.Logger   // Destination of the server's log output (default log.Default())
+	idleTimeout     time.Duration // Connections silent for this long are closed (0 = never)
 }
 
-// NewServer creates a new RPC server with an empty service map.
-func NewServer() *Server {
+// NewServer creates a new RPC server with an empty service map, configured by opts
+// (see Option); without options, every setting has its default.
+func NewServer(opts ...Option) *Server {
 	s := new(Server)
 	s.serviceMap = make(map[string]*service)
+	s.maxRequestSize = protocol.DefaultMaxBodySize
+	s.maxResponseSize = protocol.DefaultMaxBodySize
+	s.logger = log.Default()
+	for _, opt := range opts {
+		opt(s)
+	}
 	return s
 }
 
-// Register registers a service receiver (e.g., &Arith{}) with the server.
-// The struct's exported methods that match the RPC signature will be available for remote calls.
+// Register registers a service receiver (e.g., &Arith{}) with the server, under the name
+// of its struct type. The struct's exported methods that match the RPC signature will be
+// available for remote calls; the others are logged and skipped (see WithStrictRegistration).
+// A struct with no RPC method at all is an error.
+//
+// Registering a name twice is an error; the first registration stays in place. Services
+// can be registered while the server is serving (they are announced to the registry too).
 func (svr *Server) Register(rcvr any) error {
 	svc, err := NewService(rcvr)
 	if err != nil {
 		return err
 	}
+	return svr.addService(svc)
+}
+
+// RegisterName is like Register, but the service is called name instead of its struct
+// type's name — e.g., to serve two versions of a service side by side ("ArithV1",
+// "ArithV2"), or a struct whose type name is not meant for clients.
+func (svr *Server) RegisterName(name string, rcvr any) error {
+	svc, err := NewService(rcvr)
+	if err != nil {
+		return err
+	}
+	svc.name = name
+	return svr.addService(svc)
+}
+
+// RegisterFunc registers a plain function as the method serviceMethod ("Service.Method").
+// fn must have one of the method signatures of RegisterMethods, without the receiver:
+//
+//	svr.RegisterFunc("Math.Square", func(args *int, reply *int) error {
+//		*reply = *args * *args
+//		return nil
+//	})
+//
+// Functions registered under the same service name form one service, so a service can be
+// built method by method; a name already used by Register or RegisterName can't be
+// extended this way. Registering the same serviceMethod twice is an error.
+func (svr *Server) RegisterFunc(serviceMethod string, fn any) error {
+	serviceName, methodName, ok := strings.Cut(serviceMethod, ".")
+	if !ok || strings.Contains(methodName, ".") {
+		return fmt.Errorf("rpc: invalid service method %q, want \"Service.Method\"", serviceMethod)
+	}
+	if err := checkName(methodName); err != nil {
+		return err
+	}
+	fnv := reflect.ValueOf(fn)
+	if fnv.Kind() != reflect.Func || fnv.IsNil() {
+		return fmt.Errorf("rpc: %s: fn must be a function, got %T", serviceMethod, fn)
+	}
+	mType, err := parseMethod(fnv.Type(), 0)
+	if err != nil {
+		return fmt.Errorf("rpc: %s: %s %v", serviceMethod, fnv.Type(), err)
+	}
+	mType.fn = fnv
+
+	if err := checkName(serviceName); err != nil {
+		return err
+	}
+
+	svr.mu.Lock()
+	svc, exists := svr.serviceMap[serviceName]
+	switch {
+	case !exists:
+		// The first function of a service creates it
+		svc = &service{name: serviceName, method: make(map[string]*methodType)}
+		svr.serviceMap[serviceName] = svc
+	case svc.rcvr.IsValid():
+		svr.mu.Unlock()
+		return fmt.Errorf("rpc: service %q is already registered with a receiver", serviceName)
+	case svc.method[methodName] != nil:
+		svr.mu.Unlock()
+		return fmt.Errorf("rpc: method %q already registered", serviceMethod)
+	}
+	svc.method[methodName] = mType
+	reg, addr := svr.registry, svr.advertiseAddr
+	svr.mu.Unlock()
+
+	if !exists {
+		announce(reg, serviceName, addr)
+	}
+	return nil
+}
+
+// addService adds svc to the service map, refusing duplicates — and, in strict mode,
+// services that skipped some of their exported methods.
+func (svr *Server) addService(svc *service) error {
+	if err := checkName(svc.name); err != nil {
+		return err
+	}
+	if svr.strict && len(svc.skipped) > 0 {
+		return fmt.Errorf("rpc: service %q has exported methods that are not RPC methods%s", svc.name, skippedSuffix(svc.skipped))
+	}
+	for _, m := range svc.skipped {
+		svr.logger.Printf("rpc: %s.%s skipped: %s", svc.name, m.name, m.reason)
+	}
+	svr.mu.Lock()
+	if _, dup := svr.serviceMap[svc.name]; dup {
+		svr.mu.Unlock()
+		return fmt.Errorf("rpc: service %q already registered", svc.name)
+	}
 	svr.serviceMap[svc.name] = svc
+	reg, addr := svr.registry, svr.advertiseAddr
+	svr.mu.Unlock()
+
+	announce(reg, svc.name, addr)
+	return nil
+}
+
+// announce registers a service added while serving with the registry. Before Serve, reg is
+// nil: Serve registers every service present at that point itself. It runs outside svr.mu,
+// so a slow registry never holds up request dispatch.
+func announce(reg registry.Registry, serviceName, addr string) {
+	if reg != nil {
+		reg.Register(serviceName, registry.ServiceInstance{Addr: addr}, 10)
+	}
+}
+
+// checkName rejects service and method names clients couldn't call: empty, or containing
+// the "." that separates them in "Service.Method".
+func checkName(name string) error {
+	if name == "" || strings.Contains(name, ".") {
+		return fmt.Errorf("rpc: invalid name %q: must be non-empty and contain no \".\"", name)
+	}
 	return nil
 }
 
@@ -72,13 +207,22 @@ func (svr *Server) Serve(network, address string, advertiseAddr string, reg regi
 	// Chain wraps middlewares in reverse order to create the onion model:
 	//   Chain(A, B, C)(handler) → A(B(C(handler)))
 	//   Execution order: A.before → B.before → C.before → handler → C.after → B.after → A.after
-	svr.handler = middleware.Chain(svr.middlewares...)(svr.businessHandler)
+	// Panic recovery wraps everything: a panicking method or middleware fails its own call
+	// with an Internal status (stack logged) instead of crashing the process.
+	chain := append([]middleware.Middleware{middleware.RecoveryMiddleware(svr.logPanic)}, svr.middlewares...)
+	svr.handler = middleware.Chain(chain...)(svr.businessHandler)
 
 	if err != nil {
 		return err
 	}
+	if svr.tlsConfig != nil {
+		// The handshake runs on the connection's first read, in its own goroutine
+		listener = tls.NewListener(listener, svr.tlsConfig)
+		svr.listener = listener
+	}
 
 	// Register all services to etcd (if registry is provided)
+	svr.mu.Lock()
 	svr.advertiseAddr = advertiseAddr
 	if reg != nil {
 		svr.registry = reg
@@ -88,6 +232,7 @@ func (svr *Server) Serve(network, address string, advertiseAddr string, reg regi
 			}, 10) // TTL = 10 seconds, KeepAlive renews automatically
 		}
 	}
+	svr.mu.Unlock()
 
 	// Accept loop: one goroutine per connection
 	for {
@@ -105,7 +250,15 @@ func (svr *Server) Serve(network, address string, advertiseAddr string, reg regi
 	}
 }
 
-// Use registers a middleware. Middlewares are applied in the order they are added.
+// logPanic is the PanicHandler of the server's built-in recovery: the panic and its stack
+// go to the server's logger, the caller gets an Internal status.
+func (svr *Server) logPanic(ctx context.Context, req *message.RPCMessage, recovered any, stack []byte) *message.RPCMessage {
+	svr.logger.Printf("panic in %s: %v\n%s", req.ServiceMethod, recovered, stack)
+	return message.NewErrorMessage(status.Errorf(status.Internal, "panic in %s: %v", req.ServiceMethod, recovered))
+}
+
+// Use registers a middleware. Middlewares are applied in the order they are added,
+// inside the server's built-in panic recovery (see middleware.RecoveryMiddleware).
 func (svr *Server) Use(mw middleware.Middleware) {
 	svr.middlewares = append(svr.middlewares, mw)
 }
@@ -114,27 +267,92 @@ func (svr *Server) Use(mw middleware.Middleware) {
 // It runs a read loop in a single goroutine (reads must be sequential to parse frame boundaries),
 // but dispatches each request to its own goroutine for parallel processing.
 //
-// A per-connection write mutex (writeMu) is shared among all request goroutines on this connection.
-// This prevents frame interleaving when multiple goroutines write responses concurrently.
+// A per-connection frame writer (serverConn.writer) is shared among all request goroutines on this
+// connection. Its single writer goroutine prevents frame interleaving when multiple goroutines write
+// responses concurrently, and flushes responses that are ready at the same time in one syscall.
 func (svr *Server) handleConn(conn net.Conn) {
-	defer conn.Close()
-	writeMu := &sync.Mutex{} // Per-connection write lock, shared by all requests on this conn
+	sc := newServerConn(conn, svr.maxRequestSize, svr.maxResponseSize, svr.logger, svr.idleTimeout)
+	defer sc.close()
 	for {
 		// Read one complete frame (sequential — single reader per connection)
-		header, body, err := protocol.Decode(conn)
+		header, body, err := protocol.DecodeWithLimit(conn, uint32(sc.maxRecvSize))
 		if err != nil {
-			break // Connection closed or protocol error
+			var tooLarge *protocol.FrameTooLargeError
+			if errors.As(err, &tooLarge) {
+				// The body is still on the wire: answer the request, then give up on the connection
+				sc.rejectFrame(tooLarge.Header, status.Errorf(status.ResourceExhausted,
+					"message too large: %d bytes exceeds the %d-byte limit", tooLarge.Header.BodyLen, tooLarge.Limit))
+				sc.closeAfterReject()
+			}
+			break // Connection closed (by the client, or as idle) or protocol error
 		}
+		sc.touch()
 
-		// Skip heartbeat frames — they exist only to keep the connection alive
-		if header.MsgType == protocol.MsgTypeHeartbeat {
+		// Metadata sent in the extension area (v2) is parsed here, so the area goes straight
+		// back to the pool; requests and stream opens merge it into their message
+		ext, err := protocol.TakeExt(header)
+		if err != nil {
+			sc.rejectFrame(header, status.Errorf(status.InvalidArgument, "cannot decode frame metadata: %v", err))
+			protocol.ReleaseBody(body)
 			continue
 		}
 
-		// Dispatch request to a new goroutine for parallel processing.
-		// This is critical for performance: without `go`, a slow handler on request 1
-		// would block all subsequent requests on the same connection.
-		go svr.handleRequest(header, body, conn, writeMu)
+		// Undo the client's compression here, where frame order is still known: a stream's
+		// data frames must reach its queue in the order they were sent
+		if header.Flags&protocol.FlagCompressed != 0 {
+			wire := body
+			body, err = compressor.Decompress(compressor.Type(header.Compressor), wire, sc.maxRecvSize)
+			protocol.ReleaseBody(wire) // Only the decompressed copy is used from here on
+			if errors.Is(err, compressor.ErrTooLarge) {
+				sc.rejectFrame(header, status.Errorf(status.ResourceExhausted,
+					"message too large: decompressed body exceeds the %d-byte limit", sc.maxRecvSize))
+				continue
+			}
+			if err != nil {
+				sc.rejectFrame(header, status.Errorf(status.InvalidArgument, "cannot decompress frame: %v", err))
+				continue
+			}
+		}
+
+		// The body goes back to the pool once its frame is handled: inline below, or by the
+		// goroutine (or stream queue) the frame is handed to
+		switch header.MsgType {
+		case protocol.MsgTypeHeartbeat:
+			// The hello a v2 client opens with, or a ping: answered off the read loop, so a
+			// congested writer never holds up reading
+			if v := protocol.HelloVersion(header, body); v != 0 {
+				sc.negotiate(v)
+			} else {
+				go sc.pong(header.Seq)
+			}
+			protocol.ReleaseBody(body)
+		case protocol.MsgTypeStreamAck:
+			// Flow-control credits for a stream's send side — cheap, handled inline
+			sc.grantCredits(header.Seq, body)
+			protocol.ReleaseBody(body)
+		case protocol.MsgTypeStreamCancel:
+			// The client stopped reading — cancel the handler's ctx so Stream.Send returns
+			sc.cancelStream(header.Seq)
+			protocol.ReleaseBody(body)
+		case protocol.MsgTypeStreamOpen:
+			// Register the stream before reading on: the client's first frames may be right behind
+			st, ctx := sc.openStream(header)
+			sc.active.Add(1) // Until handleStream returns
+			go svr.handleStream(ctx, ext, body, st)
+		case protocol.MsgTypeStreamData, protocol.MsgTypeStreamEnd:
+			// Client-streamed elements and half-close, queued for the handler's Recv
+			sc.deliver(header, body)
+		case protocol.MsgTypeRequest:
+			// Dispatch request to a new goroutine for parallel processing.
+			// This is critical for performance: without `go`, a slow handler on request 1
+			// would block all subsequent requests on the same connection.
+			sc.active.Add(1) // Until handleRequest returns
+			go svr.handleRequest(header, ext, body, sc)
+		default:
+			// Server → client frame types (responses) are never valid here
+			svr.logger.Printf("Ignoring unexpected frame type %d from %s", header.MsgType, conn.RemoteAddr())
+			protocol.ReleaseBody(body)
+		}
 	}
 }
 
@@ -142,41 +360,125 @@ func (svr *Server) handleConn(conn net.Conn) {
 //
 // The protocol layer (codec encode/decode, frame write) is separated from the business layer
 // (service lookup, reflection call) to allow middleware to wrap only the business logic.
-func (svr *Server) handleRequest(header *protocol.Header, body []byte, conn net.Conn, writeMu *sync.Mutex) {
+//
+// ext is the metadata the frame carried in its extension area (v2 clients send it there
+// rather than in the body); on a v2 connection, the response metadata goes back the same way.
+func (svr *Server) handleRequest(header *protocol.Header, ext map[string]string, body []byte, sc *serverConn) {
 	// Track this request for graceful shutdown (wg.Wait ensures all in-flight requests complete)
 	svr.wg.Add(1)
 	defer svr.wg.Done()
+	defer sc.active.Add(-1) // Added by handleConn
 
 	// Step 1: Decode the frame body into an RPCMessage using the appropriate codec
+	// The message may alias the body (BinaryCodec payloads), so the body is only recycled
+	// once the handler is done with it
 	c := codec.GetCodec(codec.CodecType(header.CodecType))
 	msg := message.RPCMessage{}
-	c.Decode(body, &msg)
-
-	// Step 2: Run through the middleware chain → business handler
-	// The handler returns an RPCMessage with the response payload (or error)
-	rpcMessage := svr.handler(context.Background(), &msg)
+	defer protocol.ReleaseBody(body)
+	if err := c.Decode(body, &msg); err != nil {
+		sc.rejectFrame(header, status.Errorf(status.InvalidArgument, "cannot decode request: %v", err))
+		return
+	}
+	msg.AddMetadata(ext)
 
-	// Step 3: Encode and write the response (protected by per-connection write lock)
-	writeMu.Lock()
-	defer writeMu.Unlock()
+	// Step 2: Build the handler's ctx from the request (deadline, metadata)
+	ctx, cancel := requestContext(context.Background(), header.CodecType, &msg)
+	defer cancel()
 
-	result, err := c.Encode(rpcMessage)
-	if err != nil {
-		log.Println("Failed to encode method result")
-		return
+	// Step 3: Run through the middleware chain → business handler
+	// The handler returns an RPCMessage with the response payload (or error)
+	rpcMessage := svr.handler(ctx, &msg)
+	if header.Flags&protocol.FlagOneWay != 0 {
+		return // The client isn't waiting for a response
 	}
+	rpcMessage = withResponseMetadata(ctx, rpcMessage)
 
-	// Build response header — preserve the same Seq so the client can match it
+	// Step 4: Build response header — preserve the same Seq so the client can match it
 	replyHeader := protocol.Header{
 		CodecType: header.CodecType,
 		MsgType:   protocol.MsgTypeResponse,
 		Seq:       header.Seq, // Same seq as request — this is how multiplexing works
-		BodyLen:   uint32(len(result)),
 	}
-	err = protocol.Encode(conn, &replyHeader, result)
+	if rpcMessage.Error != "" {
+		replyHeader.Flags |= protocol.FlagError
+	}
+	if ext, ok := protocol.ExtFor(byte(sc.version.Load()), rpcMessage.Metadata); ok {
+		replyHeader.Ext = ext
+		resp := *rpcMessage // Not modified in place, see withResponseMetadata
+		resp.Metadata = nil
+		rpcMessage = &resp
+	}
+
+	// Step 5: Encode and write the response (queued on the per-connection frame writer)
+	result, err := c.Encode(rpcMessage)
+	if err != nil {
+		svr.logger.Println("Failed to encode method result")
+		return
+	}
+	// Answer with the request's compressor, so a client that compresses also gets compressed replies
+	err = sc.writeCompressed(&replyHeader, result, compressor.Type(header.Compressor))
+	var st *status.Status
+	if errors.As(err, &st) && st.Code == status.ResourceExhausted {
+		// Over the response size limit: the client gets the status instead of the reply
+		sc.rejectFrame(header, st)
+		return
+	}
 	if err != nil {
-		log.Println("Failed to encode reply message")
+		svr.logger.Println("Failed to encode reply message")
+	}
+}
+
+// requestContext derives the handler's ctx from an incoming request:
+//   - the client's deadline (if any) is rebuilt, so the handler's ctx expires when the
+//     caller stops waiting, instead of running for nothing
+//   - request metadata is exposed to middleware via metadata.FromIncomingContext, and
+//     metadata.SetResponse records the response metadata (see withResponseMetadata)
+//   - the frame's codec type tells businessHandler how args/reply are serialized
+//
+// The returned cancel func must always be called to release the context's resources.
+func requestContext(parent context.Context, codecType byte, msg *message.RPCMessage) (context.Context, context.CancelFunc) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if msg.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(parent, msg.Timeout)
+	} else {
+		ctx, cancel = context.WithCancel(parent)
+	}
+	if msg.Metadata != nil {
+		ctx = metadata.NewIncomingContext(ctx, msg.Metadata)
 	}
+	ctx = metadata.NewResponseContext(ctx)
+	ctx = context.WithValue(ctx, codecTypeKey{}, codec.CodecType(codecType))
+	return ctx, cancel
+}
+
+// withResponseMetadata adds the metadata set with metadata.SetResponse under ctx to resp,
+// over any resp already carries. resp is copied, not modified: a middleware may return
+// the same message for many calls.
+func withResponseMetadata(ctx context.Context, resp *message.RPCMessage) *message.RPCMessage {
+	md := metadata.FromResponseContext(ctx)
+	if md == nil {
+		return resp
+	}
+	for k, v := range resp.Metadata {
+		if _, ok := md[k]; !ok {
+			md[k] = v
+		}
+	}
+	out := *resp
+	out.Metadata = md
+	return &out
+}
+
+// codecTypeKey is the context key under which requestContext records the frame's codec type.
+type codecTypeKey struct{}
+
+// payloadCodec returns the codec for args/reply of the request handled under ctx — the
+// codec of the request frame. Without a recorded codec type (e.g., a handler invoked
+// directly), payloads are JSON.
+func payloadCodec(ctx context.Context) codec.Codec {
+	codecType, _ := ctx.Value(codecTypeKey{}).(codec.CodecType)
+	return codec.GetCodec(codecType)
 }
 
 // Shutdown performs graceful shutdown:
@@ -186,11 +488,13 @@ func (svr *Server) handleRequest(header *protocol.Header, body []byte, conn net.
 //  4. Wait for in-flight requests to finish (with timeout)
 func (svr *Server) Shutdown(timeout time.Duration) error {
 	// Step 1: Deregister from etcd FIRST — so clients stop sending new requests
+	svr.mu.RLock()
 	for serviceName := range svr.serviceMap {
 		if svr.registry != nil {
 			svr.registry.Deregister(serviceName, svr.advertiseAddr)
 		}
 	}
+	svr.mu.RUnlock()
 
 	// Step 2: Set shutdown flag BEFORE closing listener
 	// If we close first, the Accept error fires before the flag is set,
@@ -217,46 +521,148 @@ func (svr *Server) Shutdown(timeout time.Duration) error {
 // It is wrapped by the middleware chain and has the HandlerFunc signature.
 //
 // Flow: parse "Service.Method" → find service → find method → reflect.New(args) →
-// json.Unmarshal(payload, args) → reflect.Call → json.Marshal(reply) → return RPCMessage
+// decode(payload, args) → reflect.Call → encode(reply) → return RPCMessage
+//
+// Payloads use the codec of the request frame, so the client's codec choice decides the
+// wire format of args and reply too (for Protobuf, they must implement proto.Message).
+//
+// For streaming methods the stream (set in ctx by handleStream) takes the place of the
+// streamed side, and the returned RPCMessage only carries the final status.
 func (svr *Server) businessHandler(ctx context.Context, req *message.RPCMessage) *message.RPCMessage {
-	// Parse "ServiceName.MethodName"
+	// Parse "ServiceName.MethodName" — exactly two non-empty parts
 	split := strings.Split(req.ServiceMethod, ".")
-	if len(split) != 2 {
-		return &message.RPCMessage{Error: "invalid service method format"}
+	if len(split) != 2 || split[0] == "" || split[1] == "" {
+		return message.NewErrorMessage(status.Errorf(status.InvalidArgument, "invalid service method format: %q, want \"Service.Method\"", req.ServiceMethod))
 	}
 	serviceName := split[0]
 	methodName := split[1]
 
 	// Look up the service and method in the registry
-	svc := svr.serviceMap[serviceName]
-	method := svc.method[methodName]
+	svc, method, err := svr.lookup(serviceName, methodName)
+	if err != nil {
+		return message.NewErrorMessage(err)
+	}
 
-	// Create new instances of args and reply types via reflection
-	argv := reflect.New(method.ArgType)     // e.g., reflect.New(Args) → *Args
-	replyv := reflect.New(method.ReplyType) // e.g., reflect.New(Reply) → *Reply
+	// The call shape must match the method shape: handleStream puts the stream in ctx,
+	// a plain request has none
+	st, isStream := ctx.Value(streamKey{}).(*serverStream)
+	if method.kind != unaryMethod && !isStream {
+		return message.NewErrorMessage(status.Errorf(status.FailedPrecondition, "%s is a streaming method, call it with Client.Stream or Client.NewStream", req.ServiceMethod))
+	}
+	if method.kind == unaryMethod && isStream {
+		return message.NewErrorMessage(status.Errorf(status.FailedPrecondition, "%s is not a streaming method, call it with Client.Call", req.ServiceMethod))
+	}
+
+	// Streaming: elements go through the stream, only the status comes back here
+	if method.kind != unaryMethod {
+		var stream Stream = &streamView{st: st, ctx: ctx}
+		rpcMessage := &message.RPCMessage{ServiceMethod: req.ServiceMethod}
+		rpcMessage.SetError(svr.callStream(ctx, method, svc, req, st, stream))
+		return rpcMessage
+	}
+
+	// Create a new instance of the args type via reflection
+	argv := reflect.New(method.ArgType) // e.g., reflect.New(Args) → *Args
 
 	// Deserialize the request payload into the args struct
-	err := json.Unmarshal(req.Payload, argv.Interface())
+	pc := payloadCodec(ctx)
+	err = pc.Decode(req.Payload, argv.Interface())
 	if err != nil {
-		return &message.RPCMessage{Error: err.Error()}
+		return message.NewErrorMessage(status.Errorf(status.InvalidArgument, "cannot decode args: %v", err))
 	}
 
-	// Invoke the method via reflection: receiver.Method(args, reply)
-	methodErr := svc.Call(method, argv, replyv)
+	replyv := reflect.New(method.ReplyType) // e.g., reflect.New(Reply) → *Reply
+
+	// Invoke the method via reflection: receiver.Method([ctx,] args, reply)
+	// ctx is the middleware chain's, so the method sees TimeOutMiddleware's deadline too
+	methodErr := svc.Call(ctx, method, argv, replyv)
 
-	// Serialize the reply struct to JSON
-	replyMessage, err := json.Marshal(replyv.Interface())
-	if err != nil {
-		log.Println("Failed to marshal method result")
+	// Serialize the reply struct
+	replyMessage, err := pc.Encode(replyv.Interface())
+	if err != nil && methodErr == nil {
+		return message.NewErrorMessage(status.Errorf(status.Internal, "cannot encode reply: %v", err))
 	}
 
-	// Build the response RPCMessage
+	// Build the response RPCMessage.
+	// Handlers may return a *status.Status (via status.Errorf) to pick the code;
+	// plain errors are reported as status.Unknown.
 	rpcMessage := &message.RPCMessage{
 		ServiceMethod: req.ServiceMethod,
 		Payload:       replyMessage,
 	}
 	if methodErr != nil {
-		rpcMessage.Error = methodErr.Error()
+		rpcMessage.SetError(methodErr)
 	}
 	return rpcMessage
 }
+
+// maxListedMethods caps the "available methods" details of a NotFound error, so a server
+// with hundreds of methods doesn't answer every typo with a huge response.
+const maxListedMethods = 50
+
+// lookup finds a registered method. Registration may run concurrently (services can be
+// added while serving), hence the read lock. A miss is usually a typo on the client, so
+// the NotFound details list what the caller could have meant.
+func (svr *Server) lookup(serviceName, methodName string) (*service, *methodType, error) {
+	svr.mu.RLock()
+	defer svr.mu.RUnlock()
+	svc := svr.serviceMap[serviceName]
+	if svc == nil {
+		st := status.Newf(status.NotFound, "service %q not found", serviceName)
+		return nil, nil, st.WithDetails(svr.availableMethods()...)
+	}
+	method := svc.method[methodName]
+	if method == nil {
+		st := status.Newf(status.NotFound, "method %q not found in service %q", methodName, serviceName)
+		return nil, nil, st.WithDetails(availableMethods(svc.methodNames())...)
+	}
+	return svc, method, nil
+}
+
+// availableMethods lists every registered method as "Service.Method", sorted.
+// The caller must hold svr.mu.
+func (svr *Server) availableMethods() []string {
+	var names []string
+	for _, svc := range svr.serviceMap {
+		names = append(names, svc.methodNames()...)
+	}
+	sort.Strings(names)
+	return availableMethods(names)
+}
+
+// availableMethods turns sorted method names into the details of a NotFound error:
+// one method per detail, at most maxListedMethods, then how many were left out.
+func availableMethods(names []string) []string {
+	if len(names) <= maxListedMethods {
+		return names
+	}
+	return append(names[:maxListedMethods:maxListedMethods], fmt.Sprintf("... and %d more", len(names)-maxListedMethods))
+}
+
+// callStream invokes a streaming method with the stream in place of its streamed side(s).
+//
+// The reply of a client-streaming method is sent as the stream's only data frame, just
+// before the end frame — so on the client, reading a reply looks like reading any stream.
+func (svr *Server) callStream(ctx context.Context, method *methodType, svc *service, req *message.RPCMessage, st *serverStream, stream Stream) error {
+	streamv := reflect.ValueOf(&stream).Elem() // Keep the interface type for reflect.Call
+
+	switch method.kind {
+	case serverStreamMethod:
+		argv := reflect.New(method.ArgType)
+		if err := st.codec.Decode(req.Payload, argv.Interface()); err != nil {
+			return status.Errorf(status.InvalidArgument, "cannot decode args: %v", err)
+		}
+		st.closeRecv() // The args were the only input
+		return svc.Call(ctx, method, argv, streamv)
+
+	case clientStreamMethod:
+		replyv := reflect.New(method.ReplyType)
+		if err := svc.Call(ctx, method, streamv, replyv); err != nil {
+			return err
+		}
+		return stream.Send(replyv.Interface())
+
+	default: // bidiStreamMethod
+		return svc.Call(ctx, method, streamv)
+	}
+}
@@ -1,12 +1,25 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log"
+	"math"
 	"mini-rpc/codec"
+	"mini-rpc/compressor"
 	"mini-rpc/message"
+	"mini-rpc/metadata"
+	"mini-rpc/middleware"
 	"mini-rpc/protocol"
+	"mini-rpc/status"
 	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -115,3 +128,972 @@ func TestServer(t *testing.T) {
 
 	fmt.Println("Pass all the test!")
 }
+
+type CountArgs struct {
+	N int
+}
+
+type Counter struct{}
+
+// Count streams the integers 0..N-1, then reports how many it sent in the response metadata.
+func (c *Counter) Count(args *CountArgs, stream Stream) error {
+	for i := 0; i < args.N; i++ {
+		if err := stream.Send(i); err != nil {
+			return err
+		}
+	}
+	return metadata.SetResponse(stream.Context(), metadata.Pairs("sent", strconv.Itoa(args.N)))
+}
+
+// Streaming shapes, plus methods that must be skipped
+func (c *Counter) Sum(stream Stream, reply *Reply) error { return nil }
+func (c *Counter) Chat(stream Stream) error              { return nil }
+func (c *Counter) BadReply(stream Stream, reply Reply) error {
+	return nil
+}
+
+func TestRegisterStreamingMethods(t *testing.T) {
+	svc, err := NewService(&Counter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]methodKind{
+		"Count": serverStreamMethod,
+		"Sum":   clientStreamMethod,
+		"Chat":  bidiStreamMethod,
+	}
+	for name, kind := range want {
+		m := svc.method[name]
+		if m == nil {
+			t.Fatalf("Expect method %s to be registered", name)
+		}
+		if m.kind != kind {
+			t.Fatalf("Expect %s to have kind %d, got %d", name, kind, m.kind)
+		}
+	}
+	if svc.method["BadReply"] != nil {
+		t.Fatalf("Expect BadReply (non-pointer reply) to be skipped")
+	}
+}
+
+func TestServerStreamFlowControl(t *testing.T) {
+	svr := NewServer()
+	if err := svr.Register(&Counter{}); err != nil {
+		t.Fatal(err)
+	}
+	go svr.Serve("tcp", ":8889", "", nil)
+	time.Sleep(100 * time.Millisecond)
+
+	conn, err := net.Dial("tcp", ":8889")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	total := protocol.DefaultStreamWindow + 10
+	payload, _ := json.Marshal(&CountArgs{N: total})
+	cdc := codec.GetCodec(codec.CodecTypeJSON)
+	body, _ := cdc.Encode(&message.RPCMessage{ServiceMethod: "Counter.Count", Payload: payload})
+	err = protocol.Encode(conn, &protocol.Header{
+		CodecType: protocol.CodecTypeJSON,
+		MsgType:   protocol.MsgTypeStreamOpen,
+		Seq:       7,
+		BodyLen:   uint32(len(body)),
+	}, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without acks, the server must stop after one window of data frames
+	for i := 0; i < protocol.DefaultStreamWindow; i++ {
+		header, _, err := protocol.Decode(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header.MsgType != protocol.MsgTypeStreamData || header.Seq != 7 {
+			t.Fatalf("Expect data frame for seq 7, got type %d seq %d", header.MsgType, header.Seq)
+		}
+	}
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, _, err := protocol.Decode(conn); err == nil {
+		t.Fatalf("Expect the server to wait for credits, but got another frame")
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	// Granting credits resumes the stream: the remaining elements, then the end frame
+	err = protocol.Encode(conn, &protocol.Header{
+		MsgType: protocol.MsgTypeStreamAck,
+		Seq:     7,
+		BodyLen: 4,
+	}, protocol.EncodeCredits(uint32(protocol.DefaultStreamWindow)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := protocol.DefaultStreamWindow; i < total; i++ {
+		header, body, err := protocol.Decode(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header.MsgType != protocol.MsgTypeStreamData {
+			t.Fatalf("Expect data frame, got type %d", header.MsgType)
+		}
+		var msg message.RPCMessage
+		var got int
+		cdc.Decode(body, &msg)
+		json.Unmarshal(msg.Payload, &got)
+		if got != i {
+			t.Fatalf("Expect element %d, got %d", i, got)
+		}
+	}
+	header, body, err := protocol.Decode(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.MsgType != protocol.MsgTypeStreamEnd {
+		t.Fatalf("Expect end frame, got type %d", header.MsgType)
+	}
+	var end message.RPCMessage
+	cdc.Decode(body, &end)
+	if st := end.Status(); st != nil {
+		t.Fatalf("Expect OK end status, got %v", st)
+	}
+	// On a v1 connection the response metadata travels in the end frame's body
+	if end.Metadata["sent"] != strconv.Itoa(total) {
+		t.Fatalf("Expect the handler's response metadata in the end frame, got %v", end.Metadata)
+	}
+}
+
+func TestServerCompression(t *testing.T) {
+	svr := NewServer()
+	if err := svr.Register(&Arith{}); err != nil {
+		t.Fatal(err)
+	}
+	go svr.Serve("tcp", ":8890", "", nil)
+	time.Sleep(100 * time.Millisecond)
+
+	conn, err := net.Dial("tcp", ":8890")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Compression needs v2 frames: negotiate first
+	hello, helloBody := protocol.HelloFrame()
+	if err := protocol.Encode(conn, hello, helloBody); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := protocol.Decode(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	cdc := codec.GetCodec(codec.CodecTypeJSON)
+	payload, _ := json.Marshal(&Args{A: 1, B: 2})
+	body, _ := cdc.Encode(&message.RPCMessage{ServiceMethod: "Arith.Add", Payload: payload})
+	body, _ = compressor.Get(compressor.Deflate).Compress(body)
+	err = protocol.Encode(conn, &protocol.Header{
+		Version:    protocol.Version2,
+		CodecType:  protocol.CodecTypeJSON,
+		MsgType:    protocol.MsgTypeRequest,
+		Flags:      protocol.FlagCompressed,
+		Compressor: protocol.CompressorDeflate,
+		Seq:        1,
+		BodyLen:    uint32(len(body)),
+	}, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The reply uses the request's compressor (but is too small to be compressed)
+	header, body, err := protocol.Decode(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Compressor != protocol.CompressorDeflate || header.Flags&protocol.FlagCompressed != 0 {
+		t.Fatalf("Expect an uncompressed Deflate reply, got compressor %d, flags %b", header.Compressor, header.Flags)
+	}
+	var resp message.RPCMessage
+	cdc.Decode(body, &resp)
+	var reply Reply
+	if err := json.Unmarshal(resp.Payload, &reply); err != nil || reply.Result != 3 {
+		t.Fatalf("Expect 3, got %d (%v)", reply.Result, err)
+	}
+
+	// A corrupt body is answered with InvalidArgument instead of being dropped
+	corrupt := []byte{0xde, 0xad}
+	err = protocol.Encode(conn, &protocol.Header{
+		Version:    protocol.Version2,
+		CodecType:  protocol.CodecTypeJSON,
+		MsgType:    protocol.MsgTypeRequest,
+		Flags:      protocol.FlagCompressed,
+		Compressor: protocol.CompressorGzip,
+		Seq:        2,
+		BodyLen:    uint32(len(corrupt)),
+	}, corrupt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, body, err = protocol.Decode(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp = message.RPCMessage{}
+	cdc.Decode(body, &resp)
+	if st := resp.Status(); header.Seq != 2 || st == nil || st.Code != status.InvalidArgument {
+		t.Fatalf("Expect InvalidArgument for seq 2, got seq %d: %v", header.Seq, resp.Status())
+	}
+}
+
+func TestServerVersionNegotiation(t *testing.T) {
+	svr := NewServer()
+	if err := svr.Register(&Arith{}); err != nil {
+		t.Fatal(err)
+	}
+	go svr.Serve("tcp", ":8891", "", nil)
+	time.Sleep(100 * time.Millisecond)
+
+	conn, err := net.Dial("tcp", ":8891")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// The hello is answered with a hello, after which the server writes v2 frames
+	hello, helloBody := protocol.HelloFrame()
+	if err := protocol.Encode(conn, hello, helloBody); err != nil {
+		t.Fatal(err)
+	}
+	header, body, err := protocol.Decode(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if protocol.HelloVersion(header, body) != protocol.Version2 {
+		t.Fatalf("Expect a hello offering v2, got %+v %v", header, body)
+	}
+
+	cdc := codec.GetCodec(codec.CodecTypeJSON)
+	request := func(seq uint32, flags protocol.Flags) {
+		payload, _ := json.Marshal(&Args{A: 1, B: 2})
+		body, _ := cdc.Encode(&message.RPCMessage{ServiceMethod: "Arith.Add", Payload: payload})
+		err := protocol.Encode(conn, &protocol.Header{
+			Version:   protocol.Version2,
+			CodecType: protocol.CodecTypeJSON,
+			MsgType:   protocol.MsgTypeRequest,
+			Flags:     flags,
+			Seq:       seq,
+			BodyLen:   uint32(len(body)),
+		}, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A one-way request gets no response: the first frame back answers seq 2
+	request(1, protocol.FlagOneWay)
+	request(2, 0)
+	header, _, err = protocol.Decode(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Version != protocol.Version2 || header.Seq != 2 {
+		t.Fatalf("Expect a v2 response to seq 2, got v%d seq %d", header.Version, header.Seq)
+	}
+}
+
+func TestServerMaxMessageSize(t *testing.T) {
+	svr := NewServer(WithMaxRequestSize(1024), WithMaxResponseSize(16))
+	if err := svr.Register(&Arith{}); err != nil {
+		t.Fatal(err)
+	}
+	go svr.Serve("tcp", ":8892", "", nil)
+	time.Sleep(100 * time.Millisecond)
+
+	conn, err := net.Dial("tcp", ":8892")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	cdc := codec.GetCodec(codec.CodecTypeJSON)
+	expectStatus := func(seq uint32, code status.Code) {
+		header, body, err := protocol.Decode(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var resp message.RPCMessage
+		cdc.Decode(body, &resp)
+		if st := resp.Status(); header.Seq != seq || st == nil || st.Code != code {
+			t.Fatalf("Expect code %d for seq %d, got seq %d: %v", code, seq, header.Seq, resp.Status())
+		}
+	}
+
+	// A reply over the response limit is replaced with ResourceExhausted; the connection stays usable
+	payload, _ := json.Marshal(&Args{A: 1, B: 2})
+	body, _ := cdc.Encode(&message.RPCMessage{ServiceMethod: "Arith.Add", Payload: payload})
+	err = protocol.Encode(conn, &protocol.Header{
+		CodecType: protocol.CodecTypeJSON,
+		MsgType:   protocol.MsgTypeRequest,
+		Seq:       1,
+		BodyLen:   uint32(len(body)),
+	}, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(1, status.ResourceExhausted)
+
+	// A request announcing a body over the limit is answered, then the connection is closed
+	err = protocol.Encode(conn, &protocol.Header{
+		CodecType: protocol.CodecTypeJSON,
+		MsgType:   protocol.MsgTypeRequest,
+		Seq:       2,
+		BodyLen:   1 << 30,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(2, status.ResourceExhausted)
+	if _, _, err := protocol.Decode(conn); err != io.EOF {
+		t.Fatalf("Expect the server to close the connection, got %v", err)
+	}
+
+	// Limits a frame header can't express are rejected when the option is built
+	limits := []int{-1}
+	if uint64(math.MaxInt) > math.MaxUint32 {
+		limits = append(limits, math.MaxInt)
+	}
+	for _, n := range limits {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Expect WithMaxRequestSize(%d) to panic", n)
+				}
+			}()
+			WithMaxRequestSize(n)
+		}()
+	}
+}
+
+func TestServerMalformedRequest(t *testing.T) {
+	svr := NewServer()
+	if err := svr.Register(&Arith{}); err != nil {
+		t.Fatal(err)
+	}
+	go svr.Serve("tcp", ":8893", "", nil)
+	time.Sleep(100 * time.Millisecond)
+
+	conn, err := net.Dial("tcp", ":8893")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// A truncated BinaryCodec body (method length says 255 bytes, 1 follows) is answered
+	// with InvalidArgument instead of crashing the request goroutine
+	body := []byte{0x00, 0xff, 'A'}
+	err = protocol.Encode(conn, &protocol.Header{
+		CodecType: protocol.CodecTypeBinary,
+		MsgType:   protocol.MsgTypeRequest,
+		Seq:       1,
+		BodyLen:   uint32(len(body)),
+	}, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, body, err := protocol.Decode(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp message.RPCMessage
+	if err := codec.GetCodec(codec.CodecTypeBinary).Decode(body, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if st := resp.Status(); header.Seq != 1 || st == nil || st.Code != status.InvalidArgument {
+		t.Fatalf("Expect InvalidArgument for seq 1, got seq %d: %v", header.Seq, resp.Status())
+	}
+}
+
+// Faulty has a method that panics (integer divide by zero when B is 0).
+type Faulty struct{}
+
+func (f *Faulty) Div(args *Args, reply *Reply) error {
+	reply.Result = args.A / args.B
+	return nil
+}
+
+// syncWriter lets a test read what the server logged from another goroutine.
+type syncWriter struct {
+	mu  sync.Mutex
+	buf strings.Builder
+}
+
+func (w *syncWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.Write(p)
+}
+
+func (w *syncWriter) String() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.String()
+}
+
+func TestServerPanicRecovery(t *testing.T) {
+	var logs syncWriter
+	svr := NewServer(WithLogger(log.New(&logs, "", 0)))
+	if err := svr.Register(&Arith{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := svr.Register(&Faulty{}); err != nil {
+		t.Fatal(err)
+	}
+	go svr.Serve("tcp", ":8894", "", nil)
+	time.Sleep(100 * time.Millisecond)
+
+	conn, err := net.Dial("tcp", ":8894")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	cdc := codec.GetCodec(codec.CodecTypeJSON)
+	call := func(seq uint32, method string) *message.RPCMessage {
+		payload, _ := json.Marshal(&Args{A: 1, B: 0})
+		body, _ := cdc.Encode(&message.RPCMessage{ServiceMethod: method, Payload: payload})
+		err := protocol.Encode(conn, &protocol.Header{
+			CodecType: protocol.CodecTypeJSON,
+			MsgType:   protocol.MsgTypeRequest,
+			Seq:       seq,
+			BodyLen:   uint32(len(body)),
+		}, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		header, body, err := protocol.Decode(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header.Seq != seq {
+			t.Fatalf("Expect a response to seq %d, got %d", seq, header.Seq)
+		}
+		var resp message.RPCMessage
+		cdc.Decode(body, &resp)
+		return &resp
+	}
+
+	// The panic becomes an Internal status for its own call...
+	resp := call(1, "Faulty.Div")
+	if st := resp.Status(); st == nil || st.Code != status.Internal || !strings.Contains(st.Message, "divide by zero") {
+		t.Fatalf("Expect Internal with the panic message, got %v", resp.Status())
+	}
+	// The panic and its stack go to the server's logger
+	if l := logs.String(); !strings.Contains(l, "panic in Faulty.Div: runtime error: integer divide by zero") || !strings.Contains(l, "goroutine") {
+		t.Fatalf("Expect the panic with its stack in the server's log, got %q", l)
+	}
+
+	// ...and the server (and the connection) keep serving
+	resp = call(2, "Arith.Add")
+	var reply Reply
+	if err := json.Unmarshal(resp.Payload, &reply); err != nil || resp.Status() != nil || reply.Result != 1 {
+		t.Fatalf("Expect 1, got %d (%v, %v)", reply.Result, err, resp.Status())
+	}
+}
+
+func TestUnknownServiceMethod(t *testing.T) {
+	svr := NewServer()
+	if err := svr.Register(&Arith{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := svr.Register(&Faulty{}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		serviceMethod string
+		code          status.Code
+		details       []string
+	}{
+		{"A.B.C", status.InvalidArgument, nil},
+		{"Arith.Add.Extra", status.InvalidArgument, nil},
+		{"ArithAdd", status.InvalidArgument, nil},
+		{"", status.InvalidArgument, nil},
+		{".Add", status.InvalidArgument, nil},
+		{"Arith.", status.InvalidArgument, nil},
+		// Unknown service: every method of every service, sorted
+		{"Arth.Add", status.NotFound, []string{"Arith.Add", "Faulty.Div"}},
+		// Unknown method: the methods of that service
+		{"Arith.Sub", status.NotFound, []string{"Arith.Add"}},
+	} {
+		resp := svr.businessHandler(context.Background(), &message.RPCMessage{ServiceMethod: tc.serviceMethod})
+		st := resp.Status()
+		if st == nil || st.Code != tc.code {
+			t.Errorf("%q: expect code %s, got %v", tc.serviceMethod, tc.code, st)
+			continue
+		}
+		if !reflect.DeepEqual(st.Details, tc.details) {
+			t.Errorf("%q: expect details %q, got %q", tc.serviceMethod, tc.details, st.Details)
+		}
+	}
+
+	// Long lists are cut short, with a count of what was left out
+	names := make([]string, maxListedMethods+5)
+	for i := range names {
+		names[i] = fmt.Sprintf("Svc.M%d", i)
+	}
+	details := availableMethods(names)
+	if len(details) != maxListedMethods+1 || details[maxListedMethods] != "... and 5 more" {
+		t.Errorf("Expect %d methods and a count, got %q", maxListedMethods, details[maxListedMethods:])
+	}
+}
+
+// Waiter's methods take the middleware chain's ctx.
+type Waiter struct {
+	stopped chan error // Receives ctx.Err() when Wait gives up
+}
+
+// Wait blocks until its ctx is done, like a handler doing slow work that honors cancellation.
+func (w *Waiter) Wait(ctx context.Context, args *Args, reply *Reply) error {
+	<-ctx.Done()
+	w.stopped <- ctx.Err()
+	return ctx.Err()
+}
+
+// Trace echoes the "trace-id" request metadata, in the reply and in the response metadata.
+func (w *Waiter) Trace(ctx context.Context, args *Args, reply *string) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	*reply = md["trace-id"]
+	metadata.SetResponse(ctx, metadata.Pairs("echo-trace-id", md["trace-id"])) // ErrNoResponse when called directly
+	return nil
+}
+
+// Streaming shapes take a ctx too
+func (w *Waiter) Watch(ctx context.Context, args *Args, stream Stream) error { return nil }
+func (w *Waiter) Chat(ctx context.Context, stream Stream) error              { return nil }
+
+func TestContextMethods(t *testing.T) {
+	waiter := &Waiter{stopped: make(chan error, 1)}
+	svc, err := NewService(waiter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, kind := range map[string]methodKind{"Wait": unaryMethod, "Trace": unaryMethod, "Watch": serverStreamMethod, "Chat": bidiStreamMethod} {
+		if m := svc.method[name]; m == nil || m.kind != kind || !m.takesCtx {
+			t.Fatalf("Expect %s to be registered as kind %d with a ctx, got %+v", name, kind, m)
+		}
+	}
+
+	svr := NewServer()
+	if err := svr.Register(waiter); err != nil {
+		t.Fatal(err)
+	}
+	if err := svr.Register(&Arith{}); err != nil {
+		t.Fatal(err)
+	}
+	handler := middleware.Chain(middleware.TimeOutMiddleware(50 * time.Millisecond))(svr.businessHandler)
+	call := func(ctx context.Context, method string) *message.RPCMessage {
+		payload, _ := json.Marshal(&Args{A: 1, B: 2})
+		return handler(ctx, &message.RPCMessage{ServiceMethod: method, Payload: payload})
+	}
+
+	// The method sees TimeOutMiddleware's deadline and stops when it expires
+	if resp := call(context.Background(), "Waiter.Wait"); resp.Code != status.DeadlineExceeded {
+		t.Fatalf("Expect DeadlineExceeded, got %v", resp.Status())
+	}
+	select {
+	case err := <-waiter.stopped:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("Expect the method's ctx to expire, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expect the method to stop once its ctx expired")
+	}
+
+	// Request metadata reaches the method through ctx
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.MD{"trace-id": "abc"})
+	resp := call(ctx, "Waiter.Trace")
+	var trace string
+	if err := json.Unmarshal(resp.Payload, &trace); err != nil || trace != "abc" {
+		t.Fatalf("Expect trace-id abc, got %q (%v, %v)", trace, err, resp.Status())
+	}
+
+	// Methods without a ctx keep working alongside
+	resp = call(context.Background(), "Arith.Add")
+	var reply Reply
+	if err := json.Unmarshal(resp.Payload, &reply); err != nil || reply.Result != 3 {
+		t.Fatalf("Expect 3, got %d (%v, %v)", reply.Result, err, resp.Status())
+	}
+}
+
+func TestResponseMetadata(t *testing.T) {
+	svr := NewServer()
+	// Metadata put on the response by a middleware is kept, unless SetResponse set the same key
+	svr.Use(func(next middleware.HandlerFunc) middleware.HandlerFunc {
+		return func(ctx context.Context, req *message.RPCMessage) *message.RPCMessage {
+			resp := next(ctx, req)
+			resp.Metadata = metadata.Pairs("served-by", "s1", "echo-trace-id", "overridden")
+			return resp
+		}
+	})
+	if err := svr.Register(&Waiter{stopped: make(chan error, 1)}); err != nil {
+		t.Fatal(err)
+	}
+	go svr.Serve("tcp", ":8897", "", nil)
+	time.Sleep(100 * time.Millisecond)
+
+	conn, err := net.Dial("tcp", ":8897")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	cdc := codec.GetCodec(codec.CodecTypeJSON)
+	body, _ := cdc.Encode(&message.RPCMessage{
+		ServiceMethod: "Waiter.Trace",
+		Payload:       []byte(`{"A":1,"B":2}`),
+		Metadata:      metadata.Pairs("trace-id", "abc"),
+	})
+	err = protocol.Encode(conn, &protocol.Header{
+		CodecType: protocol.CodecTypeJSON,
+		MsgType:   protocol.MsgTypeRequest,
+		Seq:       1,
+		BodyLen:   uint32(len(body)),
+	}, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, body, err = protocol.Decode(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp message.RPCMessage
+	if err := cdc.Decode(body, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Metadata["echo-trace-id"] != "abc" || resp.Metadata["served-by"] != "s1" {
+		t.Fatalf("Expect the metadata set by the method and the middleware, got %v", resp.Metadata)
+	}
+
+	// On a v2 connection metadata travels in the extension area, both ways
+	conn2, err := net.Dial("tcp", ":8897")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn2.Close()
+	hello, helloBody := protocol.HelloFrame()
+	if err := protocol.Encode(conn2, hello, helloBody); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := protocol.Decode(conn2); err != nil {
+		t.Fatal(err)
+	}
+	ext, _ := protocol.EncodeExt(map[string]string{"trace-id": "xyz"})
+	body, _ = cdc.Encode(&message.RPCMessage{ServiceMethod: "Waiter.Trace", Payload: []byte(`{"A":1,"B":2}`)})
+	err = protocol.Encode(conn2, &protocol.Header{
+		Version:   protocol.Version2,
+		CodecType: protocol.CodecTypeJSON,
+		MsgType:   protocol.MsgTypeRequest,
+		Seq:       1,
+		BodyLen:   uint32(len(body)),
+		Ext:       ext,
+	}, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, body, err := protocol.Decode(conn2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp = message.RPCMessage{}
+	if err := cdc.Decode(body, &resp); err != nil {
+		t.Fatal(err)
+	}
+	var trace string
+	if err := json.Unmarshal(resp.Payload, &trace); err != nil || trace != "xyz" {
+		t.Fatalf("Expect the request metadata from the extension area, got %q (%v)", trace, err)
+	}
+	kv, err := protocol.TakeExt(header)
+	if err != nil || kv["echo-trace-id"] != "xyz" || kv["served-by"] != "s1" || resp.Metadata != nil {
+		t.Fatalf("Expect the response metadata in the extension area only, got %v and %v (%v)", kv, resp.Metadata, err)
+	}
+}
+
+func TestRegisterNameAndFunc(t *testing.T) {
+	svr := NewServer()
+
+	// Two instances of the same struct type, under different names
+	if err := svr.Register(&Arith{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := svr.RegisterName("ArithV2", &Arith{}); err != nil {
+		t.Fatal(err)
+	}
+	// Duplicates are refused instead of silently replacing the first registration
+	if err := svr.Register(&Arith{}); err == nil {
+		t.Fatal("Expect an error registering Arith twice")
+	}
+	if err := svr.RegisterName("ArithV2", &Faulty{}); err == nil {
+		t.Fatal("Expect an error registering ArithV2 twice")
+	}
+
+	// Plain functions, with and without ctx, grouped into one service
+	if err := svr.RegisterFunc("Math.Square", func(args *int, reply *int) error {
+		*reply = *args * *args
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := svr.RegisterFunc("Math.Neg", func(ctx context.Context, args *int, reply *int) error {
+		*reply = -*args
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for name, fn := range map[string]any{
+		"Math.Square":  func(args *int, reply *int) error { return nil }, // Duplicate method
+		"Arith.Square": func(args *int, reply *int) error { return nil }, // Struct services can't be extended
+		"Math.Bad":     func(args int, reply *int) error { return nil },  // Not a pointer
+		"Math.NotFunc": 42,
+		"Math":         func(args *int, reply *int) error { return nil },
+		"A.B.C":        func(args *int, reply *int) error { return nil },
+		".Square":      func(args *int, reply *int) error { return nil },
+	} {
+		if err := svr.RegisterFunc(name, fn); err == nil {
+			t.Errorf("Expect RegisterFunc(%q) to fail", name)
+		}
+	}
+	for _, name := range []string{"", "Arith.V3"} {
+		if err := svr.RegisterName(name, &Arith{}); err == nil {
+			t.Errorf("Expect RegisterName(%q) to fail", name)
+		}
+	}
+
+	call := func(method string, args any, reply any) {
+		t.Helper()
+		payload, _ := json.Marshal(args)
+		resp := svr.businessHandler(context.Background(), &message.RPCMessage{ServiceMethod: method, Payload: payload})
+		if st := resp.Status(); st != nil {
+			t.Fatalf("%s: %v", method, st)
+		}
+		if err := json.Unmarshal(resp.Payload, reply); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var reply Reply
+	call("ArithV2.Add", &Args{A: 2, B: 3}, &reply)
+	if reply.Result != 5 {
+		t.Fatalf("Expect 5, got %d", reply.Result)
+	}
+	var n int
+	if call("Math.Square", 7, &n); n != 49 {
+		t.Fatalf("Expect 49, got %d", n)
+	}
+	if call("Math.Neg", 7, &n); n != -7 {
+		t.Fatalf("Expect -7, got %d", n)
+	}
+}
+
+func TestRegisterWhileServing(t *testing.T) {
+	svr := NewServer()
+	if err := svr.Register(&Arith{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Registrations racing with lookups (run with -race)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				svr.RegisterFunc(fmt.Sprintf("Svc%d.M%d", i, j), func(args *int, reply *int) error { return nil })
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			payload, _ := json.Marshal(&Args{A: 1, B: 2})
+			for j := 0; j < 50; j++ {
+				svr.businessHandler(context.Background(), &message.RPCMessage{ServiceMethod: "Arith.Add", Payload: payload})
+				svr.businessHandler(context.Background(), &message.RPCMessage{ServiceMethod: "Svc0.M1", Payload: []byte("1")})
+			}
+		}()
+	}
+	wg.Wait()
+	if resp := svr.businessHandler(context.Background(), &message.RPCMessage{ServiceMethod: "Svc3.M49", Payload: []byte("1")}); resp.Status() != nil {
+		t.Fatalf("Expect the method registered while serving to be callable, got %v", resp.Status())
+	}
+}
+
+// Mistakes that make a method skip registration, next to one valid method
+type Sloppy struct{}
+
+func (s *Sloppy) Add(args *Args, reply *Reply) error { return nil }
+func (s *Sloppy) ByValue(args Args, reply *Reply) error {
+	return nil
+}
+func (s *Sloppy) NoError(args *Args, reply *Reply)     {}
+func (s *Sloppy) ThreeArgs(a, b, c *Args) error        { return nil }
+func (s *Sloppy) ReplyValue(args *Args, r Reply) error { return nil }
+
+// Only unexported methods and a helper: nothing to serve
+type Empty struct{}
+
+func (e *Empty) Reset()                             {}
+func (e *Empty) add(args *Args, reply *Reply) error { return nil }
+
+func TestRegisterDiagnostics(t *testing.T) {
+	svc, err := NewService(&Sloppy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(svc.method) != 1 || svc.method["Add"] == nil {
+		t.Fatalf("Expect only Add to be registered, got %v", svc.methodNames())
+	}
+	// Skipped methods are listed in method set (alphabetical) order, each with its reason
+	want := []skippedMethod{
+		{"ByValue", "args must be a pointer or a server.Stream, got server.Args"},
+		{"NoError", "must return exactly one value, of type error"},
+		{"ReplyValue", "reply must be a pointer or a server.Stream, got server.Reply"},
+		{"ThreeArgs", "has 3 parameters, want (args, reply), (args, stream), (stream, reply) or (stream), after an optional context.Context"},
+	}
+	if !reflect.DeepEqual(svc.skipped, want) {
+		t.Fatalf("Expect skipped methods %v, got %v", want, svc.skipped)
+	}
+
+	// A struct with no RPC method at all can't be registered
+	if _, err := NewService(&Empty{}); err == nil || !strings.Contains(err.Error(), "Reset: must return") {
+		t.Fatalf("Expect an error naming the skipped method, got %v", err)
+	}
+	svr := NewServer()
+	if err := svr.Register(&Empty{}); err == nil {
+		t.Fatal("Expect an error registering a service without RPC methods")
+	}
+
+	// Lenient by default: the valid methods are served
+	if err := svr.Register(&Sloppy{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Strict: any skipped method fails the registration, and nothing is registered
+	strict := NewServer(WithStrictRegistration())
+	err = strict.Register(&Sloppy{})
+	if err == nil {
+		t.Fatal("Expect strict registration of Sloppy to fail")
+	}
+	for _, m := range want {
+		if !strings.Contains(err.Error(), m.String()) {
+			t.Errorf("Expect the error to mention %q, got %v", m, err)
+		}
+	}
+	if _, _, err := strict.lookup("Sloppy", "Add"); err == nil {
+		t.Fatal("Expect Sloppy not to be registered after a failed strict registration")
+	}
+	if err := strict.RegisterName("Calc", &Arith{}); err != nil {
+		t.Fatalf("Expect a service without skipped methods to pass strict registration, got %v", err)
+	}
+
+	// RegisterFunc reports why a function doesn't fit
+	if err := strict.RegisterFunc("Math.Bad", func(args *int, reply int) error { return nil }); err == nil || !strings.Contains(err.Error(), "reply must be a pointer") {
+		t.Fatalf("Expect RegisterFunc to explain the bad reply type, got %v", err)
+	}
+}
+
+func TestServerOptions(t *testing.T) {
+	var logs strings.Builder
+	svr := NewServer(
+		WithMaxRequestSize(1024),
+		WithMaxResponseSize(2048),
+		WithLogger(log.New(&logs, "", 0)),
+	)
+	if svr.maxRequestSize != 1024 || svr.maxResponseSize != 2048 {
+		t.Fatalf("Expect the size limits from the options, got %d and %d", svr.maxRequestSize, svr.maxResponseSize)
+	}
+
+	// Skipped methods are logged through the server's logger
+	if err := svr.Register(&Sloppy{}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(logs.String(), "rpc: Sloppy.ByValue skipped: args must be a pointer") {
+		t.Fatalf("Expect the skipped methods in the server's log, got %q", logs.String())
+	}
+
+	// No options: the defaults
+	if d := NewServer(); d.maxRequestSize != protocol.DefaultMaxBodySize || d.strict || d.tlsConfig != nil || d.logger == nil {
+		t.Fatal("Expect NewServer() to use the defaults")
+	}
+}
+
+func TestServerHeartbeatAndIdleTimeout(t *testing.T) {
+	svr := NewServer(WithIdleTimeout(100 * time.Millisecond))
+	if err := svr.Register(&Waiter{stopped: make(chan error, 1)}); err != nil {
+		t.Fatal(err)
+	}
+	go svr.Serve("tcp", ":8895", "", nil)
+	time.Sleep(100 * time.Millisecond)
+
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", ":8895")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+
+	// A ping is answered with a heartbeat carrying the same Seq
+	conn := dial()
+	defer conn.Close()
+	if err := protocol.Encode(conn, &protocol.Header{MsgType: protocol.MsgTypeHeartbeat, Seq: 7}, nil); err != nil {
+		t.Fatal(err)
+	}
+	header, body, err := protocol.Decode(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.MsgType != protocol.MsgTypeHeartbeat || header.Seq != 7 || len(body) != 0 {
+		t.Fatalf("Expect a pong with Seq 7, got %+v %v", header, body)
+	}
+
+	// Pings keep a connection open past the idle timeout...
+	for i := 0; i < 5; i++ {
+		time.Sleep(50 * time.Millisecond)
+		if err := protocol.Encode(conn, &protocol.Header{MsgType: protocol.MsgTypeHeartbeat, Seq: uint32(i)}, nil); err != nil {
+			t.Fatalf("Expect the pinged connection to stay open: %v", err)
+		}
+		if _, _, err := protocol.Decode(conn); err != nil {
+			t.Fatalf("Expect a pong: %v", err)
+		}
+	}
+
+	// ...and a silent one is closed
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := protocol.Decode(conn); err != io.EOF {
+		t.Fatalf("Expect the idle connection to be closed, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("Expect the idle connection to be closed after about 100ms, took %v", elapsed)
+	}
+
+	// A connection waiting on a request is busy, not idle, however long the handler takes
+	busy := dial()
+	defer busy.Close()
+	cdc := codec.GetCodec(codec.CodecTypeJSON)
+	payload, _ := json.Marshal(&Args{})
+	reqBody, _ := cdc.Encode(&message.RPCMessage{ServiceMethod: "Waiter.Wait", Payload: payload, Timeout: 300 * time.Millisecond})
+	err = protocol.Encode(busy, &protocol.Header{
+		CodecType: protocol.CodecTypeJSON,
+		MsgType:   protocol.MsgTypeRequest,
+		Seq:       1,
+		BodyLen:   uint32(len(reqBody)),
+	}, reqBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	busy.SetReadDeadline(time.Now().Add(time.Second))
+	header, body, err = protocol.Decode(busy)
+	if err != nil {
+		t.Fatalf("Expect the response of the slow request, got %v", err)
+	}
+	var resp message.RPCMessage
+	if err := cdc.Decode(body, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if st := resp.Status(); header.Seq != 1 || st == nil || st.Code != status.DeadlineExceeded {
+		t.Fatalf("Expect DeadlineExceeded for seq 1, got seq %d: %v", header.Seq, st)
+	}
+}
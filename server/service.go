@@ -1,29 +1,63 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"reflect"
+	"sort"
+	"strings"
+)
+
+// methodKind distinguishes the call shapes a registered method supports.
+type methodKind int
+
+// Every shape may also take a context.Context as its first parameter (see RegisterMethods).
+const (
+	unaryMethod        methodKind = iota // func (args *A, reply *R) error
+	serverStreamMethod                   // func (args *A, stream Stream) error
+	clientStreamMethod                   // func (stream Stream, reply *R) error
+	bidiStreamMethod                     // func (stream Stream) error
 )
 
 // methodType stores the reflection metadata for a single RPC-compatible method.
 type methodType struct {
-	method    reflect.Method // The reflected method itself
-	ArgType   reflect.Type   // Type of the first argument (e.g., *Args → Args)
-	ReplyType reflect.Type   // Type of the second argument (e.g., *Reply → Reply)
+	fn        reflect.Value // Method expression (receiver first) or a function registered with RegisterFunc
+	kind      methodKind    // Unary or one of the streaming shapes
+	takesCtx  bool          // First parameter is a context.Context
+	ArgType   reflect.Type  // Type of the args (e.g., *Args → Args), nil if the client streams its input
+	ReplyType reflect.Type  // Type of the reply (e.g., *Reply → Reply), nil if the server streams its output
 }
 
 // service wraps a user-defined struct (e.g., &Arith{}) and its RPC-compatible methods.
 // It maps method names to their reflection metadata for dynamic dispatch.
 type service struct {
-	name   string                 // Service name, derived from struct name (e.g., "Arith")
-	rcvr   reflect.Value          // The receiver value (pointer to struct instance)
+	name   string                 // Service name: the struct name (e.g., "Arith") or the one given to RegisterName
+	rcvr   reflect.Value          // The receiver value (pointer to struct instance); invalid for function services
 	typ    reflect.Type           // The receiver type (pointer type)
 	method map[string]*methodType // Method name → reflection metadata
+
+	skipped []skippedMethod // Exported methods that don't match an RPC signature, sorted by name
+}
+
+// skippedMethod is an exported method RegisterMethods left out, and why.
+type skippedMethod struct {
+	name   string
+	reason string
+}
+
+func (m skippedMethod) String() string {
+	return m.name + ": " + m.reason
 }
 
 // NewService creates a service from a pointer to a struct.
 // It validates the receiver and scans all methods for RPC-compatible signatures.
 //
+// Exported methods that don't match a signature are skipped and recorded with the reason,
+// which Server.Register logs — a method like Add(args Args, reply *int) (args not a
+// pointer) would otherwise only show up as "method not found" at call time. A struct
+// without a single RPC method is an error.
+//
 // Example:
 //
 //	svc, err := NewService(&Arith{})
@@ -31,6 +65,9 @@ type service struct {
 //	// svc.method["Add"] == &methodType{...}
 func NewService(rcvr any) (*service, error) {
 	typ := reflect.TypeOf(rcvr)
+	if typ == nil {
+		return nil, fmt.Errorf("rpc: rcvr must be a pointer, got nil")
+	}
 
 	// Must be a pointer (methods with pointer receivers won't show up on value types)
 	if typ.Kind() != reflect.Ptr {
@@ -49,57 +86,153 @@ func NewService(rcvr any) (*service, error) {
 		method: make(map[string]*methodType),
 	}
 	srv.RegisterMethods()
+	if len(srv.method) == 0 {
+		return nil, fmt.Errorf("rpc: type %s has no exported methods of suitable type%s", srv.name, skippedSuffix(srv.skipped))
+	}
 	return srv, nil
 }
 
+// skippedSuffix formats skipped methods for an error message: " (Add: reason; Sub: reason)".
+func skippedSuffix(skipped []skippedMethod) string {
+	if len(skipped) == 0 {
+		return ""
+	}
+	reasons := make([]string, len(skipped))
+	for i, m := range skipped {
+		reasons[i] = m.String()
+	}
+	return " (" + strings.Join(reasons, "; ") + ")"
+}
+
 // errorType is used to check if a method's return type is `error`.
 var errorType = reflect.TypeOf((*error)(nil)).Elem()
 
+// contextType is used to check if a method's first parameter is a context.Context.
+var contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+
 // RegisterMethods scans all exported methods of the struct and registers those
-// that match the RPC method signature convention:
+// that match one of the RPC method signature conventions:
 //
-//	func (receiver) MethodName(args *ArgsType, reply *ReplyType) error
+//	func (receiver) MethodName(args *ArgsType, reply *ReplyType) error       // unary
+//	func (receiver) MethodName(args *ArgsType, stream server.Stream) error   // server-streaming
+//	func (receiver) MethodName(stream server.Stream, reply *ReplyType) error // client-streaming
+//	func (receiver) MethodName(stream server.Stream) error                   // bidirectional
+//
+// Each shape may also take a context.Context first, e.g.
+//
+//	func (receiver) MethodName(ctx context.Context, args *ArgsType, reply *ReplyType) error
+//
+// ctx is the one the middleware chain passes down: it carries the call's deadline (the
+// client's, or TimeOutMiddleware's), is cancelled when the caller gives up, and exposes the
+// request metadata (metadata.FromIncomingContext). A method that checks ctx.Done() can stop
+// working on a call nobody is waiting for any more.
 //
 // Requirements:
-//   - Exactly 3 input params: receiver, *Args, *Reply (both must be pointers)
+//   - Args and reply must be pointers; a stream takes the place of the side that is streamed
 //   - Exactly 1 output: error
 //
-// Methods that don't match are silently skipped.
+// Methods that don't match are skipped, and recorded with the reason in s.skipped.
 func (s *service) RegisterMethods() {
 	for i := 0; i < s.typ.NumMethod(); i++ {
 		method := s.typ.Method(i)
-
-		// Filter: must have 3 inputs (receiver + args + reply), 1 output (error)
-		if method.Type.NumIn() != 3 || method.Type.NumOut() != 1 {
+		// The method expression takes the receiver first: the signature starts at In(1)
+		mType, err := parseMethod(method.Type, 1)
+		if err != nil {
+			s.skipped = append(s.skipped, skippedMethod{name: method.Name, reason: err.Error()})
 			continue
 		}
-		// Output must be error type
-		if method.Type.Out(0) != errorType {
-			continue
-		}
-		// Both args and reply must be pointer types
-		if method.Type.In(1).Kind() != reflect.Ptr || method.Type.In(2).Kind() != reflect.Ptr {
-			continue
+		mType.fn = method.Func
+		s.method[method.Name] = mType
+	}
+}
+
+// parseMethod matches a function type against the RPC signature conventions (see
+// RegisterMethods), or explains why it doesn't match. Parameters before first (the
+// receiver of a method expression) are not part of the signature.
+func parseMethod(typ reflect.Type, first int) (*methodType, error) {
+	// Filter: must return exactly one error
+	if typ.NumOut() != 1 || typ.Out(0) != errorType {
+		return nil, errors.New("must return exactly one value, of type error")
+	}
+
+	// An optional leading ctx; the shape is decided by the parameters after it
+	mType := &methodType{}
+	if typ.NumIn() > first && typ.In(first) == contextType {
+		mType.takesCtx = true
+		first++
+	}
+	numIn := typ.NumIn() - first
+	in := func(i int) reflect.Type { return typ.In(first + i) }
+
+	switch {
+	// Bidirectional: stream only
+	case numIn == 1 && in(0) == streamType:
+		mType.kind = bidiStreamMethod
+
+	// 2 inputs: (args or stream) + (reply or stream)
+	case numIn != 2:
+		return nil, fmt.Errorf("has %d parameters, want (args, reply), (args, stream), (stream, reply) or (stream), after an optional context.Context", numIn)
+
+	// Client-streaming: the stream replaces args, reply must be a pointer
+	case in(0) == streamType:
+		if in(1).Kind() != reflect.Ptr {
+			return nil, fmt.Errorf("reply must be a pointer, got %s", in(1))
 		}
+		mType.kind = clientStreamMethod
+		mType.ReplyType = in(1).Elem() // *Reply → Reply
+
+	// Args must be a pointer type for the remaining shapes
+	case in(0).Kind() != reflect.Ptr:
+		return nil, fmt.Errorf("args must be a pointer or a server.Stream, got %s", in(0))
+
+	// Server-streaming: the stream replaces reply
+	case in(1) == streamType:
+		mType.kind = serverStreamMethod
+		mType.ArgType = in(0).Elem() // *Args → Args
 
-		// Register the method — store Elem() types (not pointer types)
+	// Unary: reply must be a pointer type too
+	case in(1).Kind() == reflect.Ptr:
+		// Store the element types (not pointer types),
 		// so we can later use reflect.New() to create instances
-		s.method[method.Name] = &methodType{
-			method:    method,
-			ArgType:   method.Type.In(1).Elem(), // *Args → Args
-			ReplyType: method.Type.In(2).Elem(), // *Reply → Reply
-		}
+		mType.kind = unaryMethod
+		mType.ArgType = in(0).Elem()   // *Args → Args
+		mType.ReplyType = in(1).Elem() // *Reply → Reply
+
+	default:
+		return nil, fmt.Errorf("reply must be a pointer or a server.Stream, got %s", in(1))
 	}
+	return mType, nil
+}
+
+// methodNames returns the service's methods as "Service.Method", sorted.
+func (s *service) methodNames() []string {
+	names := make([]string, 0, len(s.method))
+	for name := range s.method {
+		names = append(names, s.name+"."+name)
+	}
+	sort.Strings(names)
+	return names
 }
 
 // Call invokes the registered method via reflection.
 //
-//	svc.Call(method, reflect.New(ArgsType), reflect.New(ReplyType))
+//	svc.Call(ctx, method, reflect.New(ArgsType), reflect.New(ReplyType))   // unary
+//	svc.Call(ctx, method, reflect.New(ArgsType), reflect.ValueOf(stream))   // server-streaming
+//	svc.Call(ctx, method, reflect.ValueOf(stream), reflect.New(ReplyType))  // client-streaming
+//	svc.Call(ctx, method, reflect.ValueOf(stream))                          // bidirectional
 //
-// The reflect.Value args must be pointer values (created via reflect.New).
-func (s *service) Call(mType *methodType, argv, replyv reflect.Value) error {
-	args := [3]reflect.Value{s.rcvr, argv, replyv}
-	results := mType.method.Func.Call(args[:])
+// The reflect.Value args must be pointer values (created via reflect.New), or the Stream.
+// ctx is passed to methods that take one, and ignored for the others.
+func (s *service) Call(ctx context.Context, mType *methodType, argv ...reflect.Value) error {
+	args := make([]reflect.Value, 0, 2+len(argv))
+	if s.rcvr.IsValid() {
+		args = append(args, s.rcvr) // Struct method: the receiver comes first
+	}
+	if mType.takesCtx {
+		args = append(args, reflect.ValueOf(&ctx).Elem()) // Keep the interface type, like the stream
+	}
+	args = append(args, argv...)
+	results := mType.fn.Call(args)
 
 	// Check if the returned error is non-nil
 	if !results[0].IsNil() {
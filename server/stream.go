@@ -0,0 +1,282 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"mini-rpc/codec"
+	"mini-rpc/compressor"
+	"mini-rpc/message"
+	"mini-rpc/protocol"
+	"mini-rpc/status"
+	"reflect"
+	"sync"
+)
+
+// Stream is the server side of a streaming RPC. Which directions are used depends on the
+// method's shape (see RegisterMethods):
+//
+//	// Server-streaming: large or open-ended results, sent incrementally
+//	func (s *Logs) Tail(args *TailArgs, stream server.Stream) error {
+//	    for _, line := range s.lines(args) {
+//	        if err := stream.Send(&Line{Text: line}); err != nil {
+//	            return err // client went away, or the deadline expired
+//	        }
+//	    }
+//	    return nil // → end-of-stream frame with an OK status
+//	}
+//
+//	// Client-streaming: uploads, Recv until io.EOF (the client's CloseSend)
+//	func (s *Files) Upload(stream server.Stream, reply *UploadReply) error
+//
+//	// Bidirectional: Send and Recv freely, e.g. from two goroutines
+//	func (s *Chat) Connect(stream server.Stream) error
+//
+// Both directions are flow-controlled: Send blocks when the client hasn't acknowledged
+// enough elements, and the client's Send blocks while the handler isn't calling Recv.
+type Stream interface {
+	// Context returns the stream's context: it carries the request deadline and metadata,
+	// and is cancelled when the stream ends, the client cancels it, or the connection breaks.
+	Context() context.Context
+
+	// Send serializes v and sends it to the client as one stream element.
+	Send(v any) error
+
+	// Recv unmarshals the next element sent by the client into v. It returns io.EOF once
+	// the client has half-closed the stream (Client side: CloseSend). For server-streaming
+	// methods, whose only input is args, Recv returns io.EOF right away.
+	//
+	// Recv must not be called concurrently from multiple goroutines, but may run
+	// concurrently with Send.
+	Recv(v any) error
+}
+
+// streamType is used to recognize streaming method signatures during registration.
+var streamType = reflect.TypeOf((*Stream)(nil)).Elem()
+
+// streamKey is the context key under which handleStream passes the stream to businessHandler.
+type streamKey struct{}
+
+// serverStream is the per-stream state shared between the read loop (credits, client data)
+// and the handler goroutine (Send, Recv).
+type serverStream struct {
+	sc         *serverConn
+	seq        uint32 // Seq of the StreamOpen frame — used as the stream ID for every frame
+	codecType  byte
+	codec      codec.Codec        // Codec of the open frame, used for every frame and element
+	compressor compressor.Type    // Compressor of the open frame, used for every data and end frame
+	window     *protocol.Window   // Send credits granted by the client
+	cancel     context.CancelFunc // Cancels the handler's ctx (stream end, client cancel or connection close)
+
+	mu    sync.Mutex // Orders data frames before the end frame
+	ended bool       // Set once MsgTypeStreamEnd has been written; later Sends fail
+
+	// Receive side: filled by the read loop, drained by Recv
+	recvQueue chan streamElem // Zero entry = client half-close
+	consumed  int             // Elements received since the last ack (only touched by Recv)
+	recvErr   error           // Sticky: io.EOF after half-close
+}
+
+// streamElem is a client data frame queued for Recv: the decoded message and the frame body
+// it may alias, released once the element is unmarshalled.
+type streamElem struct {
+	msg  *message.RPCMessage
+	body []byte
+}
+
+// send writes one data frame, waiting for a flow-control credit first.
+func (st *serverStream) send(ctx context.Context, v any) error {
+	payload, err := st.codec.Encode(v)
+	if err != nil {
+		return status.Errorf(status.Internal, "cannot encode stream element: %v", err)
+	}
+	body, err := st.codec.Encode(&message.RPCMessage{Payload: payload})
+	if err != nil {
+		return status.Errorf(status.Internal, "cannot encode stream element: %v", err)
+	}
+
+	// Block here (not in the read loop) when the client is slow — only this stream waits
+	if err := st.window.Acquire(ctx); err != nil {
+		if errors.Is(err, protocol.ErrWindowClosed) {
+			return status.Error(status.Canceled, "stream closed")
+		}
+		return status.FromError(err)
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.ended {
+		return status.Error(status.Canceled, "stream closed")
+	}
+	err = st.sc.writeCompressed(&protocol.Header{
+		CodecType: st.codecType,
+		MsgType:   protocol.MsgTypeStreamData,
+		Seq:       st.seq,
+	}, body, st.compressor)
+	if err != nil {
+		st.window.Grant(1) // Nothing reached the client (e.g., element over the size limit): keep the credit
+	}
+	return err
+}
+
+// recv waits for the next element from the client and unmarshals it into v.
+func (st *serverStream) recv(ctx context.Context, v any) error {
+	if st.recvErr != nil {
+		return st.recvErr
+	}
+
+	var elem streamElem
+	select {
+	case elem = <-st.recvQueue:
+	case <-ctx.Done():
+		return status.FromError(ctx.Err())
+	}
+	if elem.msg == nil {
+		st.recvErr = io.EOF
+		return st.recvErr
+	}
+
+	// Return credits in batches of half a window, like the client does for server → client data
+	st.consumed++
+	if st.consumed >= protocol.DefaultStreamWindow/2 {
+		st.sc.writeFrame(&protocol.Header{
+			CodecType: st.codecType,
+			MsgType:   protocol.MsgTypeStreamAck,
+			Seq:       st.seq,
+			BodyLen:   4,
+		}, protocol.EncodeCredits(uint32(st.consumed)))
+		st.consumed = 0
+	}
+
+	err := st.codec.Decode(elem.msg.Payload, v)
+	protocol.ReleaseBody(elem.body) // v holds its own copy now
+	if err != nil {
+		return status.Errorf(status.InvalidArgument, "cannot decode stream element: %v", err)
+	}
+	return nil
+}
+
+// closeRecv marks the receive side as finished before the handler runs
+// (server-streaming methods get their only input from the open frame).
+func (st *serverStream) closeRecv() {
+	st.recvErr = io.EOF
+}
+
+// deliver is called by the connection's read loop for every client data/end frame.
+// It must not block: the client may only have DefaultStreamWindow data frames in flight,
+// so a full queue means the client ignored flow control and the stream is cancelled.
+func (st *serverStream) deliver(elem streamElem) {
+	select {
+	case st.recvQueue <- elem:
+	default:
+		protocol.ReleaseBody(elem.body)
+		st.sc.logger.Printf("Stream %d: client exceeded flow-control window, cancelling", st.seq)
+		st.cancel()
+	}
+}
+
+// end writes the end-of-stream frame carrying the final status and the response metadata
+// (the client's Trailer), then closes the window so any Send still blocked on credits returns.
+func (st *serverStream) end(result *message.RPCMessage) {
+	header := &protocol.Header{
+		CodecType: st.codecType,
+		MsgType:   protocol.MsgTypeStreamEnd,
+		Flags:     protocol.FlagStreamEnd,
+		Seq:       st.seq,
+	}
+	if result.Error != "" {
+		header.Flags |= protocol.FlagError
+	}
+	if ext, ok := protocol.ExtFor(byte(st.sc.version.Load()), result.Metadata); ok {
+		header.Ext = ext
+		end := *result // Same as handleRequest: the metadata goes in the extension area only
+		end.Metadata = nil
+		result = &end
+	}
+
+	body, err := st.codec.Encode(result)
+	if err != nil {
+		st.sc.logger.Println("Failed to encode stream end")
+		header.Ext, header.Flags = nil, header.Flags|protocol.FlagError
+		body, _ = st.codec.Encode(message.NewErrorMessage(status.Error(status.Internal, "cannot encode stream end")))
+	}
+
+	st.mu.Lock()
+	st.ended = true
+	err = st.sc.writeCompressed(header, body, st.compressor)
+	st.mu.Unlock()
+	if err != nil {
+		st.sc.logger.Println("Failed to write stream end")
+	}
+
+	st.window.Close()
+}
+
+// streamView is what the handler sees as its Stream: the shared serverStream plus the
+// ctx produced by the middleware chain (e.g., with TimeOutMiddleware's deadline applied).
+type streamView struct {
+	st  *serverStream
+	ctx context.Context
+}
+
+func (v *streamView) Context() context.Context { return v.ctx }
+func (v *streamView) Send(msg any) error       { return v.st.send(v.ctx, msg) }
+func (v *streamView) Recv(msg any) error       { return v.st.recv(v.ctx, msg) }
+
+// openStream registers a new stream on the connection. It runs on the read loop, before the
+// handler goroutine starts, so client frames that immediately follow the open frame
+// (data, half-close, cancel) already find the stream.
+//
+// The returned ctx is cancelled by the stream's cancel func; handleStream derives the
+// handler's ctx from it.
+func (sc *serverConn) openStream(header *protocol.Header) (*serverStream, context.Context) {
+	ctx, cancel := context.WithCancel(context.Background())
+	st := &serverStream{
+		sc:         sc,
+		seq:        header.Seq,
+		codecType:  header.CodecType,
+		codec:      codec.GetCodec(codec.CodecType(header.CodecType)),
+		compressor: compressor.Type(header.Compressor),
+		window:     protocol.NewWindow(protocol.DefaultStreamWindow),
+		cancel:     cancel,
+		recvQueue:  make(chan streamElem, protocol.DefaultStreamWindow+1), // Window + half-close
+	}
+	sc.streams.Store(header.Seq, st)
+	return st, ctx
+}
+
+// handleStream processes a MsgTypeStreamOpen frame: decode → middleware → streaming method → end frame.
+//
+// The stream goes through the same middleware chain as unary calls (logging, rate limiting,
+// timeouts apply unchanged); the handler's return value becomes the end-of-stream status.
+// ext is the metadata the open frame carried in its extension area, as for handleRequest.
+func (svr *Server) handleStream(streamCtx context.Context, ext map[string]string, body []byte, st *serverStream) {
+	svr.wg.Add(1)
+	defer svr.wg.Done()
+	defer st.sc.active.Add(-1) // Added by handleConn
+	defer st.sc.streams.Delete(st.seq)
+	defer st.cancel()
+
+	// Step 1: Decode the open frame — it carries the method name (and args, for server-streaming)
+	msg := message.RPCMessage{}
+	defer protocol.ReleaseBody(body) // msg may alias it (see handleRequest)
+	if err := st.codec.Decode(body, &msg); err != nil {
+		st.end(message.NewErrorMessage(status.Errorf(status.InvalidArgument, "cannot decode stream open frame: %v", err)))
+		return
+	}
+	msg.AddMetadata(ext)
+
+	// Step 2: Build the stream's ctx (deadline, metadata)
+	ctx, cancel := requestContext(streamCtx, st.codecType, &msg)
+	defer cancel()
+
+	// Step 3: Middleware chain → businessHandler, which finds the stream in ctx
+	result := svr.handler(context.WithValue(ctx, streamKey{}, st), &msg)
+
+	// Step 4: Report the final status to the client
+	// Elements (including a client-streaming reply) were already sent as data frames.
+	// Copy rather than clear result.Payload: a middleware may return the same message for many calls.
+	end := *withResponseMetadata(ctx, result) // Metadata set with metadata.SetResponse
+	end.Payload = nil
+	st.end(&end)
+}
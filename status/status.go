@@ -0,0 +1,158 @@
+// Package status defines the structured error model of mini-RPC.
+//
+// Instead of a free-form error string, every failed call carries a Status on the wire:
+//
+//	Code     — a canonical error code (NotFound, Unavailable, ...), safe to branch on
+//	Message  — a human-readable description, for logs and people
+//	Details  — optional extra context (e.g., the list of valid method names)
+//
+// Handlers return coded errors with status.Errorf; clients inspect them with errors.As
+// (or the CodeOf shortcut) instead of matching on error strings:
+//
+//	// server
+//	return status.Errorf(status.NotFound, "user %d not found", id)
+//
+//	// client
+//	var st *status.Status
+//	if errors.As(err, &st) && st.Code == status.NotFound { ... }
+//
+// The numeric values match gRPC's codes, so mixed-language deployments agree on meaning.
+package status
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Code is a canonical error code, stored as 4 bytes on the wire.
+type Code uint32
+
+const (
+	OK                 Code = 0  // Not an error; returned on success
+	Canceled           Code = 1  // The operation was cancelled, typically by the caller
+	Unknown            Code = 2  // Unknown error, e.g., a plain Go error returned by a handler
+	InvalidArgument    Code = 3  // The client specified an invalid argument (bad format, undecodable args)
+	DeadlineExceeded   Code = 4  // The deadline expired before the operation could complete
+	NotFound           Code = 5  // Some requested entity (service, method, resource) was not found
+	AlreadyExists      Code = 6  // The entity that a client attempted to create already exists
+	PermissionDenied   Code = 7  // The caller does not have permission to execute the operation
+	ResourceExhausted  Code = 8  // Some resource has been exhausted (rate limit, quota, message size)
+	FailedPrecondition Code = 9  // The system is not in a state required for the operation
+	Aborted            Code = 10 // The operation was aborted (e.g., concurrency conflict)
+	OutOfRange         Code = 11 // The operation was attempted past the valid range
+	Unimplemented      Code = 12 // The operation is not implemented or not supported
+	Internal           Code = 13 // Internal error — an invariant of the system has been broken
+	Unavailable        Code = 14 // The service is currently unavailable; usually safe to retry
+	DataLoss           Code = 15 // Unrecoverable data loss or corruption
+	Unauthenticated    Code = 16 // The request does not have valid authentication credentials
+)
+
+var codeNames = [...]string{
+	OK:                 "OK",
+	Canceled:           "Canceled",
+	Unknown:            "Unknown",
+	InvalidArgument:    "InvalidArgument",
+	DeadlineExceeded:   "DeadlineExceeded",
+	NotFound:           "NotFound",
+	AlreadyExists:      "AlreadyExists",
+	PermissionDenied:   "PermissionDenied",
+	ResourceExhausted:  "ResourceExhausted",
+	FailedPrecondition: "FailedPrecondition",
+	Aborted:            "Aborted",
+	OutOfRange:         "OutOfRange",
+	Unimplemented:      "Unimplemented",
+	Internal:           "Internal",
+	Unavailable:        "Unavailable",
+	DataLoss:           "DataLoss",
+	Unauthenticated:    "Unauthenticated",
+}
+
+func (c Code) String() string {
+	if int(c) < len(codeNames) {
+		return codeNames[c]
+	}
+	return fmt.Sprintf("Code(%d)", uint32(c))
+}
+
+// Status is a structured RPC error. *Status implements the error interface,
+// so it can be returned from handlers and matched with errors.As on the client.
+type Status struct {
+	Code    Code     // Canonical error code
+	Message string   // Human-readable description
+	Details []string // Optional extra context, nil if none
+}
+
+// New returns a Status with the given code and message.
+func New(code Code, msg string) *Status {
+	return &Status{Code: code, Message: msg}
+}
+
+// Newf is like New but formats the message with fmt.Sprintf.
+func Newf(code Code, format string, a ...any) *Status {
+	return New(code, fmt.Sprintf(format, a...))
+}
+
+// Error returns an error with the given code and message, or nil if code is OK.
+func Error(code Code, msg string) error {
+	return New(code, msg).Err()
+}
+
+// Errorf is like Error but formats the message with fmt.Sprintf.
+func Errorf(code Code, format string, a ...any) error {
+	return Newf(code, format, a...).Err()
+}
+
+// Error implements the error interface, formatted like gRPC for familiarity:
+//
+//	rpc error: code = NotFound desc = service "Arith" not found
+func (s *Status) Error() string {
+	return fmt.Sprintf("rpc error: code = %s desc = %s", s.Code, s.Message)
+}
+
+// Err returns s as an error, or nil if s is nil or its code is OK.
+// Avoids the classic typed-nil trap of returning a nil *Status as a non-nil error.
+func (s *Status) Err() error {
+	if s == nil || s.Code == OK {
+		return nil
+	}
+	return s
+}
+
+// WithDetails returns a copy of s with details appended. s itself is not modified.
+func (s *Status) WithDetails(details ...string) *Status {
+	cp := *s
+	cp.Details = append(append([]string(nil), s.Details...), details...)
+	return &cp
+}
+
+// FromError converts any error into a Status:
+//   - nil                          → nil
+//   - an error wrapping a *Status  → that Status
+//   - context.DeadlineExceeded     → DeadlineExceeded
+//   - context.Canceled             → Canceled
+//   - anything else                → Unknown, with err.Error() as the message
+func FromError(err error) *Status {
+	if err == nil {
+		return nil
+	}
+	var st *Status
+	if errors.As(err, &st) {
+		return st
+	}
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return New(DeadlineExceeded, err.Error())
+	case errors.Is(err, context.Canceled):
+		return New(Canceled, err.Error())
+	}
+	return New(Unknown, err.Error())
+}
+
+// CodeOf returns the code of err: OK for nil, Unknown for errors without a Status.
+func CodeOf(err error) Code {
+	if err == nil {
+		return OK
+	}
+	return FromError(err).Code
+}
@@ -0,0 +1,68 @@
+package status
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestErrorsAs(t *testing.T) {
+	err := fmt.Errorf("wrapped: %w", Errorf(NotFound, "user %d not found", 42))
+
+	var st *Status
+	if !errors.As(err, &st) {
+		t.Fatal("expect errors.As to find *Status")
+	}
+	if st.Code != NotFound || st.Message != "user 42 not found" {
+		t.Fatalf("unexpected status: %+v", st)
+	}
+	if CodeOf(err) != NotFound {
+		t.Fatalf("expect NotFound, got %s", CodeOf(err))
+	}
+}
+
+func TestErrOK(t *testing.T) {
+	if err := Error(OK, "fine"); err != nil {
+		t.Fatalf("expect nil error for OK, got %v", err)
+	}
+	var st *Status
+	if st.Err() != nil {
+		t.Fatal("expect nil error for nil *Status")
+	}
+	if CodeOf(nil) != OK {
+		t.Fatal("expect OK for nil error")
+	}
+}
+
+func TestFromError(t *testing.T) {
+	cases := []struct {
+		err  error
+		want Code
+	}{
+		{context.DeadlineExceeded, DeadlineExceeded},
+		{fmt.Errorf("call: %w", context.Canceled), Canceled},
+		{errors.New("boom"), Unknown},
+		{New(Unavailable, "down"), Unavailable},
+	}
+	for _, tc := range cases {
+		if got := FromError(tc.err).Code; got != tc.want {
+			t.Errorf("FromError(%v): expect %s, got %s", tc.err, tc.want, got)
+		}
+	}
+}
+
+func TestWithDetails(t *testing.T) {
+	base := New(NotFound, "method not found")
+	st := base.WithDetails("Add", "Multiply")
+
+	if len(st.Details) != 2 || st.Details[0] != "Add" {
+		t.Fatalf("unexpected details: %v", st.Details)
+	}
+	if base.Details != nil {
+		t.Fatal("WithDetails must not modify the original Status")
+	}
+	if st.Error() != "rpc error: code = NotFound desc = method not found" {
+		t.Fatalf("unexpected error string: %s", st.Error())
+	}
+}
@@ -1,10 +1,12 @@
 package test
 
 import (
+	"bytes"
 	"mini-rpc/client"
 	"mini-rpc/codec"
 	"mini-rpc/loadbalance"
 	"mini-rpc/message"
+	"mini-rpc/protocol"
 	"mini-rpc/registry"
 	"mini-rpc/server"
 	"testing"
@@ -165,3 +167,51 @@ func BenchmarkCodecBinary(b *testing.B) {
 		cdc.Decode(data, &out)
 	}
 }
+
+// 场景6: 帧编解码（不走网络）— body 来自缓冲池，用完归还，稳态下 0 次分配
+func BenchmarkFrameEncodeDecode(b *testing.B) {
+	body := bytes.Repeat([]byte{'x'}, 256)
+	h := &protocol.Header{Version: protocol.Version2, MsgType: protocol.MsgTypeRequest, Seq: 1, BodyLen: uint32(len(body))}
+	var buf bytes.Buffer
+	r := bytes.NewReader(nil)
+	var decoded protocol.Header
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		if err := protocol.Encode(&buf, h, body); err != nil {
+			b.Fatal(err)
+		}
+		r.Reset(buf.Bytes())
+		out, err := protocol.DecodeInto(r, &decoded, protocol.DefaultMaxBodySize)
+		if err != nil {
+			b.Fatal(err)
+		}
+		protocol.ReleaseBody(out)
+	}
+}
+
+// 场景7: 高并发（每核 16 个 goroutine）共享一个连接 — 写合并：排队的帧由写协程一次 writev 发出
+func BenchmarkParallelCall(b *testing.B) {
+	svr, _ := setupServerAndClient(b, "127.0.0.1:29094")
+	b.Cleanup(func() { svr.Shutdown(3 * time.Second) })
+
+	reg := NewMockRegistry()
+	reg.Register("Arith", registry.ServiceInstance{Addr: "127.0.0.1:29094"}, 10)
+	cli := client.NewClient(reg, &loadbalance.RoundRobinBalancer{}, byte(codec.CodecTypeBinary), 1)
+
+	b.ReportAllocs()
+	b.SetParallelism(16)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		args := &Args{A: 1, B: 2}
+		reply := &Reply{}
+		for pb.Next() {
+			if err := cli.Call("Arith.Add", args, reply); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
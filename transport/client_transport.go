@@ -9,93 +9,301 @@
 //	goroutine-3 ──Send(seq=3)──┘
 //
 //	recvLoop:  ←── response(seq=2) → pending[2] chan ← response → goroutine-2 wakes up
+//
+// Streams (see stream.go) reuse the same idea: the Seq of the StreamOpen frame becomes the
+// stream ID, and recvLoop routes every data/end/ack frame with that Seq to the stream.
 package transport
 
 import (
-	"encoding/json"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
 	"mini-rpc/codec"
+	"mini-rpc/compressor"
 	"mini-rpc/message"
+	"mini-rpc/metadata"
 	"mini-rpc/protocol"
+	"mini-rpc/status"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // ClientTransport manages a single multiplexed TCP connection.
 type ClientTransport struct {
-	conn    net.Conn        // Underlying TCP connection
-	codec   codec.CodecType // Serialization format for this transport
-	seq     uint32          // Monotonically increasing sequence number (protected by sending mutex)
-	pending sync.Map        // map[uint32]chan *message.RPCMessage — each request waits on its own channel
-	sending sync.Mutex      // Write lock — multiple goroutines share one conn, writes must be serialized
-	//                        to prevent frame interleaving (req A's header + req B's body = corruption)
+	conn    net.Conn              // Underlying TCP connection
+	codec   codec.CodecType       // Serialization format for this transport
+	seq     uint32                // Monotonically increasing sequence number (atomic)
+	pending sync.Map              // map[uint32]ResponseHandler — each request registers its own completion callback
+	streams sync.Map              // map[uint32]*ClientStream — open streams, keyed by the Seq of their open frame
+	writer  *protocol.FrameWriter // Writer goroutine — every frame goes through it, so frames never
+	//                              interleave (req A's header + req B's body = corruption)
+	hello   sync.Once     // Sends the version negotiation frame ahead of the first frame
+	version atomic.Uint32 // Frame format for writes: v1 until the server answers our hello
+
+	maxRequestSize  atomic.Uint32 // Largest request body sent (after compression)
+	maxResponseSize atomic.Uint32 // Largest response body accepted, compressed or not
+
+	done    chan struct{} // Closed when recvLoop exits: the connection is broken for good
+	err     error         // Why recvLoop exited; written before done is closed
+	closing atomic.Bool   // Set by Close: recvLoop's read error is ours, not the peer's
+
+	heartbeatInterval time.Duration // Period of heartbeatLoop, 0 = no heartbeats
+	heartbeatMisses   int           // Unanswered pings in a row that tear the connection down, 0 = never
+	frames            atomic.Uint64 // Frames received so far — any frame proves the server is alive
+	pongs             atomic.Bool   // The server answers pings (an older server doesn't)
+	deadPeer          atomic.Bool   // Set by heartbeatLoop before it closes the connection
+	logger            *log.Logger
 }
 
-// NewClientTransport creates a transport for the given connection and starts two background goroutines:
+// ErrClientClosed is the error of every call and stream cut short by Close, and of every
+// call made after it.
+var ErrClientClosed = errors.New("client closed")
+
+// ErrHeartbeatTimeout is why a transport breaks when the server stops answering heartbeats
+// (see WithHeartbeatMisses).
+var ErrHeartbeatTimeout = errors.New("heartbeat timeout: the server stopped answering")
+
+// ResponseHandler is called exactly once with the response for a request sent via SendAsync
+// (or with an error message if the connection breaks first).
+//
+// It runs on the recvLoop goroutine, so it must not block — otherwise every other
+// response on this connection would be delayed behind it. resp is only valid during the
+// call: its payload may point into a pooled frame body, recycled once the handler returns.
+type ResponseHandler func(resp *message.RPCMessage)
+
+// NewClientTransport creates a transport for the given connection, configured by opts (see
+// Option), and starts three background goroutines:
 //   - recvLoop: continuously reads responses from the connection and dispatches to pending callers
-//   - heartbeatLoop: sends periodic heartbeat frames to detect dead connections
-func NewClientTransport(conn net.Conn, codec codec.CodecType) *ClientTransport {
+//   - heartbeatLoop: sends periodic heartbeat frames to detect dead connections (unless turned off)
+//   - the frame writer (protocol.FrameWriter): batches concurrent writes into one syscall
+//
+// The connection starts on the v1 frame format. The first frame written offers v2 to the
+// server (see protocol.HelloFrame); once a v2 server agrees, writes switch to v2. Until
+// then frames go out uncompressed, whatever compressor the call asked for.
+func NewClientTransport(conn net.Conn, codec codec.CodecType, opts ...Option) *ClientTransport {
 	transport := &ClientTransport{
-		conn:  conn,
-		codec: codec,
+		conn:              conn,
+		codec:             codec,
+		writer:            protocol.NewFrameWriter(conn),
+		done:              make(chan struct{}),
+		heartbeatInterval: DefaultHeartbeatInterval,
+		heartbeatMisses:   DefaultHeartbeatMisses,
+		logger:            log.Default(),
+	}
+	transport.version.Store(uint32(protocol.Version))
+	transport.maxRequestSize.Store(protocol.DefaultMaxBodySize)
+	transport.maxResponseSize.Store(protocol.DefaultMaxBodySize)
+	for _, opt := range opts {
+		opt(transport)
 	}
 	go transport.recvLoop()
-	go transport.heartbeatLoop(30 * time.Second)
+	if transport.heartbeatInterval > 0 {
+		go transport.heartbeatLoop(transport.heartbeatInterval)
+	}
 	return transport
 }
 
+// SetMaxRequestSize sets the largest request body, in bytes, the transport sends (after
+// compression, stream elements included). Defaults to protocol.DefaultMaxBodySize.
+// Larger requests fail with a ResourceExhausted status without anything being sent.
+//
+// It panics if n is negative or over math.MaxUint32.
+func (t *ClientTransport) SetMaxRequestSize(n int) {
+	t.maxRequestSize.Store(sizeLimit("SetMaxRequestSize", n))
+}
+
+// SetMaxResponseSize sets the largest response body, in bytes, the transport accepts — both
+// on the wire and after decompression. Defaults to protocol.DefaultMaxBodySize.
+//
+// A frame announcing a larger body fails its call with a ResourceExhausted status, and the
+// connection is closed (every other call fails with Unavailable): the body is never read,
+// so the byte stream can't be resynchronized. A compressed body that inflates past the limit
+// only fails its own call.
+//
+// It panics if n is negative or over math.MaxUint32.
+func (t *ClientTransport) SetMaxResponseSize(n int) {
+	t.maxResponseSize.Store(sizeLimit("SetMaxResponseSize", n))
+}
+
 // Send serializes and sends an RPC request over the connection.
 // Returns the sequence number and a channel that will receive the response.
-//
-// Thread safety: the sending mutex ensures that the entire frame (header + body)
-// is written atomically. Without this lock, concurrent writes would interleave
-// bytes from different requests, corrupting the TCP stream.
 func (t *ClientTransport) Send(serviceMethod string, args any) (uint32, <-chan *message.RPCMessage, error) {
-	t.sending.Lock()
-	defer t.sending.Unlock()
-
-	// Assign a unique sequence number for this request (protected by sending mutex)
-	t.seq++
-	seq := t.seq
+	return t.SendContext(context.Background(), serviceMethod, args)
+}
 
-	// Step 1: Serialize args to JSON bytes
-	payload, err := json.Marshal(args)
+// SendContext is like Send, but also propagates ctx's deadline and outgoing metadata
+// (metadata.NewOutgoingContext) to the server, and compresses the request with the
+// compressor chosen by compressor.NewContext, if any. The server answers with the same one.
+//
+// The remaining time (not the absolute deadline) is carried in RPCMessage.Timeout, so the
+// server can rebuild an equivalent deadline without depending on synchronized clocks.
+// If ctx is already done, nothing is sent and ctx.Err() is returned.
+//
+// SendContext does not wait for the response; callers that stop waiting (e.g., on
+// cancellation) should call Cancel(seq) so the pending entry doesn't leak.
+func (t *ClientTransport) SendContext(ctx context.Context, serviceMethod string, args any) (uint32, <-chan *message.RPCMessage, error) {
+	respChan := make(chan *message.RPCMessage, 1) // Buffered to prevent recvLoop from blocking
+	seq, err := t.SendAsync(ctx, serviceMethod, args, func(resp *message.RPCMessage) {
+		resp.Payload = bytes.Clone(resp.Payload) // Outlives the handler (see ResponseHandler)
+		respChan <- resp
+	})
 	if err != nil {
 		return 0, nil, err
 	}
+	return seq, respChan, nil
+}
 
-	// Step 2: Wrap in RPCMessage and encode with the configured codec
-	rpcMessage := message.RPCMessage{
-		ServiceMethod: serviceMethod,
-		Error:         "",
-		Payload:       payload,
+// SendAsync sends an RPC request and registers onResponse to be invoked by recvLoop when
+// the matching response arrives. Unlike SendContext, no channel or goroutine is needed per call,
+// which makes it the building block for fire-many-collect-later APIs (Client.Go).
+func (t *ClientTransport) SendAsync(ctx context.Context, serviceMethod string, args any, onResponse ResponseHandler) (uint32, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
 	}
-	cdc := codec.GetCodec(t.codec)
-	body, err := cdc.Encode(&rpcMessage)
-	if err != nil {
-		return 0, nil, err
+	if err := t.Err(); err != nil {
+		return 0, err
 	}
 
-	// Step 3: Build the protocol frame header
-	header := protocol.Header{
+	// Step 1: Serialize args and wrap them in an RPCMessage encoded with the configured codec
+	header := &protocol.Header{
 		CodecType: byte(t.codec),
 		MsgType:   protocol.MsgTypeRequest,
-		Seq:       seq,
-		BodyLen:   uint32(len(body)),
+	}
+	body, err := t.encodeRequest(ctx, header, serviceMethod, args)
+	if err != nil {
+		return 0, err
 	}
 
-	// Step 4: Register a response channel BEFORE sending (avoid race with recvLoop)
-	respChan := make(chan *message.RPCMessage, 1) // Buffered to prevent recvLoop from blocking
-	t.pending.Store(seq, respChan)
+	// Step 2: Assign a unique sequence number for this request
+	seq := atomic.AddUint32(&t.seq, 1)
+	header.Seq = seq
 
-	// Step 5: Write the frame to the TCP connection
-	err = protocol.Encode(t.conn, &header, body)
+	// Step 3: Register the response handler BEFORE sending (avoid race with recvLoop)
+	t.pending.Store(seq, onResponse)
+
+	// Step 4: Write the frame to the TCP connection, compressed as ctx asks
+	ct, _ := compressor.FromContext(ctx)
+	err = t.writeCompressed(header, body, ct)
 	if err != nil {
 		t.pending.Delete(seq) // Clean up on failure
-		return 0, nil, err
+		return 0, err
 	}
 
-	return seq, respChan, nil
+	return seq, nil
+}
+
+// SendOneWay sends a request that expects no response (protocol.FlagOneWay): nothing is
+// registered in pending, and the server runs the handler without writing anything back.
+// It returns once the request is written, so the caller learns nothing about the outcome.
+//
+// On a v1 connection the flag can't be sent; the server then replies as usual, and
+// recvLoop drops the response since no one is waiting for it.
+func (t *ClientTransport) SendOneWay(ctx context.Context, serviceMethod string, args any) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	header := &protocol.Header{
+		CodecType: byte(t.codec),
+		MsgType:   protocol.MsgTypeRequest,
+		Flags:     protocol.FlagOneWay,
+	}
+	body, err := t.encodeRequest(ctx, header, serviceMethod, args)
+	if err != nil {
+		return err
+	}
+	header.Seq = atomic.AddUint32(&t.seq, 1)
+	ct, _ := compressor.FromContext(ctx)
+	return t.writeCompressed(header, body, ct)
+}
+
+// encodeRequest serializes args, wraps them in an RPCMessage together with ctx's deadline
+// and outgoing metadata, and encodes the envelope. Both layers use the transport's codec.
+// A nil args leaves the payload empty.
+//
+// On a v2 connection the metadata goes in the extension area of h, the header the request
+// is sent with, rather than in the envelope: the server reads it without decoding the body.
+// The version only ever goes up, so a frame encoded for v2 is also written as v2.
+func (t *ClientTransport) encodeRequest(ctx context.Context, h *protocol.Header, serviceMethod string, args any) ([]byte, error) {
+	cdc := codec.GetCodec(t.codec)
+	if cdc == nil {
+		return nil, fmt.Errorf("unsupported codec type: %d", t.codec)
+	}
+	rpcMessage := message.RPCMessage{
+		ServiceMethod: serviceMethod,
+		Error:         "",
+	}
+	if args != nil {
+		payload, err := cdc.Encode(args)
+		if err != nil {
+			return nil, err
+		}
+		rpcMessage.Payload = payload
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		rpcMessage.Timeout = time.Until(deadline)
+		if rpcMessage.Timeout <= 0 {
+			return nil, context.DeadlineExceeded
+		}
+	}
+	if md, ok := metadata.FromOutgoingContext(ctx); ok {
+		if ext, ok := protocol.ExtFor(byte(t.version.Load()), md); ok {
+			h.Ext = ext
+		} else {
+			rpcMessage.Metadata = md // v1, or too large for the extension area
+		}
+	}
+	return cdc.Encode(&rpcMessage)
+}
+
+// writeFrame writes one complete frame to the connection, in the negotiated frame format,
+// and returns once it has been written. The very first frame is preceded by the hello that
+// starts version negotiation.
+//
+// Thread safety: frames are handed to the transport's FrameWriter, whose single goroutine
+// writes each frame (header + body) whole — concurrent frames are batched into one write,
+// never interleaved. The hello's sync.Once holds back every other writer until it is queued.
+func (t *ClientTransport) writeFrame(h *protocol.Header, body []byte) error {
+	t.hello.Do(func() {
+		t.writer.WriteFrame(protocol.HelloFrame()) // A failure is sticky: the write below reports it
+	})
+	h.Version = byte(t.version.Load())
+	return t.writer.WriteFrame(h, body)
+}
+
+// writeCompressed writes a request or stream frame with the compressor the caller picked,
+// which only takes effect after the hello exchange: until then the server may not know about
+// compression. Requests over maxRequestSize fail with ResourceExhausted and are never sent.
+func (t *ClientTransport) writeCompressed(h *protocol.Header, body []byte, ct compressor.Type) error {
+	if t.version.Load() < uint32(protocol.Version2) {
+		// A v1 frame can't say it's compressed: the server may predate compression
+		if ct != compressor.None && compressor.Get(ct) == nil {
+			return fmt.Errorf("unsupported compressor type: %d", ct)
+		}
+		ct = compressor.None
+	}
+	body, compressed, err := compressor.Compress(ct, body)
+	if err != nil {
+		return err
+	}
+	if limit := t.maxRequestSize.Load(); uint32(len(body)) > limit {
+		return status.Errorf(status.ResourceExhausted, "message too large: %d bytes exceeds the %d-byte limit", len(body), limit)
+	}
+	h.Compressor = byte(ct)
+	if compressed {
+		h.Flags |= protocol.FlagCompressed
+	}
+	h.BodyLen = uint32(len(body))
+	return t.writeFrame(h, body)
+}
+
+// Cancel stops waiting for the response of the given sequence number.
+// The pending entry is removed, so if the response arrives later, recvLoop simply drops it.
+func (t *ClientTransport) Cancel(seq uint32) {
+	t.pending.Delete(seq)
 }
 
 // recvLoop runs in a dedicated goroutine, continuously reading responses from the connection.
@@ -106,36 +314,182 @@ func (t *ClientTransport) Send(serviceMethod string, args any) (uint32, <-chan *
 // Why a single goroutine for reading? TCP is a byte stream — reads must be sequential
 // to correctly parse frame boundaries. Multiple readers would corrupt the stream.
 func (t *ClientTransport) recvLoop() {
+	header := &protocol.Header{} // Reused for every frame: nothing keeps it past one iteration
 	for {
 		// Read one complete frame from the connection
-		header, body, err := protocol.Decode(t.conn)
+		body, err := protocol.DecodeInto(t.conn, header, t.maxResponseSize.Load())
 		if err != nil {
-			// Connection broken — notify all pending callers
-			t.closeAllPending(err)
+			var tooLarge *protocol.FrameTooLargeError
+			if errors.As(err, &tooLarge) {
+				// The body is still on the wire: fail its call, then give up on the connection
+				t.failFrame(tooLarge.Header, status.Errorf(status.ResourceExhausted,
+					"message too large: %d bytes exceeds the %d-byte limit", tooLarge.Header.BodyLen, tooLarge.Limit))
+				t.conn.Close()
+			}
+			// Connection broken — stop the writer, notify all pending callers, and release
+			// the socket. The writer goes first: a send registers its call before queuing the
+			// frame, and a write can still succeed after the read side failed (e.g., the peer
+			// only half-closed), so once the writer is closed every call that got through is
+			// already in pending, and every later one fails on the writer.
+			if t.deadPeer.Load() {
+				err = ErrHeartbeatTimeout // The read failed because heartbeatLoop gave up on the server
+			}
+			cause := status.Errorf(status.Unavailable, "connection broken: %v", err)
+			if t.closing.Load() {
+				err = ErrClientClosed // We closed it: not a network failure
+				cause = status.Error(status.Canceled, err.Error())
+			}
+			t.writer.Close()
+			t.closeAllPending(cause)
+			t.conn.Close()
+			t.err = err
+			close(t.done)
 			return
 		}
 
+		t.frames.Add(1)
+
+		// Metadata the server sent in the extension area (v2), added to the response below
+		ext, err := protocol.TakeExt(header)
+		if err != nil {
+			t.failFrame(header, status.Errorf(status.Internal, "cannot decode response metadata: %v", err))
+			protocol.ReleaseBody(body)
+			continue
+		}
+
+		// The server's answer to our hello (it speaks v2, so our writes can switch too),
+		// or to a ping: the frame count above is all heartbeatLoop needs from it
+		if header.MsgType == protocol.MsgTypeHeartbeat {
+			if v := protocol.HelloVersion(header, body); v > byte(t.version.Load()) {
+				t.version.Store(uint32(v))
+			} else if len(body) == 0 {
+				t.pongs.Store(true)
+			}
+			protocol.ReleaseBody(body)
+			continue
+		}
+
+		// Flow-control credits carry a raw 4-byte body, not an RPCMessage
+		if header.MsgType == protocol.MsgTypeStreamAck {
+			if cs, ok := t.streams.Load(header.Seq); ok {
+				cs.(*ClientStream).grantCredits(body)
+			}
+			protocol.ReleaseBody(body)
+			continue
+		}
+
+		// Undo the compression the server applied (the same compressor as our request)
+		if header.Flags&protocol.FlagCompressed != 0 {
+			wire := body
+			body, err = compressor.Decompress(compressor.Type(header.Compressor), wire, int(t.maxResponseSize.Load()))
+			protocol.ReleaseBody(wire)
+			if errors.Is(err, compressor.ErrTooLarge) {
+				t.failFrame(header, status.Errorf(status.ResourceExhausted,
+					"message too large: decompressed body exceeds the %d-byte limit", t.maxResponseSize.Load()))
+				continue
+			}
+			if err != nil {
+				t.failFrame(header, status.Errorf(status.Internal, "cannot decompress frame: %v", err))
+				continue
+			}
+		}
+
 		// Deserialize the response body
 		responseRPC := message.RPCMessage{}
 		cdc := codec.GetCodec(codec.CodecType(header.CodecType))
-		cdc.Decode(body, &responseRPC)
+		if err := cdc.Decode(body, &responseRPC); err != nil {
+			t.failFrame(header, status.Errorf(status.Internal, "cannot decode response: %v", err))
+			protocol.ReleaseBody(body)
+			continue
+		}
+		responseRPC.AddMetadata(ext)
+
+		switch header.MsgType {
+		case protocol.MsgTypeStreamData, protocol.MsgTypeStreamEnd:
+			// Stream frames go to the stream's queue; the stream stays registered until its end frame
+			if cs, ok := t.streams.Load(header.Seq); ok {
+				cs.(*ClientStream).deliver(header.MsgType, &responseRPC)
+			}
+		default:
+			// Route the response to the correct caller using the sequence number.
+			// The handler is done with the payload when it returns, so the body is recycled;
+			// stream elements are queued instead, and left to the garbage collector.
+			if onResponse, ok := t.pending.LoadAndDelete(header.Seq); ok {
+				onResponse.(ResponseHandler)(&responseRPC)
+			}
+			protocol.ReleaseBody(body)
+		}
+	}
+}
 
-		// Route the response to the correct caller using the sequence number
-		if channel, ok := t.pending.LoadAndDelete(header.Seq); ok {
-			channel.(chan *message.RPCMessage) <- &responseRPC
+// failFrame fails the call or stream a frame belonged to when the frame can't be read.
+func (t *ClientTransport) failFrame(header *protocol.Header, err error) {
+	switch header.MsgType {
+	case protocol.MsgTypeStreamData, protocol.MsgTypeStreamEnd:
+		if cs, ok := t.streams.Load(header.Seq); ok {
+			cs.(*ClientStream).abort(err)
+			go cs.(*ClientStream).cancel()
+		}
+	default:
+		if onResponse, ok := t.pending.LoadAndDelete(header.Seq); ok {
+			onResponse.(ResponseHandler)(message.NewErrorMessage(err))
 		}
 	}
 }
 
-// closeAllPending is called when the connection breaks. It sends an error message
-// to every pending caller so they don't block forever waiting for a response.
-func (t *ClientTransport) closeAllPending(err error) {
+// closeAllPending is called when the connection breaks. It sends connErr to every pending
+// caller so they don't block forever waiting for a response, and aborts every stream with it.
+//
+// Each entry is removed with LoadAndDelete (instead of Range + Clear) so a handler
+// can never be invoked twice, and a request registered concurrently is not silently dropped.
+func (t *ClientTransport) closeAllPending(connErr error) {
 	t.pending.Range(func(key, value any) bool {
-		channel := value.(chan *message.RPCMessage)
-		channel <- &message.RPCMessage{Error: err.Error()}
+		if onResponse, ok := t.pending.LoadAndDelete(key); ok {
+			onResponse.(ResponseHandler)(message.NewErrorMessage(connErr))
+		}
 		return true
 	})
-	t.pending.Clear()
+	t.streams.Range(func(key, value any) bool {
+		if cs, ok := t.streams.LoadAndDelete(key); ok {
+			cs.(*ClientStream).abort(connErr)
+		}
+		return true
+	})
+}
+
+// Close shuts the transport down: the connection is closed, every pending call fails with a
+// Canceled status ("client closed"), open streams are aborted the same way, and the
+// background goroutines exit. Later calls fail with ErrClientClosed. Close waits for the
+// pending calls to be failed, so none is left waiting when it returns; closing twice is a no-op.
+func (t *ClientTransport) Close() error {
+	if !t.closing.CompareAndSwap(false, true) {
+		<-t.done
+		return nil
+	}
+	err := t.conn.Close() // recvLoop's read fails right away, and it cleans up
+	<-t.done
+	if t.Err() != ErrClientClosed {
+		return nil // The connection was already broken: nothing of ours to report
+	}
+	return err
+}
+
+// Done returns a channel that is closed once the connection is broken (read error, peer
+// gone, oversized frame). A broken transport never recovers: every pending call has failed
+// with Unavailable and every later call fails too, so its owner should drop it and dial a
+// new one (Client does so on its own).
+func (t *ClientTransport) Done() <-chan struct{} {
+	return t.done
+}
+
+// Err returns why the connection broke, or nil while it is still usable.
+func (t *ClientTransport) Err() error {
+	select {
+	case <-t.done:
+		return t.err
+	default:
+		return nil
+	}
 }
 
 // Conn returns the underlying TCP connection.
@@ -143,22 +497,49 @@ func (t *ClientTransport) Conn() net.Conn {
 	return t.conn
 }
 
-// heartbeatLoop sends periodic heartbeat frames to keep the connection alive.
-// If the server doesn't receive any data for a long time, it may close the connection.
-// Heartbeat frames have MsgType=Heartbeat and no body, so they're very lightweight.
+// heartbeatLoop pings the server periodically, until the connection breaks: a heartbeat frame
+// (MsgType=Heartbeat, no body, Seq = ping number) that the server answers in kind. It keeps
+// idle connections alive through NATs and server idle timeouts, and detects a dead server
+// that TCP alone would only notice after minutes: when heartbeatMisses pings in a row go by
+// without a single frame from the server, the connection is closed, failing every pending
+// call with ErrHeartbeatTimeout (and the Client redials on the next call).
+//
+// A server that never answered a ping (an older version) is not held to it: only
+// a connection that has seen a pong can time out.
 func (t *ClientTransport) heartbeatLoop(interval time.Duration) {
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
-	for range ticker.C {
+	var ping uint32
+	var framesAtPing uint64
+	missed := 0
+	for {
+		select {
+		case <-ticker.C:
+		case <-t.done:
+			return // Connection broken, nothing left to keep alive
+		}
+
+		// Step 1: Has anything arrived since the previous ping?
+		if frames := t.frames.Load(); ping > 0 && frames == framesAtPing {
+			missed++
+		} else {
+			missed = 0
+			framesAtPing = frames
+		}
+		if t.heartbeatMisses > 0 && missed >= t.heartbeatMisses && t.pongs.Load() {
+			t.deadPeer.Store(true)
+			t.conn.Close() // recvLoop's read fails, and it fails the pending calls
+			return
+		}
+
+		// Step 2: Ping — heartbeats go through the frame writer like every other frame
+		ping++
 		header := &protocol.Header{
 			MsgType: protocol.MsgTypeHeartbeat,
+			Seq:     ping,
 			BodyLen: 0,
 		}
-		// Heartbeat writes also need the sending lock to avoid frame interleaving
-		t.sending.Lock()
-		err := protocol.Encode(t.conn, header, nil)
-		t.sending.Unlock()
-		if err != nil {
+		if err := t.writeFrame(header, nil); err != nil {
 			return // Connection broken, exit heartbeat loop
 		}
 	}
@@ -1,10 +1,22 @@
 package transport
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"io"
+	"math"
 	"mini-rpc/codec"
+	"mini-rpc/compressor"
+	"mini-rpc/internal/leakcheck"
+	"mini-rpc/message"
+	"mini-rpc/metadata"
+	"mini-rpc/protocol"
 	"mini-rpc/server"
+	"mini-rpc/status"
 	"net"
+	"runtime"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -25,6 +37,11 @@ func (a *Arith) Add(args *Args, reply *Reply) error {
 	return nil
 }
 
+func (a *Arith) Sleep(args *Args, reply *Reply) error {
+	time.Sleep(time.Duration(args.A) * time.Millisecond)
+	return nil
+}
+
 // 测试单连接上串行发送多个请求
 func TestClientTransportSerial(t *testing.T) {
 	svr := server.NewServer()
@@ -121,3 +138,560 @@ func TestClientTransportConcurrent(t *testing.T) {
 
 	wg.Wait()
 }
+
+// 测试 SendContext：deadline 已过直接失败；Cancel 后 pending 被清理，迟到的响应被丢弃
+func TestClientTransportSendContextCancel(t *testing.T) {
+	svr := server.NewServer()
+	if err := svr.Register(&Arith{}); err != nil {
+		t.Fatal(err)
+	}
+	go svr.Serve("tcp", ":9003", "", nil)
+	time.Sleep(100 * time.Millisecond)
+
+	conn, err := net.Dial("tcp", ":9003")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ct := NewClientTransport(conn, codec.CodecTypeJSON)
+
+	expired, cancel := context.WithTimeout(context.Background(), -time.Second)
+	defer cancel()
+	if _, _, err := ct.SendContext(expired, "Arith.Add", &Args{A: 1, B: 2}); err != context.DeadlineExceeded {
+		t.Fatalf("expect context.DeadlineExceeded, got %v", err)
+	}
+
+	seq, ch, err := ct.SendContext(context.Background(), "Arith.Sleep", &Args{A: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ct.Cancel(seq)
+	if _, ok := ct.pending.Load(seq); ok {
+		t.Fatal("expect pending entry to be removed by Cancel")
+	}
+
+	// 迟到的响应不应该再投递到已取消的 channel
+	select {
+	case resp := <-ch:
+		t.Fatalf("expect late response to be dropped, got %+v", resp)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+// 测试压缩：v1 帧不压缩（老服务端读不了）；协商到 v2 后，请求按 ctx 选择的算法压缩，
+// 响应按帧头里的算法解压
+func TestClientTransportCompression(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+	ct := NewClientTransport(clientConn, codec.CodecTypeJSON)
+	cdc := codec.GetCodec(codec.CodecTypeJSON)
+
+	text := strings.Repeat("compress me ", 1000)
+	go func() {
+		// 第一帧是版本协商的 hello，假服务端应答它，之后的请求走 v2
+		header, body, err := protocol.Decode(serverConn)
+		if err != nil || header.MsgType != protocol.MsgTypeHeartbeat {
+			t.Errorf("expect a hello first, got %v (%v)", header, err)
+			return
+		}
+		hello, helloBody := protocol.HelloFrame()
+		protocol.Encode(serverConn, hello, helloBody)
+
+		for i := 0; i < 2; i++ {
+			header, body, err = protocol.Decode(serverConn)
+			if err != nil {
+				return
+			}
+			if header.Flags&protocol.FlagCompressed == 0 {
+				// 第一个请求在 hello 的应答到达之前就决定了不压缩（帧头可能已经是 v2）
+				if i == 1 || header.Compressor != 0 || int(header.BodyLen) < len(text) {
+					t.Errorf("expect only the first request uncompressed, got %+v", header)
+				}
+			} else {
+				// 帧头带上了 gzip，且正文确实被压缩过
+				if header.Version != protocol.Version2 || header.Compressor != byte(compressor.Gzip) || int(header.BodyLen) >= len(text) {
+					t.Errorf("expect a gzip-compressed v2 request, got %+v", header)
+				}
+				body, err = compressor.Decompress(compressor.Gzip, body, protocol.DefaultMaxBodySize)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+			var req message.RPCMessage
+			cdc.Decode(body, &req)
+
+			// 原样回显，v2 连接上同样用 gzip 压缩
+			reply, _ := cdc.Encode(&message.RPCMessage{Payload: req.Payload})
+			rh := &protocol.Header{Version: header.Version, MsgType: protocol.MsgTypeResponse, Seq: header.Seq}
+			if header.Version == protocol.Version2 {
+				reply, _, _ = compressor.Compress(compressor.Gzip, reply)
+				rh.Flags, rh.Compressor = protocol.FlagCompressed, byte(compressor.Gzip)
+			}
+			rh.BodyLen = uint32(len(reply))
+			protocol.Encode(serverConn, rh, reply)
+		}
+	}()
+
+	ctx := compressor.NewContext(context.Background(), compressor.Gzip)
+	for i := 0; i < 2; i++ {
+		_, ch, err := ct.SendContext(ctx, "Echo.Echo", text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var resp *message.RPCMessage
+		select {
+		case resp = <-ch:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for the echo")
+		}
+		var got string
+		if err := cdc.Decode(resp.Payload, &got); err != nil {
+			t.Fatal(err)
+		}
+		if got != text {
+			t.Fatalf("expect the echoed text, got %d bytes", len(got))
+		}
+	}
+	if v := ct.version.Load(); v != uint32(protocol.Version2) {
+		t.Fatalf("expect v2 after negotiation, got v%d", v)
+	}
+}
+
+// 测试版本协商：对 v2 服务端，收到 hello 应答后切换到 v2；单向请求不等待响应
+func TestClientTransportVersionNegotiation(t *testing.T) {
+	svr := server.NewServer()
+	if err := svr.Register(&Arith{}); err != nil {
+		t.Fatal(err)
+	}
+	go svr.Serve("tcp", ":9004", "", nil)
+	time.Sleep(100 * time.Millisecond)
+
+	conn, err := net.Dial("tcp", ":9004")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ct := NewClientTransport(conn, codec.CodecTypeJSON)
+
+	// 第一个请求仍是 v1 帧（hello 的应答还没到），之后的请求走 v2
+	for i := 0; i < 2; i++ {
+		_, ch, err := ct.Send("Arith.Add", &Args{A: i, B: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := <-ch
+		var reply Reply
+		if err := json.Unmarshal(resp.Payload, &reply); err != nil || reply.Result != i+1 {
+			t.Fatalf("expect %d, got %d (%v)", i+1, reply.Result, err)
+		}
+	}
+	if v := ct.version.Load(); v != uint32(protocol.Version2) {
+		t.Fatalf("expect v2 after negotiation, got v%d", v)
+	}
+
+	// 单向请求：不注册 pending，服务端也不回复
+	if err := ct.SendOneWay(context.Background(), "Arith.Add", &Args{A: 1, B: 1}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	n := 0
+	ct.pending.Range(func(key, value any) bool { n++; return true })
+	if n != 0 {
+		t.Fatalf("expect no pending requests, got %d", n)
+	}
+}
+
+// 测试消息大小限制：超限的请求不发送；超限的响应让调用失败并关闭连接
+func TestClientTransportMaxMessageSize(t *testing.T) {
+	svr := server.NewServer()
+	if err := svr.Register(&Arith{}); err != nil {
+		t.Fatal(err)
+	}
+	go svr.Serve("tcp", ":9005", "", nil)
+	time.Sleep(100 * time.Millisecond)
+
+	conn, err := net.Dial("tcp", ":9005")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ct := NewClientTransport(conn, codec.CodecTypeJSON)
+
+	// 请求超限：直接返回 ResourceExhausted，连接不受影响
+	ct.SetMaxRequestSize(16)
+	var st *status.Status
+	if _, _, err := ct.Send("Arith.Add", &Args{A: 1, B: 2}); !errors.As(err, &st) || st.Code != status.ResourceExhausted {
+		t.Fatalf("expect ResourceExhausted, got %v", err)
+	}
+	ct.SetMaxRequestSize(protocol.DefaultMaxBodySize)
+
+	// 响应超限：这次调用得到 ResourceExhausted
+	ct.SetMaxResponseSize(16)
+	_, ch, err := ct.Send("Arith.Add", &Args{A: 1, B: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := (<-ch).Status(); st == nil || st.Code != status.ResourceExhausted {
+		t.Fatalf("expect ResourceExhausted, got %v", st)
+	}
+
+	// 连接已关闭，后续请求失败
+	time.Sleep(50 * time.Millisecond)
+	if _, _, err := ct.Send("Arith.Add", &Args{A: 1, B: 2}); err == nil {
+		t.Fatal("expect the connection to be closed")
+	}
+
+	// 帧头表示不了的上限（负数、超过 uint32）直接 panic，而不是悄悄截断
+	limits := []int{-1}
+	if uint64(math.MaxInt) > math.MaxUint32 {
+		limits = append(limits, math.MaxInt)
+	}
+	for _, n := range limits {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("expect SetMaxResponseSize(%d) to panic", n)
+				}
+			}()
+			ct.SetMaxResponseSize(n)
+		}()
+	}
+}
+
+// 测试连接断开后 Done 被关闭、Err 给出原因
+func TestClientTransportDone(t *testing.T) {
+	svr := server.NewServer()
+	if err := svr.Register(&Arith{}); err != nil {
+		t.Fatal(err)
+	}
+	go svr.Serve("tcp", ":9006", "", nil)
+	time.Sleep(100 * time.Millisecond)
+
+	conn, err := net.Dial("tcp", ":9006")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ct := NewClientTransport(conn, codec.CodecTypeJSON)
+	if _, ch, err := ct.Send("Arith.Add", &Args{A: 1, B: 2}); err != nil || (<-ch).Status() != nil {
+		t.Fatalf("expect the call to succeed, got %v", err)
+	}
+	if err := ct.Err(); err != nil {
+		t.Fatalf("expect a live transport, got %v", err)
+	}
+
+	// 慢请求还在路上时连接被关掉：调用收到 Unavailable，Done 关闭
+	_, ch, err := ct.Send("Arith.Sleep", &Args{A: 200})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	select {
+	case <-ct.Done():
+	case <-time.After(time.Second):
+		t.Fatal("expect Done to be closed after the connection broke")
+	}
+	if ct.Err() == nil {
+		t.Fatal("expect Err to report why the connection broke")
+	}
+	if st := (<-ch).Status(); st == nil || st.Code != status.Unavailable {
+		t.Fatalf("expect Unavailable, got %v", st)
+	}
+
+	// 之后的请求直接失败
+	if _, _, err := ct.Send("Arith.Add", &Args{A: 1, B: 2}); err == nil {
+		t.Fatal("expect Send on a broken transport to fail")
+	}
+}
+
+// 测试 WithHeartbeatInterval：按设定的间隔发心跳，0 表示不发
+func TestClientTransportOptions(t *testing.T) {
+	ln, err := net.Listen("tcp", ":9007")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// 统计 200ms 内收到的心跳帧（不算 hello）
+	countHeartbeats := func(opts ...Option) int {
+		conn, err := net.Dial("tcp", ":9007")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		peer, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer peer.Close()
+
+		NewClientTransport(conn, codec.CodecTypeJSON, opts...)
+		peer.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		n := 0
+		for {
+			header, body, err := protocol.Decode(peer)
+			if err != nil {
+				return n
+			}
+			if header.MsgType == protocol.MsgTypeHeartbeat && len(body) == 0 {
+				n++
+			}
+		}
+	}
+
+	if n := countHeartbeats(WithHeartbeatInterval(20 * time.Millisecond)); n < 5 {
+		t.Fatalf("expect a heartbeat every 20ms, got %d in 200ms", n)
+	}
+	if n := countHeartbeats(WithHeartbeatInterval(0)); n != 0 {
+		t.Fatalf("expect no heartbeats, got %d", n)
+	}
+
+	// 其余选项落到对应字段上
+	conn, err := net.Dial("tcp", ":9007")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ct := NewClientTransport(conn, codec.CodecTypeJSON, WithMaxRequestSize(100), WithMaxResponseSize(200))
+	if ct.maxRequestSize.Load() != 100 || ct.maxResponseSize.Load() != 200 {
+		t.Fatal("expect the size limits from the options")
+	}
+}
+
+// 测试 Close：挂起的调用收到 "client closed"，之后的调用直接失败，后台 goroutine 全部退出
+func TestClientTransportClose(t *testing.T) {
+	svr := server.NewServer()
+	if err := svr.Register(&Arith{}); err != nil {
+		t.Fatal(err)
+	}
+	go svr.Serve("tcp", ":9008", "", nil)
+	time.Sleep(100 * time.Millisecond)
+	base := runtime.NumGoroutine()
+
+	conn, err := net.Dial("tcp", ":9008")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ct := NewClientTransport(conn, codec.CodecTypeJSON, WithHeartbeatInterval(10*time.Millisecond))
+	_, ch, err := ct.Send("Arith.Sleep", &Args{A: 300})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	if err := ct.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Close 返回时挂起的调用已经失败了
+	select {
+	case resp := <-ch:
+		if st := resp.Status(); st == nil || st.Code != status.Canceled || st.Message != "client closed" {
+			t.Fatalf("expect Canceled \"client closed\", got %v", st)
+		}
+	default:
+		t.Fatal("expect the pending call to have failed when Close returns")
+	}
+	if _, _, err := ct.Send("Arith.Add", &Args{A: 1, B: 2}); !errors.Is(err, ErrClientClosed) {
+		t.Fatalf("expect ErrClientClosed, got %v", err)
+	}
+	if !errors.Is(ct.Err(), ErrClientClosed) {
+		t.Fatalf("expect Err to be ErrClientClosed, got %v", ct.Err())
+	}
+	if err := ct.Close(); err != nil {
+		t.Fatalf("expect a second Close to be a no-op, got %v", err)
+	}
+
+	// recvLoop、heartbeatLoop、写 goroutine，以及服务端这条连接上的 goroutine 都退出
+	leakcheck.Check(t, base)
+}
+
+// 测试心跳超时：服务端回过 pong 之后不再应答，连续 2 次 ping 没有回音就断开连接；
+// 从没回过 pong 的老服务端不受影响
+func TestClientTransportHeartbeatTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", ":9009")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// fakeServer 读所有帧，前 pongs 个 ping 回 pong，之后只读不答
+	fakeServer := func(pongs int) {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			header, body, err := protocol.Decode(conn)
+			if err != nil {
+				return
+			}
+			if header.MsgType == protocol.MsgTypeHeartbeat && len(body) == 0 && pongs > 0 {
+				pongs--
+				protocol.Encode(conn, &protocol.Header{MsgType: protocol.MsgTypeHeartbeat, Seq: header.Seq}, nil)
+			}
+		}
+	}
+
+	// 1. 回过 3 次 pong 后失联：连接被断开，挂起的调用收到 Unavailable
+	go fakeServer(3)
+	conn, err := net.Dial("tcp", ":9009")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ct := NewClientTransport(conn, codec.CodecTypeJSON, WithHeartbeatInterval(20*time.Millisecond), WithHeartbeatMisses(2))
+	_, ch, err := ct.Send("Arith.Add", &Args{A: 1, B: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-ct.Done():
+	case <-time.After(time.Second):
+		t.Fatal("expect the transport to give up on a silent server")
+	}
+	if !errors.Is(ct.Err(), ErrHeartbeatTimeout) {
+		t.Fatalf("expect ErrHeartbeatTimeout, got %v", ct.Err())
+	}
+	if st := (<-ch).Status(); st == nil || st.Code != status.Unavailable || !strings.Contains(st.Message, "heartbeat timeout") {
+		t.Fatalf("expect Unavailable (heartbeat timeout), got %v", st)
+	}
+
+	// 2. 从不回 pong 的服务端（老版本）：连接保持
+	go fakeServer(0)
+	conn, err = net.Dial("tcp", ":9009")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := NewClientTransport(conn, codec.CodecTypeJSON, WithHeartbeatInterval(20*time.Millisecond), WithHeartbeatMisses(2))
+	defer old.Close()
+	time.Sleep(200 * time.Millisecond)
+	if err := old.Err(); err != nil {
+		t.Fatalf("expect a server that never answered pings to be left alone, got %v", err)
+	}
+}
+
+// 测试服务端半关闭（只关写端）：读端失败时写仍可能成功，
+// 每个发出去的请求都必须收到结果，不能在 pending 里挂住
+func TestClientTransportHalfClose(t *testing.T) {
+	ln, err := net.Listen("tcp", ":9010")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	for range 20 {
+		conn, err := net.Dial("tcp", ":9010")
+		if err != nil {
+			t.Fatal(err)
+		}
+		peer, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		go io.Copy(io.Discard, peer) // 一直读，客户端的写不会失败
+
+		ct := NewClientTransport(conn, codec.CodecTypeJSON, WithHeartbeatInterval(0))
+		var wg sync.WaitGroup
+		for range 8 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					_, ch, err := ct.Send("Arith.Add", &Args{A: 1, B: 2})
+					if err != nil {
+						return // 写端关了
+					}
+					select {
+					case <-ch:
+					case <-time.After(time.Second):
+						t.Error("expect every sent call to complete after the server half-closed")
+						return
+					}
+				}
+			}()
+		}
+		time.Sleep(5 * time.Millisecond)
+		peer.(*net.TCPConn).CloseWrite()
+		wg.Wait()
+		ct.Close()
+		peer.Close()
+	}
+}
+
+// 测试 metadata 的传输位置：v1 帧放在 RPCMessage 里，协商到 v2 后放在扩展区
+func TestClientTransportExtMetadata(t *testing.T) {
+	ln, err := net.Listen("tcp", ":9011")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// 假服务端：应答 hello，检查每个请求的 metadata 在哪，再按同样的方式回一个
+	go func() {
+		peer, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer peer.Close()
+		cdc := codec.GetCodec(codec.CodecTypeJSON)
+		for i := 0; i < 3; i++ {
+			header, body, err := protocol.Decode(peer)
+			if err != nil {
+				return
+			}
+			if header.MsgType == protocol.MsgTypeHeartbeat {
+				hello, v := protocol.HelloFrame()
+				protocol.Encode(peer, hello, v)
+				continue
+			}
+			if i == 2 && header.Version != protocol.Version2 {
+				t.Error("expect the second request to be a v2 frame")
+			}
+			var req message.RPCMessage
+			cdc.Decode(body, &req)
+			ext, err := protocol.TakeExt(header)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp := &message.RPCMessage{}
+			reply := &protocol.Header{Version: header.Version, CodecType: header.CodecType, MsgType: protocol.MsgTypeResponse, Seq: header.Seq}
+			if header.Version == protocol.Version2 {
+				if req.Metadata != nil || ext["trace-id"] != "abc" {
+					t.Errorf("expect the metadata in the extension area of a v2 frame, got %v and %v", req.Metadata, ext)
+				}
+				reply.Ext, _ = protocol.EncodeExt(map[string]string{"echo": ext["trace-id"]})
+			} else {
+				if ext != nil || req.Metadata["trace-id"] != "abc" {
+					t.Errorf("expect the metadata in the body of a v1 frame, got %v and %v", req.Metadata, ext)
+				}
+				resp.Metadata = map[string]string{"echo": req.Metadata["trace-id"]}
+			}
+			out, _ := cdc.Encode(resp)
+			reply.BodyLen = uint32(len(out))
+			protocol.Encode(peer, reply, out)
+		}
+	}()
+
+	conn, err := net.Dial("tcp", ":9011")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ct := NewClientTransport(conn, codec.CodecTypeJSON, WithHeartbeatInterval(0))
+	defer ct.Close()
+
+	// 第一个请求是 v1 帧，第二个走 v2；两种方式都能拿到响应 metadata
+	ctx := metadata.NewOutgoingContext(context.Background(), metadata.Pairs("trace-id", "abc"))
+	for i := 0; i < 2; i++ {
+		ch := make(chan *message.RPCMessage, 1)
+		if _, err := ct.SendAsync(ctx, "Arith.Add", &Args{}, func(resp *message.RPCMessage) { ch <- resp }); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case resp := <-ch:
+			if resp.Metadata["echo"] != "abc" {
+				t.Fatalf("request %d: expect the response metadata, got %v", i, resp.Metadata)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("request %d: no response", i)
+		}
+	}
+}
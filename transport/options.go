@@ -0,0 +1,58 @@
+package transport
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"time"
+)
+
+// Heartbeat defaults: a ping every DefaultHeartbeatInterval, and the connection is torn down
+// after DefaultHeartbeatMisses pings in a row go unanswered (about 1.5 minutes).
+const (
+	DefaultHeartbeatInterval = 30 * time.Second
+	DefaultHeartbeatMisses   = 3
+)
+
+// Option configures a ClientTransport at construction:
+// transport.NewClientTransport(conn, codecType, transport.WithHeartbeatInterval(5*time.Second)).
+type Option func(*ClientTransport)
+
+// WithHeartbeatInterval sets how often heartbeats are sent (default DefaultHeartbeatInterval);
+// 0 or less turns them off.
+func WithHeartbeatInterval(d time.Duration) Option {
+	return func(t *ClientTransport) { t.heartbeatInterval = d }
+}
+
+// WithHeartbeatMisses sets how many pings in a row may go by without any frame from the
+// server before the connection is closed as dead (default DefaultHeartbeatMisses); 0 or less
+// keeps a silent connection open. Detection takes between n and n+1 heartbeat intervals.
+func WithHeartbeatMisses(n int) Option {
+	return func(t *ClientTransport) { t.heartbeatMisses = n }
+}
+
+// WithMaxRequestSize sets the largest request body the transport sends; see SetMaxRequestSize.
+func WithMaxRequestSize(n int) Option {
+	limit := sizeLimit("WithMaxRequestSize", n)
+	return func(t *ClientTransport) { t.maxRequestSize.Store(limit) }
+}
+
+// WithMaxResponseSize sets the largest response body the transport accepts; see SetMaxResponseSize.
+func WithMaxResponseSize(n int) Option {
+	limit := sizeLimit("WithMaxResponseSize", n)
+	return func(t *ClientTransport) { t.maxResponseSize.Store(limit) }
+}
+
+// sizeLimit converts a body size limit for storage, panicking if it doesn't fit: a frame
+// header announces at most math.MaxUint32 bytes, and a negative limit is a programming error.
+func sizeLimit(name string, n int) uint32 {
+	if n < 0 || uint64(n) > math.MaxUint32 {
+		panic(fmt.Sprintf("transport: %s(%d) out of range 0-%d", name, n, uint32(math.MaxUint32)))
+	}
+	return uint32(n)
+}
+
+// WithLogger sends the transport's log output to l instead of the standard logger.
+func WithLogger(l *log.Logger) Option {
+	return func(t *ClientTransport) { t.logger = l }
+}
@@ -0,0 +1,291 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"io"
+	"mini-rpc/codec"
+	"mini-rpc/compressor"
+	"mini-rpc/message"
+	"mini-rpc/metadata"
+	"mini-rpc/protocol"
+	"mini-rpc/status"
+	"sync"
+	"sync/atomic"
+)
+
+// ClientStream is the client side of a streaming call, opened with OpenStream.
+//
+// Receive side: frames for the stream are pushed by recvLoop into a bounded queue. The queue
+// never blocks recvLoop: the server may only have DefaultStreamWindow data frames in flight
+// (flow control), so the queue holds at most that many elements plus the end frame. A server
+// that ignores the window gets its stream aborted instead of stalling every other call on
+// the connection.
+//
+// Send side: Send waits for credits from the server (MsgTypeStreamAck), so a client uploading
+// faster than the handler calls Recv blocks on its own stream. CloseSend half-closes the
+// stream: the handler's Recv returns io.EOF, while the server can keep sending.
+type ClientStream struct {
+	t          *ClientTransport
+	seq        uint32          // Seq of the StreamOpen frame — the stream ID
+	ctx        context.Context // Bounds the whole stream, not just one Recv
+	compressor compressor.Type // Chosen at open time (compressor.NewContext), used for every frame
+	queue      chan streamFrame
+
+	consumed int         // Data frames received since the last ack (only touched by Recv)
+	err      error       // Sticky terminal error: io.EOF, the final status, or an abort reason
+	trailer  metadata.MD // Response metadata from the end frame (only touched by Recv)
+
+	abortOnce sync.Once
+	aborted   chan struct{} // Closed when the stream fails without an end frame
+	abortErr  error         // Set before aborted is closed
+
+	window     *protocol.Window // Send credits granted by the server; closed once the stream is over
+	sendMu     sync.Mutex       // Orders data frames before the half-close frame
+	sendClosed bool             // Set by CloseSend
+}
+
+// streamFrame is one queued stream frame (data or end).
+type streamFrame struct {
+	msgType protocol.MsgType
+	msg     *message.RPCMessage
+}
+
+// OpenStream starts a streaming call: it sends a MsgTypeStreamOpen frame carrying args
+// (plus ctx's deadline and metadata) and returns the stream. args is the input of a
+// server-streaming method; pass nil for client-streaming and bidirectional methods,
+// whose input is sent with Send.
+//
+// A compressor chosen with compressor.NewContext applies to every frame of the stream,
+// in both directions. ctx bounds the whole stream. When it is done, Recv returns ctx.Err() and the server is told
+// to stop (MsgTypeStreamCancel), so the handler's ctx is cancelled too.
+func (t *ClientTransport) OpenStream(ctx context.Context, serviceMethod string, args any) (*ClientStream, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// Step 1: Encode the open frame exactly like a unary request
+	header := &protocol.Header{
+		CodecType: byte(t.codec),
+		MsgType:   protocol.MsgTypeStreamOpen,
+	}
+	body, err := t.encodeRequest(ctx, header, serviceMethod, args)
+	if err != nil {
+		return nil, err
+	}
+
+	// Step 2: Register the stream BEFORE sending (the first data frame may arrive right away)
+	ct, _ := compressor.FromContext(ctx)
+	cs := &ClientStream{
+		t:          t,
+		seq:        atomic.AddUint32(&t.seq, 1),
+		ctx:        ctx,
+		compressor: ct,
+		queue:      make(chan streamFrame, protocol.DefaultStreamWindow+1), // Window + end frame
+		aborted:    make(chan struct{}),
+		window:     protocol.NewWindow(protocol.DefaultStreamWindow),
+	}
+	t.streams.Store(cs.seq, cs)
+
+	// Step 3: Write the open frame
+	header.Seq = cs.seq
+	err = t.writeCompressed(header, body, cs.compressor)
+	if err != nil {
+		t.streams.Delete(cs.seq)
+		return nil, err
+	}
+	return cs, nil
+}
+
+// Send serializes v and sends it to the handler as one stream element, blocking while
+// the server has no credits left for this stream.
+//
+// If the stream is already over (the handler returned, or the stream was cancelled or
+// broken), Send returns io.EOF; the reason is then reported by Recv.
+// Send must not be called concurrently from multiple goroutines, but may run
+// concurrently with Recv.
+func (cs *ClientStream) Send(v any) error {
+	cdc := codec.GetCodec(cs.t.codec)
+	payload, err := cdc.Encode(v)
+	if err != nil {
+		return err
+	}
+	body, err := cdc.Encode(&message.RPCMessage{Payload: payload})
+	if err != nil {
+		return err
+	}
+
+	if err := cs.window.Acquire(cs.ctx); err != nil {
+		if errors.Is(err, protocol.ErrWindowClosed) {
+			return io.EOF
+		}
+		return err
+	}
+
+	cs.sendMu.Lock()
+	defer cs.sendMu.Unlock()
+	if cs.sendClosed {
+		return status.Error(status.FailedPrecondition, "send on a stream after CloseSend")
+	}
+	err = cs.t.writeCompressed(&protocol.Header{
+		CodecType: byte(cs.t.codec),
+		MsgType:   protocol.MsgTypeStreamData,
+		Seq:       cs.seq,
+	}, body, cs.compressor)
+	if err != nil {
+		cs.window.Grant(1) // Nothing reached the server (e.g., element over the size limit): keep the credit
+	}
+	return err
+}
+
+// CloseSend half-closes the stream: the handler's Recv returns io.EOF once it has read
+// every element sent before. Results can still be read with Recv. Calling CloseSend
+// more than once is a no-op.
+func (cs *ClientStream) CloseSend() error {
+	cs.sendMu.Lock()
+	defer cs.sendMu.Unlock()
+	if cs.sendClosed {
+		return nil
+	}
+	cs.sendClosed = true
+
+	body, err := codec.GetCodec(cs.t.codec).Encode(&message.RPCMessage{})
+	if err != nil {
+		return err
+	}
+	return cs.t.writeCompressed(&protocol.Header{
+		CodecType: byte(cs.t.codec),
+		MsgType:   protocol.MsgTypeStreamEnd,
+		Flags:     protocol.FlagStreamEnd,
+		Seq:       cs.seq,
+	}, body, cs.compressor)
+}
+
+// Recv returns the next stream element. At the end of the stream it returns io.EOF if the
+// handler succeeded, or the handler's error as a *status.Status. Once Recv has returned an
+// error, every later call returns the same error.
+//
+// Recv must not be called concurrently from multiple goroutines.
+func (cs *ClientStream) Recv() (*message.RPCMessage, error) {
+	if cs.err != nil {
+		return nil, cs.err
+	}
+
+	// Frames that arrived before an abort or cancellation are still delivered first
+	select {
+	case f := <-cs.queue:
+		return cs.handle(f)
+	default:
+	}
+
+	select {
+	case f := <-cs.queue:
+		return cs.handle(f)
+	case <-cs.aborted:
+		cs.err = cs.abortErr
+	case <-cs.ctx.Done():
+		cs.err = cs.ctx.Err()
+		cs.cancel()
+	}
+	return nil, cs.err
+}
+
+// Trailer returns the response metadata the handler set with metadata.SetResponse, which
+// the server sends with the end of the stream. It is nil until Recv has returned io.EOF or
+// the handler's status, and stays nil if the stream was cancelled or broken instead.
+//
+// Trailer must not be called concurrently with Recv.
+func (cs *ClientStream) Trailer() metadata.MD {
+	return cs.trailer
+}
+
+// Close abandons the stream: the server is told to stop, and frames still in flight are dropped.
+// Calling Close after Recv has returned an error is a no-op.
+//
+// Close must not be called concurrently with Recv.
+func (cs *ClientStream) Close() error {
+	if cs.err != nil {
+		return nil
+	}
+	cs.err = status.Error(status.Canceled, "stream closed")
+	cs.cancel()
+	return nil
+}
+
+// handle processes one dequeued frame.
+func (cs *ClientStream) handle(f streamFrame) (*message.RPCMessage, error) {
+	if f.msgType == protocol.MsgTypeStreamEnd {
+		// The server is done with this stream ID — stop routing frames to us
+		cs.t.streams.Delete(cs.seq)
+		cs.trailer = f.msg.Metadata
+		if st := f.msg.Status(); st != nil {
+			cs.err = st
+		} else {
+			cs.err = io.EOF
+		}
+		return nil, cs.err
+	}
+
+	// Return credits in batches of half a window: fewer ack frames, and the server
+	// still has the other half to keep sending while the ack is in flight
+	cs.consumed++
+	if cs.consumed >= protocol.DefaultStreamWindow/2 {
+		cs.t.writeFrame(&protocol.Header{
+			CodecType: byte(cs.t.codec),
+			MsgType:   protocol.MsgTypeStreamAck,
+			Seq:       cs.seq,
+			BodyLen:   4,
+		}, protocol.EncodeCredits(uint32(cs.consumed)))
+		cs.consumed = 0
+	}
+	return f.msg, nil
+}
+
+// deliver is called by recvLoop for every data/end frame of this stream. It must not block.
+func (cs *ClientStream) deliver(msgType protocol.MsgType, msg *message.RPCMessage) {
+	if msgType == protocol.MsgTypeStreamEnd {
+		// The handler has returned: unblock a Send waiting for credits that will never come
+		cs.window.Close()
+	}
+	select {
+	case cs.queue <- streamFrame{msgType: msgType, msg: msg}:
+	default:
+		// More frames in flight than the window allows: the server ignored flow control.
+		// Drop the stream (and tell the server) rather than block recvLoop.
+		cs.abort(status.Errorf(status.ResourceExhausted, "stream %d: peer exceeded flow-control window", cs.seq))
+		go cs.cancel()
+	}
+}
+
+// grantCredits applies a MsgTypeStreamAck frame from the server to the send window.
+func (cs *ClientStream) grantCredits(body []byte) {
+	n, err := protocol.DecodeCredits(body)
+	if err != nil {
+		cs.t.logger.Printf("Invalid stream ack for seq %d: %v", cs.seq, err)
+		return
+	}
+	cs.window.Grant(int(n))
+}
+
+// abort fails the stream without an end frame (connection broken, protocol violation).
+func (cs *ClientStream) abort(err error) {
+	cs.abortOnce.Do(func() {
+		cs.abortErr = err
+		close(cs.aborted)
+		cs.window.Close()
+	})
+}
+
+// cancel unregisters the stream and tells the server to cancel the handler.
+// Frames the server sent before it saw the cancel are dropped by recvLoop.
+func (cs *ClientStream) cancel() {
+	cs.window.Close()
+	if _, ok := cs.t.streams.LoadAndDelete(cs.seq); !ok {
+		return // Already ended or cancelled
+	}
+	cs.t.writeFrame(&protocol.Header{
+		CodecType: byte(cs.t.codec),
+		MsgType:   protocol.MsgTypeStreamCancel,
+		Seq:       cs.seq,
+	}, nil)
+}